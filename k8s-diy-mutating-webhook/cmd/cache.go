@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// responseCache holds the mutation results of recently admitted objects, so identical objects, like the pods
+// of a ReplicaSet scaling up, reuse the computed patch. It is a bounded LRU whose entries expire after the ttl.
+// Only the mutation result is cached, the response and its UID are built for every request.
+type responseCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	expires time.Time
+	result  *mutationResult
+}
+
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// responseCacheKey hashes everything the mutation result depends on: the config generation, the resource,
+// the namespace, its labels and LimitRanges, and the raw object. A result computed with the previous config
+// while it is reloaded is cached under the previous generation, so later requests never get it.
+func responseCacheKey(resource metav1.GroupVersionResource, namespace string, generation uint64, opts patchOptions, raw []byte) string {
+	namespaceLabels := opts.namespaceLabels
+	hash := sha256.New()
+	for _, part := range []string{strconv.FormatUint(generation, 10), resource.String(), namespace, strconv.FormatBool(opts.limitRangeDefaults)} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	keys := make([]string, 0, len(namespaceLabels))
+	for key := range namespaceLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write([]byte{'='})
+		hash.Write([]byte(namespaceLabels[key]))
+		hash.Write([]byte{0})
+	}
+	hash.Write(raw)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// get returns the cached result for the key, nil if there is none or it expired.
+func (c *responseCache) get(key string) *mutationResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry.result
+}
+
+// add caches the result, evicting the least recently used entry when the cache is full. The result must not
+// be modified afterwards.
+func (c *responseCache) add(key string, result *mutationResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.expires = now().Add(c.ttl)
+		entry.result = result
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, expires: now().Add(c.ttl), result: result})
+}
+
+// purge drops all entries, their results were computed with a config that isn't in use anymore. It only
+// frees the memory, the entries are keyed by config generation.
+func (c *responseCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
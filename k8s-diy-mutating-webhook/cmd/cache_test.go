@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const cachedPod = `
+metadata:
+  name: web
+  namespace: default
+spec:
+  containers:
+  - name: app
+    image: nginx
+`
+
+// histogramCount returns the number of observations of the histogram.
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	metric := &dto.Metric{}
+	if err := observer.(prometheus.Metric).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestResponseCacheHitsSkipRuleEvents(t *testing.T) {
+	resetMetrics(t)
+	logs := captureLogs(t)
+	wh := testWebhook(t, `
+rules:
+- name: service-account
+  defaultServiceAccountWarning: {}
+- name: working-dir
+  dryRun: true
+  workingDir:
+    path: /app
+- name: escalation
+  dryRun: true
+  privilegeEscalation:
+    deny: true
+`)
+	wh.responseCache = newResponseCache(10, time.Minute)
+	pod := testPod(t, cachedPod+`
+    securityContext:
+      allowPrivilegeEscalation: true
+`)
+	for i := 0; i < 3; i++ {
+		admissionResponse(t, wh.mutate, podReview(t, pod))
+	}
+
+	if hits := testutil.ToFloat64(responseCacheHits); hits != 2 {
+		t.Errorf("got %v cache hits, want 2", hits)
+	}
+	// The rules only ran for the first request, the hits don't count or log their events again.
+	if warnings := testutil.ToFloat64(ruleWarnings.WithLabelValues("service-account", "default")); warnings != 1 {
+		t.Errorf("got %v warnings, want 1", warnings)
+	}
+	if operations := testutil.ToFloat64(dryRunOperations.WithLabelValues("working-dir")); operations != 1 {
+		t.Errorf("got %v dry-run operations, want 1", operations)
+	}
+	if denials := testutil.ToFloat64(ruleDenials.WithLabelValues("escalation", "default")); denials != 1 {
+		t.Errorf("got %v denials, want 1", denials)
+	}
+	if count := histogramCount(t, ruleDuration.WithLabelValues("working-dir")); count != 1 {
+		t.Errorf("got %d rule duration observations, want 1", count)
+	}
+	for _, line := range []string{"dry run, not applying patch", "dry run, not denying", "warning: pod uses the default service account"} {
+		if n := strings.Count(logs.String(), line); n != 1 {
+			t.Errorf("logged %q %d times, want 1", line, n)
+		}
+	}
+}
+
+func TestResponseCacheIgnoresResultsOfReloadedConfig(t *testing.T) {
+	configFile := t.TempDir() + "/config.yaml"
+	writeConfig := func(path string) {
+		config := "rules:\n- name: working-dir\n  workingDir:\n    path: " + path + "\n"
+		if err := ioutil.WriteFile(configFile, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("/old")
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh := &mutatingWebhook{name: "test-webhook", configFile: configFile, config: config, configReloadAttempts: 1, responseCache: newResponseCache(10, time.Minute)}
+	pod := testPod(t, cachedPod)
+	review := podReview(t, pod)
+
+	// A request evaluated with the old config that only adds its result once the reload purged the cache.
+	stale, err := computePatch(pod, config, patchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfig("/new")
+	if err := wh.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	request := review.Request
+	wh.responseCache.add(responseCacheKey(request.Resource, request.Namespace, config.generation, patchOptions{}, request.Object.Raw), stale)
+
+	response := admissionResponse(t, wh.mutate, review)
+	if !strings.Contains(string(response.Patch), `"/new"`) {
+		t.Errorf("got patch %s, want the workingDir of the reloaded config", response.Patch)
+	}
+}
+
+func TestResponseCacheIdenticalPods(t *testing.T) {
+	resetMetrics(t)
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	wh.responseCache = newResponseCache(10, time.Minute)
+	var patches []string
+	for _, uid := range []types.UID{"first-uid", "second-uid"} {
+		review := podReview(t, testPod(t, cachedPod))
+		review.Request.UID = uid
+		response := admissionResponse(t, wh.mutate, review)
+		if response.UID != uid {
+			t.Errorf("got response UID %q, want the request UID %q", response.UID, uid)
+		}
+		patches = append(patches, string(response.Patch))
+	}
+	if hits := testutil.ToFloat64(responseCacheHits); hits != 1 {
+		t.Errorf("got %v cache hits, want 1", hits)
+	}
+	if patches[0] != patches[1] || len(patches[0]) == 0 {
+		t.Errorf("got patches %q, want the same patch for both pods", patches)
+	}
+
+	// A pod of another namespace is computed on its own.
+	pod := testPod(t, cachedPod)
+	pod.Namespace = "team-a"
+	admissionResponse(t, wh.mutate, podReview(t, pod))
+	if hits := testutil.ToFloat64(responseCacheHits); hits != 1 {
+		t.Errorf("got %v cache hits after a pod of another namespace, want 1", hits)
+	}
+}
+
+func TestResponseCacheEvictsAndExpires(t *testing.T) {
+	clock, current := now, time.Date(2023, 4, 5, 8, 30, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = clock })
+
+	cache := newResponseCache(2, time.Minute)
+	results := map[string]*mutationResult{"a": {}, "b": {}, "c": {}}
+	cache.add("a", results["a"])
+	cache.add("b", results["b"])
+	// Using a makes b the least recently used entry, which c evicts.
+	cache.get("a")
+	cache.add("c", results["c"])
+	for key, want := range map[string]*mutationResult{"a": results["a"], "b": nil, "c": results["c"]} {
+		if got := cache.get(key); got != want {
+			t.Errorf("got %p for %s, want %p", got, key, want)
+		}
+	}
+
+	current = current.Add(time.Minute + time.Second)
+	if got := cache.get("a"); got != nil {
+		t.Errorf("got %p for a after the ttl, want none", got)
+	}
+	if len(cache.entries) != 1 || cache.order.Len() != 1 {
+		t.Errorf("got %d entries, want the expired one dropped", len(cache.entries))
+	}
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// certExpiryCheckInterval is how often the serving certificate expiry is checked after the start.
+const certExpiryCheckInterval = time.Hour
+
+// watchCertExpiry checks the expiry of the serving certificate at the start and then periodically, updating
+// the cert_expiry_seconds gauge and warning once the certificate expires within window. A zero window only
+// updates the gauge.
+func watchCertExpiry(cert tls.Certificate, window time.Duration) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("no certificate in the TLS key pair")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	checkCertExpiry(leaf, window)
+	go func() {
+		for range time.Tick(certExpiryCheckInterval) {
+			checkCertExpiry(leaf, window)
+		}
+	}()
+	return nil
+}
+
+// checkCertExpiry sets the cert_expiry_seconds gauge to the time left until the certificate expires, and
+// warns if that is less than window.
+func checkCertExpiry(leaf *x509.Certificate, window time.Duration) {
+	left := leaf.NotAfter.Sub(now())
+	certExpiry.Set(left.Seconds())
+	switch {
+	case left <= 0:
+		errorLogger.Printf("WARNING: the TLS certificate expired at %s, rotate it", leaf.NotAfter.UTC().Format(time.RFC3339))
+	case window > 0 && left < window:
+		errorLogger.Printf("WARNING: the TLS certificate expires at %s, in %s, rotate it", leaf.NotAfter.UTC().Format(time.RFC3339), left.Round(time.Minute))
+	}
+}
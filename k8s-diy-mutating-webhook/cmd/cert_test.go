@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckCertExpiry(t *testing.T) {
+	resetMetrics(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := now
+	now = func() time.Time { return start }
+	t.Cleanup(func() { now = clock })
+
+	for _, test := range []struct {
+		name     string
+		notAfter time.Time
+		window   time.Duration
+		warning  string
+	}{
+		{name: "valid", notAfter: start.Add(90 * 24 * time.Hour), window: 30 * 24 * time.Hour},
+		{name: "within the window", notAfter: start.Add(48 * time.Hour), window: 30 * 24 * time.Hour, warning: "WARNING: the TLS certificate expires at 2024-01-03T00:00:00Z, in 48h0m0s, rotate it"},
+		{name: "window disabled", notAfter: start.Add(48 * time.Hour)},
+		{name: "expired", notAfter: start.Add(-time.Hour), warning: "WARNING: the TLS certificate expired at 2023-12-31T23:00:00Z, rotate it"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cert := newTestCA(t).issue(t, "webhook", x509.ExtKeyUsageServerAuth, test.notAfter)
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCertExpiry(leaf, test.window)
+			if got, want := testutil.ToFloat64(certExpiry), test.notAfter.Sub(start).Seconds(); got != want {
+				t.Errorf("got cert expiry %v seconds, want %v", got, want)
+			}
+			if warned := strings.TrimSpace(logs.String()); (len(test.warning) == 0 && len(warned) > 0) || !strings.Contains(warned, test.warning) {
+				t.Errorf("got logs %q, want %q", warned, test.warning)
+			}
+		})
+	}
+
+	if err := watchCertExpiry(tls.Certificate{}, time.Hour); err == nil || !strings.Contains(err.Error(), "no certificate") {
+		t.Errorf("got error %v for an empty key pair", err)
+	}
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// chaosOptions configures the failure injection used to exercise the failurePolicy of the webhook
+// configuration. The zero value disables it.
+type chaosOptions struct {
+	// errorRate is the fraction of requests answered with an internal server error.
+	errorRate float64
+	// delay is added to the fraction delayRate of the requests.
+	delay     time.Duration
+	delayRate float64
+}
+
+func (c chaosOptions) enabled() bool {
+	return c.errorRate > 0 || (c.delay > 0 && c.delayRate > 0)
+}
+
+// chaosHandler injects the configured delays and errors in front of h.
+func chaosHandler(h http.Handler, opts chaosOptions) http.Handler {
+	if !opts.enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.delay > 0 && rand.Float64() < opts.delayRate {
+			logger.Printf("chaos: delaying request by %s", opts.delay)
+			time.Sleep(opts.delay)
+		}
+		if rand.Float64() < opts.errorRate {
+			logger.Printf("chaos: failing request")
+			http.Error(w, "chaos: injected failure", http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChaosHandler(t *testing.T) {
+	captureLogs(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {})
+	for _, test := range []struct {
+		errorRate float64
+		minFailed int
+		maxFailed int
+	}{
+		{errorRate: 0, minFailed: 0, maxFailed: 0},
+		{errorRate: 0.25, minFailed: 400, maxFailed: 600},
+		{errorRate: 1, minFailed: 2000, maxFailed: 2000},
+	} {
+		handler := chaosHandler(ok, chaosOptions{errorRate: test.errorRate})
+		failed := 0
+		for i := 0; i < 2000; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/mutate", nil))
+			if w.Code == http.StatusInternalServerError {
+				failed++
+			}
+		}
+		if failed < test.minFailed || failed > test.maxFailed {
+			t.Errorf("error rate %v: failed %d of 2000 requests, want %d to %d", test.errorRate, failed, test.minFailed, test.maxFailed)
+		}
+	}
+
+	handler := chaosHandler(ok, chaosOptions{delay: 20 * time.Millisecond, delayRate: 1})
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/mutate", nil))
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || w.Code != http.StatusOK {
+		t.Errorf("got status %d after %s, want a delayed success", w.Code, elapsed)
+	}
+}
+
+func TestChaosFlagsHidden(t *testing.T) {
+	for _, name := range []string{"chaos-error-rate", "chaos-delay", "chaos-delay-rate"} {
+		if flag := rootCmd.Flags().Lookup(name); flag == nil || !flag.Hidden {
+			t.Errorf("flag %s is not hidden", name)
+		}
+	}
+}
@@ -0,0 +1,1719 @@
+package cmd
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultPinAnnotation  = "diy-webhook/pinned"
+	defaultManagedByKey   = "app.kubernetes.io/managed-by"
+	defaultManagedByValue = "diy-webhook"
+
+	defaultTimestampAnnotation = "diy-webhook/mutated-at"
+
+	defaultAppliedRulesAnnotation = "diy-webhook/applied-rules"
+
+	defaultFieldManager   = "diy-webhook"
+	maxFieldManagerLength = 128
+
+	defaultReadinessProbeAnnotation = "diy-webhook/default-readiness-probe"
+
+	defaultStartupProbeFailureThreshold = 30
+	defaultStartupProbePeriodSeconds    = 10
+
+	defaultPodAntiAffinityWeight = 100
+
+	defaultTopologySpreadMaxSkew = 1
+
+	defaultPodDisruptionBudgetAnnotation = "diy-webhook/pod-disruption-budget"
+
+	defaultQoSAnnotation = "diy-webhook/qos"
+
+	defaultTopologyAwareHintsAnnotation = "service.kubernetes.io/topology-aware-hints"
+	defaultTopologyAwareHintsValue      = "auto"
+
+	defaultEmptyDirSizeLimit = "1Gi"
+
+	defaultLimitProfileLabel = "diy-webhook/profile"
+
+	defaultInteractiveAnnotation = "diy-webhook/interactive"
+
+	defaultMetricNamespaces = 50
+
+	defaultProjectedTokenVolume     = "diy-webhook-token"
+	defaultProjectedTokenPath       = "token"
+	defaultProjectedTokenExpiration = 3600
+	minProjectedTokenExpiration     = 600
+)
+
+// Types of the injected pod anti-affinity.
+const (
+	AntiAffinityPreferred = "preferred"
+	AntiAffinityRequired  = "required"
+)
+
+// Actions of the hostPorts rule.
+const (
+	HostPortsDeny  = "deny"
+	HostPortsStrip = "strip"
+)
+
+const (
+	// OnErrorFail fails the admission request when a rule goes wrong.
+	OnErrorFail = "fail"
+	// OnErrorSkip drops the offending operations and keeps admitting. A rule whose patch doesn't apply to the
+	// pod is skipped as a whole.
+	OnErrorSkip = "skip"
+)
+
+// Config holds the mutation settings of the webhook. It is loaded from the file passed via --config.
+type Config struct {
+	// Enabled set to false is the kill switch of the webhook: every pod is admitted unchanged. The
+	// DIY_WEBHOOK_ENABLED environment variable overrides it. Defaults to true.
+	Enabled   *bool           `json:"enabled,omitempty"`
+	Pin       PinConfig       `json:"pin"`
+	ManagedBy ManagedByConfig `json:"managedBy"`
+	Timestamp TimestampConfig `json:"timestamp"`
+	// AppliedRules configures the annotation listing the rules that changed the pod.
+	AppliedRules AppliedRulesConfig `json:"appliedRules"`
+	// ManagedFields records the webhook as the field manager of the fields it sets.
+	ManagedFields ManagedFieldsConfig `json:"managedFields"`
+	// Rules are evaluated in order for every admitted pod.
+	Rules []Rule `json:"rules"`
+	// NamespaceRules maps a namespace to the names of the rules enabled in it. Namespaces that aren't
+	// listed get all rules.
+	NamespaceRules map[string][]string `json:"namespaceRules,omitempty"`
+	// ProtectedLabels are label keys rules must not change, like the controller managed pod-template-hash.
+	// Operations touching them are dropped with a warning. Omitting the list keeps the defaults.
+	ProtectedLabels []string `json:"protectedLabels"`
+	// ProtectedOwners lists the controllers whose pods are admitted untouched, so the webhook doesn't fight
+	// operators that manage their own pod specs.
+	ProtectedOwners []ProtectedOwner `json:"protectedOwners,omitempty"`
+	// MaxContainers caps the containers of a pod a rule may add sidecars up to, 0 is unlimited. A rule whose
+	// patch would add containers beyond it is skipped with a warning. There is no sidecar rule type, so the cap
+	// applies to any rule growing the container list, like a rawPatch rule appending a sidecar.
+	MaxContainers int `json:"maxContainers,omitempty"`
+	// SensitiveEnv are patterns of env var names whose values are masked in the dry-run logs and the debug
+	// output, where * matches any characters. Variables the pod takes from a secret are always masked.
+	// Omitting the list keeps the defaults.
+	SensitiveEnv []string `json:"sensitiveEnv"`
+
+	namespaceRules map[string]map[string]bool
+	sensitiveEnv   []*regexp.Regexp
+	// generation counts the reloads of the config, it keys the response cache.
+	generation uint64
+}
+
+// ProtectedOwner matches the owner references of a pod. An empty name matches every owner of the kind.
+type ProtectedOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+}
+
+// PinConfig configures the pin annotation. Pods carrying it are admitted untouched, regardless of the rules.
+type PinConfig struct {
+	Annotation string `json:"annotation"`
+	// SetAfterMutation adds the pin annotation to every pod the webhook mutates, so later admissions skip it.
+	SetAfterMutation bool `json:"setAfterMutation"`
+	// Versioned sets the pin annotation added after mutation to mutated-by-<webhook version>, or to
+	// mutated-by-<commit> for builds without a version. Pods pinned by another version of the webhook are
+	// mutated again, so an upgrade applies its rules when controllers readmit them. Pin annotations with
+	// other values, like the ones set by hand, keep pinning.
+	Versioned bool `json:"versioned,omitempty"`
+}
+
+// ManagedByConfig configures the label added to every pod the webhook mutates. An existing label is kept.
+type ManagedByConfig struct {
+	Enabled bool   `json:"enabled"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+}
+
+// TimestampConfig configures the annotation recording when the webhook mutated a pod. The time is taken from
+// the clock of the node running the webhook, so it can be skewed against the API server and other nodes.
+type TimestampConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Annotation string `json:"annotation"`
+	// Format is either rfc3339 (default) or unix.
+	Format string `json:"format"`
+}
+
+// AppliedRulesConfig configures the annotation listing the names of the rules that changed a pod, comma
+// separated in config order. Dry-run rules and rules without changes are left out.
+type AppliedRulesConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Annotation string `json:"annotation"`
+}
+
+// ManagedFieldsConfig adds a managedFields entry of the manager for the fields set by the webhook, so
+// server-side apply and GitOps tools can tell them from the fields of the submitted object. See
+// managedFieldsPatch for the limitations.
+type ManagedFieldsConfig struct {
+	Enabled bool   `json:"enabled"`
+	Manager string `json:"manager"`
+}
+
+// Rule is a named mutation applied to the pods and containers matched by its selector.
+// Exactly one of the mutation fields must be set.
+type Rule struct {
+	Name     string   `json:"name"`
+	Selector Selector `json:"selector,omitempty"`
+	// OnError is either fail (default) or skip.
+	OnError string `json:"onError,omitempty"`
+	// DryRun only logs and counts the operations of the rule, neither they nor its warnings reach the response.
+	DryRun bool `json:"dryRun,omitempty"`
+	// MaxOperations caps the patch operations of the rule, 0 is unlimited. A rule exceeding it fails, or is
+	// skipped with onError skip.
+	MaxOperations int `json:"maxOperations,omitempty"`
+	// LogCooldown logs the rule at most once per period, 0 logs everything. Metrics count every occurrence.
+	LogCooldown metav1.Duration `json:"logCooldown,omitempty"`
+	// MetricNamespaces caps the distinct namespace label values of the rule's warning and denial metrics,
+	// further namespaces are counted as other. Defaults to 50.
+	MetricNamespaces int `json:"metricNamespaces,omitempty"`
+
+	Limits          *LimitsRule          `json:"limits,omitempty"`
+	ImagePullPolicy *ImagePullPolicyRule `json:"imagePullPolicy,omitempty"`
+	RawPatch        *RawPatchRule        `json:"rawPatch,omitempty"`
+	ReadinessProbe  *ReadinessProbeRule  `json:"readinessProbe,omitempty"`
+	SeccompProfile  *SeccompProfileRule  `json:"seccompProfile,omitempty"`
+	ProjectedToken  *ProjectedTokenRule  `json:"projectedToken,omitempty"`
+
+	DefaultServiceAccountWarning *DefaultServiceAccountWarningRule `json:"defaultServiceAccountWarning,omitempty"`
+	DNSSearch                    *DNSSearchRule                    `json:"dnsSearch,omitempty"`
+	StartupProbe                 *StartupProbeRule                 `json:"startupProbe,omitempty"`
+	RunAs                        *RunAsRule                        `json:"runAs,omitempty"`
+	PodAntiAffinity              *PodAntiAffinityRule              `json:"podAntiAffinity,omitempty"`
+	TopologySpread               *TopologySpreadRule               `json:"topologySpread,omitempty"`
+	Env                          *EnvRule                          `json:"env,omitempty"`
+	PodDisruptionBudget          *PodDisruptionBudgetRule          `json:"podDisruptionBudget,omitempty"`
+	GuaranteedQoS                *GuaranteedQoSRule                `json:"guaranteedQoS,omitempty"`
+	TopologyAwareHints           *TopologyAwareHintsRule           `json:"topologyAwareHints,omitempty"`
+	CostAllocation               *CostAllocationRule               `json:"costAllocation,omitempty"`
+	Tolerations                  *TolerationsRule                  `json:"tolerations,omitempty"`
+	ReadinessGate                *ReadinessGateRule                `json:"readinessGate,omitempty"`
+	EmptyDirSizeLimit            *EmptyDirSizeLimitRule            `json:"emptyDirSizeLimit,omitempty"`
+	FSGroupChangePolicy          *FSGroupChangePolicyRule          `json:"fsGroupChangePolicy,omitempty"`
+	WorkingDir                   *WorkingDirRule                   `json:"workingDir,omitempty"`
+	PrivilegeEscalation          *PrivilegeEscalationRule          `json:"privilegeEscalation,omitempty"`
+	DropCapabilities             *DropCapabilitiesRule             `json:"dropCapabilities,omitempty"`
+	LimitsFromRequests           *LimitsFromRequestsRule           `json:"limitsFromRequests,omitempty"`
+	MemoryEnv                    *MemoryEnvRule                    `json:"memoryEnv,omitempty"`
+	LimitProfiles                *LimitProfilesRule                `json:"limitProfiles,omitempty"`
+	StdinTTY                     *StdinTTYRule                     `json:"stdinTTY,omitempty"`
+	PreferredNodeAffinity        *PreferredNodeAffinityRule        `json:"preferredNodeAffinity,omitempty"`
+	PostStart                    *PostStartRule                    `json:"postStart,omitempty"`
+	HostPorts                    *HostPortsRule                    `json:"hostPorts,omitempty"`
+	Sysctls                      *SysctlsRule                      `json:"sysctls,omitempty"`
+	MeshSidecar                  *MeshSidecarRule                  `json:"meshSidecar,omitempty"`
+	Subdomain                    *SubdomainRule                    `json:"subdomain,omitempty"`
+	Annotations                  *AnnotationsRule                  `json:"annotations,omitempty"`
+
+	logs       *logSampler
+	namespaces *labelCap
+}
+
+// Selector restricts a rule to matching pods and containers. An empty selector matches everything.
+type Selector struct {
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// NamespaceSelector matches the labels of the pod namespace. Namespaces are looked up in the cluster,
+	// pods in unknown namespaces don't match.
+	NamespaceSelector   *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	ContainerNamePrefix string                `json:"containerNamePrefix,omitempty"`
+	// ContainerNamePattern is a regular expression the container name must match.
+	ContainerNamePattern string `json:"containerNamePattern,omitempty"`
+	// OS restricts the rule to linux or windows pods. Rules setting Linux-only security fields default to linux.
+	OS corev1.OSName `json:"os,omitempty"`
+	// Images restricts the rule to containers whose image matches one of the patterns, where * matches any
+	// characters.
+	Images []string `json:"images,omitempty"`
+	// ExcludeImages skips containers whose image matches one of the patterns, where * matches any characters.
+	ExcludeImages []string `json:"excludeImages,omitempty"`
+
+	podSelector          labels.Selector
+	namespaceSelector    labels.Selector
+	containerNamePattern *regexp.Regexp
+	images               []*regexp.Regexp
+	excludeImages        []*regexp.Regexp
+}
+
+// LimitsRule sets resource limits on containers that don't define any. A limit is either a quantity or a
+// percentage like 10%, taken of the reference node. The node a pod lands on isn't known at admission, so the
+// reference node stands in for a typical node of the cluster.
+type LimitsRule struct {
+	CPU              string `json:"cpu,omitempty"`
+	Memory           string `json:"memory,omitempty"`
+	EphemeralStorage string `json:"ephemeralStorage,omitempty"`
+	// ReferenceNode is the allocatable capacity percentages are resolved against.
+	ReferenceNode *ReferenceNode `json:"referenceNode,omitempty"`
+	// SkipWithLimitRange leaves pods alone in namespaces with a LimitRange defaulting container limits. The API
+	// server applies those defaults to pods before the webhooks run, so this mostly keeps the rule's limits out
+	// of Deployment pod templates, which LimitRanges don't default.
+	SkipWithLimitRange bool `json:"skipWithLimitRange,omitempty"`
+
+	limits corev1.ResourceList
+}
+
+// ReferenceNode is the allocatable capacity of a typical node.
+type ReferenceNode struct {
+	CPU              resource.Quantity `json:"cpu"`
+	Memory           resource.Quantity `json:"memory"`
+	EphemeralStorage resource.Quantity `json:"ephemeralStorage"`
+}
+
+// ImagePullPolicyRule sets the imagePullPolicy of containers that leave it empty.
+// The API server defaults the field before admission for regular requests, so this mostly
+// targets objects that reach the webhook undefaulted.
+type ImagePullPolicyRule struct {
+	Default corev1.PullPolicy `json:"default,omitempty"`
+	// Registries set the imagePullPolicy of containers with images from a matching registry instead of the
+	// default. The first matching entry wins, other containers get the default.
+	Registries []RegistryPullPolicy `json:"registries,omitempty"`
+}
+
+// RegistryPullPolicy maps a registry to an imagePullPolicy. Registry matches the host of the image reference
+// with or without its port, docker.io for images without a host, and may contain * wildcards like
+// *.example.com, matched like the image patterns of selectors.
+// Like the default, the policy only fills in an empty imagePullPolicy unless Override is set. As the API
+// server defaults the field before admission, regular requests need Override to get the policy.
+type RegistryPullPolicy struct {
+	Registry string            `json:"registry"`
+	Policy   corev1.PullPolicy `json:"policy"`
+	// Override replaces an imagePullPolicy set in the pod.
+	Override bool `json:"override,omitempty"`
+
+	registry *regexp.Regexp
+}
+
+// RawPatchRule adds the configured JSONPatch operations as they are.
+type RawPatchRule struct {
+	Operations []patchOperation `json:"operations"`
+
+	// operations are the operations as written in the config, where a null value differs from a missing one.
+	operations jsonpatch.Patch
+}
+
+// UnmarshalJSON keeps the operations as written next to the decoded ones, for compile to validate. Like the
+// rest of the config, unknown fields are rejected.
+func (p *RawPatchRule) UnmarshalJSON(data []byte) error {
+	type rule RawPatchRule
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode((*rule)(p)); err != nil {
+		return err
+	}
+	var raw struct {
+		Operations jsonpatch.Patch `json:"operations"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	p.operations = raw.Operations
+	return nil
+}
+
+// ReadinessProbeRule adds a TCP readiness probe on the first declared port of containers without one.
+// Pods opt in by setting the annotation to "true".
+type ReadinessProbeRule struct {
+	Annotation          string `json:"annotation,omitempty"`
+	InitialDelaySeconds int32  `json:"initialDelaySeconds,omitempty"`
+	PeriodSeconds       int32  `json:"periodSeconds,omitempty"`
+}
+
+const (
+	// TimestampRFC3339 formats timestamps like 2006-01-02T15:04:05Z.
+	TimestampRFC3339 = "rfc3339"
+	// TimestampUnix formats timestamps as seconds since the epoch.
+	TimestampUnix = "unix"
+)
+
+const (
+	LevelPod       = "pod"
+	LevelContainer = "container"
+)
+
+// SeccompProfileRule sets the RuntimeDefault seccomp profile where none is set, on the pod security context
+// or on every selected container. If AllowedProfiles is set, it warns about Localhost profiles not listed in it.
+type SeccompProfileRule struct {
+	// Level is either pod (default) or container.
+	Level           string   `json:"level,omitempty"`
+	AllowedProfiles []string `json:"allowedProfiles,omitempty"`
+}
+
+// ProjectedTokenRule adds a projected service account token volume to the pod and mounts it into the selected
+// containers. Pods and containers that already have the volume or the mount are left alone.
+// DisableAutomount replaces the legacy token mounted by the kubelet with the projected one: it sets
+// automountServiceAccountToken to false on pods that leave it unset, and pods that set it to false, which
+// don't need a token, get no projected token either. Pods that set it to true keep the legacy token.
+type ProjectedTokenRule struct {
+	VolumeName        string `json:"volumeName,omitempty"`
+	MountPath         string `json:"mountPath"`
+	Path              string `json:"path,omitempty"`
+	Audience          string `json:"audience,omitempty"`
+	ExpirationSeconds int64  `json:"expirationSeconds,omitempty"`
+	DisableAutomount  bool   `json:"disableAutomount,omitempty"`
+}
+
+// DefaultServiceAccountWarningRule warns about pods running with the default service account. It doesn't patch.
+type DefaultServiceAccountWarningRule struct{}
+
+// DNSSearchRule appends search domains to the pod dnsConfig, skipping the ones already present.
+type DNSSearchRule struct {
+	Domains []string `json:"domains"`
+}
+
+// StartupProbeRule adds a startup probe to containers that have a liveness probe but no startup probe, so slow
+// starting apps aren't killed before they are up. The probe reuses the handler of the liveness probe and allows
+// failureThreshold * periodSeconds for the start.
+type StartupProbeRule struct {
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+	PeriodSeconds    int32 `json:"periodSeconds,omitempty"`
+}
+
+// RunAsRule defaults runAsUser and runAsGroup in the pod security context, or in the security context of every
+// selected container. Each field is only set if it is unset. Without an explicit group, the group follows the
+// user whenever the user is defaulted.
+type RunAsRule struct {
+	// Level is either pod (default) or container.
+	Level string `json:"level,omitempty"`
+	User  *int64 `json:"user,omitempty"`
+	Group *int64 `json:"group,omitempty"`
+}
+
+// PodAntiAffinityRule adds a preferred pod anti-affinity to Deployments with more than one replica, so their
+// pods spread over the topology domains. The anti-affinity selects the pod template labels. Pods created
+// directly and Deployments with a single replica are left alone, as are pod templates with a pod anti-affinity.
+type PodAntiAffinityRule struct {
+	// TopologyKey defaults to kubernetes.io/hostname.
+	TopologyKey string `json:"topologyKey,omitempty"`
+	// Weight is between 1 and 100 (default).
+	Weight int32 `json:"weight,omitempty"`
+	// Type is preferred (default) or required. Required anti-affinity leaves replicas pending once every
+	// topology domain has one, so the rule warns whenever it injects it, counted in rule_warnings_total.
+	Type string `json:"type,omitempty"`
+}
+
+// TopologySpreadRule adds a topology spread constraint selecting the pod labels, unless the pod already has a
+// constraint for the topology key. Pods without labels are left alone.
+type TopologySpreadRule struct {
+	// TopologyKey defaults to topology.kubernetes.io/zone.
+	TopologyKey string `json:"topologyKey,omitempty"`
+	// MaxSkew defaults to 1.
+	MaxSkew int32 `json:"maxSkew,omitempty"`
+	// WhenUnsatisfiable is either ScheduleAnyway (default) or DoNotSchedule.
+	WhenUnsatisfiable corev1.UnsatisfiableConstraintAction `json:"whenUnsatisfiable,omitempty"`
+}
+
+// EnvRule adds environment variables to the selected containers, unless a container already sets them.
+// Combined with a namespaceSelector, it can enable debugging settings like GOTRACEBACK only in dev namespaces.
+type EnvRule struct {
+	Variables []corev1.EnvVar `json:"variables"`
+}
+
+// PodDisruptionBudgetRule annotates pods with the name of the PodDisruptionBudget that should cover them, for
+// controllers that manage budgets from pod annotations. The name is either fixed or the value of a pod label,
+// pods without that label are left alone. An existing annotation is never overridden.
+type PodDisruptionBudgetRule struct {
+	// Annotation defaults to diy-webhook/pod-disruption-budget.
+	Annotation string `json:"annotation,omitempty"`
+	Name       string `json:"name,omitempty"`
+	// NameFromLabel takes the name from the value of the pod label.
+	NameFromLabel string `json:"nameFromLabel,omitempty"`
+}
+
+// GuaranteedQoSRule sets the cpu and memory requests of the selected containers to their limits, for pods that
+// opt into the Guaranteed QoS class with the annotation set to guaranteed. Rules see the pod as patched by the
+// rules before them, so the rule goes after the limits rules. Containers without cpu and memory limits are
+// left alone with a warning.
+type GuaranteedQoSRule struct {
+	// Annotation defaults to diy-webhook/qos.
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// TopologyAwareHintsRule annotates the pods backing topology-aware services. An existing annotation is kept,
+// so pods can opt out by setting another value.
+type TopologyAwareHintsRule struct {
+	// Annotation defaults to service.kubernetes.io/topology-aware-hints.
+	Annotation string `json:"annotation,omitempty"`
+	// Value defaults to auto.
+	Value string `json:"value,omitempty"`
+}
+
+// CostAllocationRule annotates pods with cost allocation data like the team or cost center, taken from the
+// labels of their namespace. Existing annotations are kept.
+type CostAllocationRule struct {
+	Annotations []CostAllocationAnnotation `json:"annotations"`
+}
+
+// CostAllocationAnnotation sets the annotation to the value of a namespace label, or to the fallback if the
+// namespace doesn't have the label. Without a fallback the annotation is then left out.
+type CostAllocationAnnotation struct {
+	Annotation string `json:"annotation"`
+	// FromLabel defaults to the annotation key.
+	FromLabel string `json:"fromLabel,omitempty"`
+	Fallback  string `json:"fallback,omitempty"`
+}
+
+// TolerationsRule adds tolerations the pod doesn't have yet. Combined with a namespaceSelector or namespaceRules,
+// it lets the pods of a namespace tolerate the taints of their dedicated nodes.
+type TolerationsRule struct {
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Spot adds the tolerations of the taints cloud providers put on spot and preemptible nodes.
+	Spot bool `json:"spot,omitempty"`
+
+	tolerations []corev1.Toleration
+}
+
+// spotTolerations tolerate the taints of spot nodes on GKE and AKS. EKS doesn't taint spot nodes by default.
+var spotTolerations = []corev1.Toleration{
+	{Key: "cloud.google.com/gke-spot", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+	{Key: "cloud.google.com/gke-preemptible", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+	{Key: "kubernetes.azure.com/scalesetpriority", Operator: corev1.TolerationOpEqual, Value: "spot", Effect: corev1.TaintEffectNoSchedule},
+}
+
+// ReadinessGateRule adds a readiness gate, so pods only become ready once a controller sets the condition.
+type ReadinessGateRule struct {
+	ConditionType corev1.PodConditionType `json:"conditionType"`
+}
+
+// EmptyDirSizeLimitRule sets a size limit on emptyDir volumes without one, so they can't fill the disk of the
+// node. Pods exceeding the limit are evicted.
+type EmptyDirSizeLimitRule struct {
+	// SizeLimit defaults to 1Gi.
+	SizeLimit *resource.Quantity `json:"sizeLimit,omitempty"`
+}
+
+// FSGroupChangePolicyRule defaults the fsGroupChangePolicy of pods with an fsGroup, OnRootMismatch skips the
+// recursive ownership change of volumes that already have the right owner. With FSGroup set, pods without an
+// fsGroup get one too. Pods that end up without an fsGroup are left alone, the policy has no effect there.
+type FSGroupChangePolicyRule struct {
+	// Policy is OnRootMismatch (default) or Always.
+	Policy  corev1.PodFSGroupChangePolicy `json:"policy,omitempty"`
+	FSGroup *int64                        `json:"fsGroup,omitempty"`
+}
+
+// WorkingDirRule sets the workingDir of containers that leave it empty, for images that expect to be started
+// in a specific directory. Use the images selector to target them.
+type WorkingDirRule struct {
+	Path string `json:"path"`
+}
+
+// PrivilegeEscalationRule sets allowPrivilegeEscalation to false in the security context of containers that
+// leave it unset. Privileged containers are left alone. With Deny, pods with a container that explicitly
+// allows privilege escalation are rejected.
+type PrivilegeEscalationRule struct {
+	Deny bool `json:"deny,omitempty"`
+}
+
+// DropCapabilitiesRule drops all Linux capabilities of containers that don't configure capabilities, adding
+// back the ones listed in Add. Containers with capabilities in their security context are left alone.
+type DropCapabilitiesRule struct {
+	Add []corev1.Capability `json:"add,omitempty"`
+}
+
+// LimitsFromRequestsRule sets the limit of a resource a container requests but doesn't limit to the request
+// times the ratio of the resource, like 2 for limits twice the requests. Resources without a ratio are skipped.
+type LimitsFromRequestsRule struct {
+	CPU              float64 `json:"cpu,omitempty"`
+	Memory           float64 `json:"memory,omitempty"`
+	EphemeralStorage float64 `json:"ephemeralStorage,omitempty"`
+
+	ratios map[corev1.ResourceName]float64
+}
+
+// MemoryEnvRule derives environment variables like GOMEMLIMIT or JAVA_TOOL_OPTIONS from the memory limit of
+// containers, so runtimes tune their garbage collection to it. Containers without a memory limit, or that set
+// the variable already, are left alone.
+type MemoryEnvRule struct {
+	Variables []MemoryEnvVar `json:"variables"`
+}
+
+// MemoryEnvVar computes the variable value as the memory limit times Ratio in Unit, rounded down, and renders
+// it with the Value template, where {{.}} is the number. For example ratio 0.9, unit MiB and value {{.}}MiB
+// sets GOMEMLIMIT to 90% of the limit.
+type MemoryEnvVar struct {
+	Name string `json:"name"`
+	// Ratio is between 0 and 1 (default).
+	Ratio float64 `json:"ratio,omitempty"`
+	// Unit is B (default), KiB, MiB or GiB.
+	Unit string `json:"unit,omitempty"`
+	// Value defaults to {{.}}.
+	Value string `json:"value,omitempty"`
+
+	value *template.Template
+}
+
+// LimitProfilesRule sets the limits of a named profile, like small or large, on containers without limits. Pods
+// pick the profile with the label, pods without it or with an unknown profile get the default profile. Without
+// a default profile these pods are left alone.
+type LimitProfilesRule struct {
+	// Label defaults to diy-webhook/profile.
+	Label    string                 `json:"label,omitempty"`
+	Default  string                 `json:"default,omitempty"`
+	Profiles map[string]*LimitsRule `json:"profiles"`
+}
+
+// StdinTTYRule turns off stdin, stdinOnce and tty of containers, which generated manifests sometimes leave on
+// for pods nobody attaches to. Pods with the annotation set to true are interactive and left alone.
+type StdinTTYRule struct {
+	// Annotation defaults to diy-webhook/interactive.
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// PreferredNodeAffinityRule adds weighted node preferences to pods without a node affinity, like weight 100
+// for nodes labeled as spot capacity and weight 1 for on-demand nodes, so pods land on spot nodes when there
+// are some and fall back to on-demand nodes otherwise.
+type PreferredNodeAffinityRule struct {
+	Preferences []corev1.PreferredSchedulingTerm `json:"preferences"`
+}
+
+// PostStartRule adds a postStart lifecycle hook, like a command warming a cache, to containers without one.
+// The hook is an exec or httpGet handler, written as in the container spec. Containers keep their own
+// postStart hook and their preStop hook.
+type PostStartRule struct {
+	corev1.LifecycleHandler
+}
+
+// HostPortsRule handles containers declaring host ports, which tie pods to nodes with the port free and expose
+// them on the node. Action deny, the default, rejects the pod and strip removes the host ports, with a warning
+// listing the containers. Host ports of hostNetwork pods always equal the container ports and aren't stripped.
+type HostPortsRule struct {
+	Action string `json:"action,omitempty"`
+}
+
+// SysctlsRule adds sysctls to the pod security context, keeping the values of the sysctls the pod sets. Only
+// the sysctls every kubelet allows are accepted: the safe sysctls of Kubernetes 1.24. Others, like
+// net.core.somaxconn, must be listed in AllowedUnsafeSysctls and be allowed by the kubelets with
+// --allowed-unsafe-sysctls, the pods are rejected on nodes that don't allow them.
+type SysctlsRule struct {
+	Sysctls              []corev1.Sysctl `json:"sysctls"`
+	AllowedUnsafeSysctls []string        `json:"allowedUnsafeSysctls,omitempty"`
+}
+
+// MeshSidecarRule annotates pods with a service mesh sidecar, for example to have the mesh hold the app until
+// the proxy is up and keep the proxy until the app exits. A pod has a sidecar if one of its containers or init
+// containers has a sidecar name, or if it requests injection with one of the inject annotations set to true or
+// enabled. The mesh webhook may inject after this one, so the annotations are added to pods requesting injection
+// too; with reinvocationPolicy IfNeeded this webhook also sees the injected containers. Existing annotations
+// are kept.
+type MeshSidecarRule struct {
+	// Containers defaults to istio-proxy and linkerd-proxy.
+	Containers []string `json:"containers,omitempty"`
+	// InjectAnnotations defaults to sidecar.istio.io/inject and linkerd.io/inject.
+	InjectAnnotations []string          `json:"injectAnnotations,omitempty"`
+	Annotations       map[string]string `json:"annotations"`
+}
+
+// SubdomainRule sets the subdomain of pods without one, giving them a stable DNS name under the headless
+// service of that name. The subdomain is either fixed or the value of a pod label, pods without that label or
+// with a value that isn't a DNS label are left alone.
+type SubdomainRule struct {
+	Subdomain string `json:"subdomain,omitempty"`
+	// FromLabel takes the subdomain from the value of the pod label.
+	FromLabel string `json:"fromLabel,omitempty"`
+}
+
+// AnnotationsRule adds a fixed set of annotations to the matching pods, like the ones a CNI selects pods into
+// network policies by. Annotations the pod already has keep their value, so readmitted pods aren't changed.
+type AnnotationsRule struct {
+	Annotations map[string]string `json:"annotations"`
+}
+
+func defaultConfig() *Config {
+	enabled := true
+	return &Config{
+		Enabled: &enabled,
+		Pin: PinConfig{
+			Annotation: defaultPinAnnotation,
+		},
+		ManagedBy: ManagedByConfig{
+			Key:   defaultManagedByKey,
+			Value: defaultManagedByValue,
+		},
+		Timestamp: TimestampConfig{
+			Annotation: defaultTimestampAnnotation,
+			Format:     TimestampRFC3339,
+		},
+		AppliedRules: AppliedRulesConfig{
+			Annotation: defaultAppliedRulesAnnotation,
+		},
+		ManagedFields: ManagedFieldsConfig{
+			Manager: defaultFieldManager,
+		},
+		ProtectedLabels: []string{appsv1.DefaultDeploymentUniqueLabelKey, appsv1.ControllerRevisionHashLabelKey},
+		SensitiveEnv:    []string{"*PASSWORD*", "*SECRET*", "*TOKEN*", "*_KEY"},
+		Rules: []Rule{
+			{
+				Name:   "limits",
+				Limits: &LimitsRule{CPU: "100m", Memory: "100Mi"},
+			},
+		},
+	}
+}
+
+// enabledEnvVar overrides the enabled setting of the config, to turn the webhook off without changing it.
+const enabledEnvVar = "DIY_WEBHOOK_ENABLED"
+
+// embeddedConfigName is the file name of the embedded config, used to pick its format and in errors.
+const embeddedConfigName = "default-config.yaml"
+
+// embeddedConfig is the config loaded when no config file is given.
+//
+//go:embed default-config.yaml
+var embeddedConfig []byte
+
+// configReadError is returned by loadConfig if the config file can't be read. Unlike invalid configs, that
+// can be transient, like while a ConfigMap volume is updated.
+type configReadError struct {
+	err error
+}
+
+func (e *configReadError) Error() string {
+	return fmt.Sprintf("can't read config file: %v", e.err)
+}
+
+// loadConfig reads the config file at path. An empty path loads the config embedded in the binary.
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if len(path) > 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, &configReadError{err: err}
+		}
+		if err := decodeConfig(path, data, config); err != nil {
+			return nil, err
+		}
+	} else if err := decodeConfig(embeddedConfigName, embeddedConfig, config); err != nil {
+		return nil, fmt.Errorf("embedded config: %v", err)
+	}
+	if value, ok := os.LookupEnv(enabledEnvVar); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, expected true or false", enabledEnvVar, value)
+		}
+		config.Enabled = &enabled
+	}
+	config.setDefaults()
+	if err := config.compile(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return config, nil
+}
+
+// decodeConfig parses the config file as JSON or YAML, based on its extension. For other extensions
+// the format is sniffed from the content: a document starting with { is JSON.
+func decodeConfig(path string, data []byte, config *Config) error {
+	format := "YAML"
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		format = "JSON"
+	case ".yaml", ".yml":
+	default:
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			format = "JSON"
+		}
+	}
+
+	var err error
+	if format == "JSON" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	} else {
+		err = yaml.UnmarshalStrict(data, config)
+	}
+	if err != nil {
+		return fmt.Errorf("can't parse %s config file %s: %v", format, path, err)
+	}
+	return nil
+}
+
+// setDefaults fills the settings the config file left out. Omitting rules keeps the default rules,
+// an explicit empty list disables them.
+func (c *Config) setDefaults() {
+	defaults := defaultConfig()
+	if c.Enabled == nil {
+		c.Enabled = defaults.Enabled
+	}
+	if len(c.Pin.Annotation) == 0 {
+		c.Pin.Annotation = defaults.Pin.Annotation
+	}
+	if len(c.ManagedBy.Key) == 0 {
+		c.ManagedBy.Key = defaults.ManagedBy.Key
+	}
+	if len(c.ManagedBy.Value) == 0 {
+		c.ManagedBy.Value = defaults.ManagedBy.Value
+	}
+	if len(c.Timestamp.Annotation) == 0 {
+		c.Timestamp.Annotation = defaults.Timestamp.Annotation
+	}
+	if len(c.Timestamp.Format) == 0 {
+		c.Timestamp.Format = defaults.Timestamp.Format
+	}
+	if len(c.AppliedRules.Annotation) == 0 {
+		c.AppliedRules.Annotation = defaults.AppliedRules.Annotation
+	}
+	if len(c.ManagedFields.Manager) == 0 {
+		c.ManagedFields.Manager = defaults.ManagedFields.Manager
+	}
+	if c.ProtectedLabels == nil {
+		c.ProtectedLabels = defaults.ProtectedLabels
+	}
+	if c.SensitiveEnv == nil {
+		c.SensitiveEnv = defaults.SensitiveEnv
+	}
+	if c.Rules == nil {
+		c.Rules = defaults.Rules
+	}
+}
+
+// compile validates the config and prepares the parsed values used during admission.
+func (c *Config) compile() error {
+	if errs := validation.IsQualifiedName(c.ManagedBy.Key); len(errs) > 0 {
+		return fmt.Errorf("invalid managedBy key %q: %s", c.ManagedBy.Key, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsValidLabelValue(c.ManagedBy.Value); len(errs) > 0 {
+		return fmt.Errorf("invalid managedBy value %q: %s", c.ManagedBy.Value, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsQualifiedName(c.AppliedRules.Annotation); len(errs) > 0 {
+		return fmt.Errorf("invalid appliedRules annotation %q: %s", c.AppliedRules.Annotation, strings.Join(errs, ", "))
+	}
+	if len(c.ManagedFields.Manager) > maxFieldManagerLength {
+		return fmt.Errorf("managedFields manager %q is longer than %d characters", c.ManagedFields.Manager, maxFieldManagerLength)
+	}
+	switch c.Timestamp.Format {
+	case TimestampRFC3339, TimestampUnix:
+	default:
+		return fmt.Errorf("invalid timestamp format %q, expected %s or %s", c.Timestamp.Format, TimestampRFC3339, TimestampUnix)
+	}
+	for _, key := range c.ProtectedLabels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid protected label %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	c.sensitiveEnv = nil
+	for _, pattern := range c.SensitiveEnv {
+		if len(pattern) == 0 {
+			return errors.New("empty sensitiveEnv pattern")
+		}
+		c.sensitiveEnv = append(c.sensitiveEnv, globToRegexp(pattern))
+	}
+	names := map[string]bool{}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if len(rule.Name) == 0 {
+			return fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %q: %v", rule.Name, err)
+		}
+	}
+	c.namespaceRules = map[string]map[string]bool{}
+	for namespace, ruleNames := range c.NamespaceRules {
+		enabled := map[string]bool{}
+		for _, name := range ruleNames {
+			if !names[name] {
+				return fmt.Errorf("namespaceRules of %q: unknown rule %q", namespace, name)
+			}
+			enabled[name] = true
+		}
+		c.namespaceRules[namespace] = enabled
+	}
+	for i, owner := range c.ProtectedOwners {
+		if len(owner.Kind) == 0 {
+			return fmt.Errorf("protected owner %d has no kind", i)
+		}
+	}
+	if c.MaxContainers < 0 {
+		return fmt.Errorf("invalid maxContainers %d, expected a non-negative value", c.MaxContainers)
+	}
+	return nil
+}
+
+// needsNamespaces reports whether a rule selects or reads namespace labels, so namespaces must be looked up.
+func (c *Config) needsNamespaces() bool {
+	for i := range c.Rules {
+		if c.Rules[i].Selector.NamespaceSelector != nil || c.Rules[i].CostAllocation != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// disabled reports whether the kill switch is on and pods must be admitted unchanged.
+func (c *Config) disabled() bool {
+	return c.Enabled != nil && !*c.Enabled
+}
+
+// needsLimitRanges reports whether a rule looks up the LimitRanges of the pod namespace.
+func (c *Config) needsLimitRanges() bool {
+	for i := range c.Rules {
+		if limits := c.Rules[i].Limits; limits != nil && limits.SkipWithLimitRange {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleEnabled reports whether the rule applies to pods in the namespace.
+func (c *Config) ruleEnabled(namespace, rule string) bool {
+	enabled, ok := c.namespaceRules[namespace]
+	return !ok || enabled[rule]
+}
+
+func (r *Rule) compile() error {
+	mutations := r.mutations()
+	if len(mutations) != 1 {
+		return fmt.Errorf("expected exactly one mutation, got %d", len(mutations))
+	}
+	switch r.OnError {
+	case "", OnErrorFail, OnErrorSkip:
+	default:
+		return fmt.Errorf("invalid onError %q, expected %s or %s", r.OnError, OnErrorFail, OnErrorSkip)
+	}
+	if r.MaxOperations < 0 {
+		return fmt.Errorf("invalid maxOperations %d, expected a non-negative value", r.MaxOperations)
+	}
+	if r.LogCooldown.Duration < 0 {
+		return fmt.Errorf("invalid logCooldown %s, expected a non-negative duration", r.LogCooldown.Duration)
+	}
+	r.logs = &logSampler{cooldown: r.LogCooldown.Duration}
+	if r.MetricNamespaces == 0 {
+		r.MetricNamespaces = defaultMetricNamespaces
+	}
+	if r.MetricNamespaces < 0 {
+		return fmt.Errorf("invalid metricNamespaces %d, expected a positive value", r.MetricNamespaces)
+	}
+	r.namespaces = newLabelCap(r.MetricNamespaces)
+	if _, ok := mutations[0].(linuxOnly); ok {
+		if r.Selector.OS == corev1.Windows {
+			return errors.New("the rule sets Linux-only fields, which the API server rejects for windows pods")
+		}
+		r.Selector.OS = corev1.Linux
+	}
+	if err := r.Selector.compile(); err != nil {
+		return err
+	}
+	return mutations[0].compile()
+}
+
+// mutation returns the mutation of a compiled rule.
+func (r *Rule) mutation() mutation {
+	return r.mutations()[0]
+}
+
+// mutations returns the mutation fields set on the rule.
+func (r *Rule) mutations() []mutation {
+	var mutations []mutation
+	if r.Limits != nil {
+		mutations = append(mutations, r.Limits)
+	}
+	if r.ImagePullPolicy != nil {
+		mutations = append(mutations, r.ImagePullPolicy)
+	}
+	if r.RawPatch != nil {
+		mutations = append(mutations, r.RawPatch)
+	}
+	if r.ReadinessProbe != nil {
+		mutations = append(mutations, r.ReadinessProbe)
+	}
+	if r.SeccompProfile != nil {
+		mutations = append(mutations, r.SeccompProfile)
+	}
+	if r.ProjectedToken != nil {
+		mutations = append(mutations, r.ProjectedToken)
+	}
+	if r.DefaultServiceAccountWarning != nil {
+		mutations = append(mutations, r.DefaultServiceAccountWarning)
+	}
+	if r.DNSSearch != nil {
+		mutations = append(mutations, r.DNSSearch)
+	}
+	if r.StartupProbe != nil {
+		mutations = append(mutations, r.StartupProbe)
+	}
+	if r.RunAs != nil {
+		mutations = append(mutations, r.RunAs)
+	}
+	if r.PodAntiAffinity != nil {
+		mutations = append(mutations, r.PodAntiAffinity)
+	}
+	if r.TopologySpread != nil {
+		mutations = append(mutations, r.TopologySpread)
+	}
+	if r.Env != nil {
+		mutations = append(mutations, r.Env)
+	}
+	if r.PodDisruptionBudget != nil {
+		mutations = append(mutations, r.PodDisruptionBudget)
+	}
+	if r.GuaranteedQoS != nil {
+		mutations = append(mutations, r.GuaranteedQoS)
+	}
+	if r.TopologyAwareHints != nil {
+		mutations = append(mutations, r.TopologyAwareHints)
+	}
+	if r.CostAllocation != nil {
+		mutations = append(mutations, r.CostAllocation)
+	}
+	if r.Tolerations != nil {
+		mutations = append(mutations, r.Tolerations)
+	}
+	if r.ReadinessGate != nil {
+		mutations = append(mutations, r.ReadinessGate)
+	}
+	if r.EmptyDirSizeLimit != nil {
+		mutations = append(mutations, r.EmptyDirSizeLimit)
+	}
+	if r.FSGroupChangePolicy != nil {
+		mutations = append(mutations, r.FSGroupChangePolicy)
+	}
+	if r.WorkingDir != nil {
+		mutations = append(mutations, r.WorkingDir)
+	}
+	if r.PrivilegeEscalation != nil {
+		mutations = append(mutations, r.PrivilegeEscalation)
+	}
+	if r.DropCapabilities != nil {
+		mutations = append(mutations, r.DropCapabilities)
+	}
+	if r.LimitsFromRequests != nil {
+		mutations = append(mutations, r.LimitsFromRequests)
+	}
+	if r.MemoryEnv != nil {
+		mutations = append(mutations, r.MemoryEnv)
+	}
+	if r.LimitProfiles != nil {
+		mutations = append(mutations, r.LimitProfiles)
+	}
+	if r.StdinTTY != nil {
+		mutations = append(mutations, r.StdinTTY)
+	}
+	if r.PreferredNodeAffinity != nil {
+		mutations = append(mutations, r.PreferredNodeAffinity)
+	}
+	if r.PostStart != nil {
+		mutations = append(mutations, r.PostStart)
+	}
+	if r.HostPorts != nil {
+		mutations = append(mutations, r.HostPorts)
+	}
+	if r.Sysctls != nil {
+		mutations = append(mutations, r.Sysctls)
+	}
+	if r.MeshSidecar != nil {
+		mutations = append(mutations, r.MeshSidecar)
+	}
+	if r.Subdomain != nil {
+		mutations = append(mutations, r.Subdomain)
+	}
+	if r.Annotations != nil {
+		mutations = append(mutations, r.Annotations)
+	}
+	return mutations
+}
+
+func (s *Selector) compile() error {
+	switch s.OS {
+	case "", corev1.Linux, corev1.Windows:
+	default:
+		return fmt.Errorf("invalid os %q, expected %s or %s", s.OS, corev1.Linux, corev1.Windows)
+	}
+	s.podSelector = labels.Everything()
+	if s.PodSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(s.PodSelector)
+		if err != nil {
+			return fmt.Errorf("invalid podSelector: %v", err)
+		}
+		s.podSelector = selector
+	}
+	s.namespaceSelector = nil
+	if s.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(s.NamespaceSelector)
+		if err != nil {
+			return fmt.Errorf("invalid namespaceSelector: %v", err)
+		}
+		s.namespaceSelector = selector
+	}
+	if len(s.ContainerNamePattern) > 0 {
+		pattern, err := regexp.Compile(s.ContainerNamePattern)
+		if err != nil {
+			return fmt.Errorf("invalid containerNamePattern: %v", err)
+		}
+		s.containerNamePattern = pattern
+	}
+	s.images = nil
+	for _, image := range s.Images {
+		s.images = append(s.images, globToRegexp(image))
+	}
+	s.excludeImages = nil
+	for _, image := range s.ExcludeImages {
+		s.excludeImages = append(s.excludeImages, globToRegexp(image))
+	}
+	return nil
+}
+
+// globToRegexp turns a pattern where * matches any characters into an anchored regular expression.
+func globToRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+func (l *LimitsRule) compile() error {
+	l.limits = corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{
+		corev1.ResourceCPU:              l.CPU,
+		corev1.ResourceMemory:           l.Memory,
+		corev1.ResourceEphemeralStorage: l.EphemeralStorage,
+	} {
+		if len(value) == 0 {
+			continue
+		}
+		if strings.HasSuffix(value, "%") {
+			quantity, err := l.percentage(name, value)
+			if err != nil {
+				return fmt.Errorf("invalid %s limit %q: %v", name, value, err)
+			}
+			l.limits[name] = quantity
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s limit %q: %v", name, value, err)
+		}
+		l.limits[name] = quantity
+	}
+	if len(l.limits) == 0 {
+		return errors.New("limits rule needs at least one of cpu, memory or ephemeralStorage")
+	}
+	return nil
+}
+
+// percentage resolves a percentage limit like 10% against the reference node.
+func (l *LimitsRule) percentage(name corev1.ResourceName, value string) (resource.Quantity, error) {
+	if l.ReferenceNode == nil {
+		return resource.Quantity{}, errors.New("percentages need a referenceNode")
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return resource.Quantity{}, errors.New("expected a percentage between 0 and 100")
+	}
+	if name == corev1.ResourceCPU {
+		if l.ReferenceNode.CPU.IsZero() {
+			return resource.Quantity{}, errors.New("referenceNode has no cpu")
+		}
+		return *resource.NewMilliQuantity(int64(float64(l.ReferenceNode.CPU.MilliValue())*percent/100), resource.DecimalSI), nil
+	}
+	capacity := l.ReferenceNode.Memory
+	if name == corev1.ResourceEphemeralStorage {
+		capacity = l.ReferenceNode.EphemeralStorage
+	}
+	if capacity.IsZero() {
+		return resource.Quantity{}, fmt.Errorf("referenceNode has no %s", name)
+	}
+	return *resource.NewQuantity(int64(float64(capacity.Value())*percent/100), resource.BinarySI), nil
+}
+
+func (p *ImagePullPolicyRule) compile() error {
+	if len(p.Default) == 0 && len(p.Registries) == 0 {
+		return errors.New("imagePullPolicy rule needs a default or registries")
+	}
+	if len(p.Default) > 0 {
+		if err := validatePullPolicy(p.Default); err != nil {
+			return err
+		}
+	}
+	for i := range p.Registries {
+		registry := &p.Registries[i]
+		if len(registry.Registry) == 0 {
+			return fmt.Errorf("invalid registry pattern %q", registry.Registry)
+		}
+		if err := validatePullPolicy(registry.Policy); err != nil {
+			return fmt.Errorf("registry %s: %v", registry.Registry, err)
+		}
+		registry.registry = globToRegexp(registry.Registry)
+	}
+	return nil
+}
+
+func validatePullPolicy(policy corev1.PullPolicy) error {
+	switch policy {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return nil
+	}
+	return fmt.Errorf("invalid imagePullPolicy %q, expected one of %s", policy,
+		strings.Join([]string{string(corev1.PullAlways), string(corev1.PullIfNotPresent), string(corev1.PullNever)}, ", "))
+}
+
+func (p *RawPatchRule) compile() error {
+	if len(p.Operations) == 0 {
+		return errors.New("rawPatch rule needs at least one operation")
+	}
+	for i, operation := range p.operations {
+		if err := validateOperation(operation); err != nil {
+			return fmt.Errorf("operation %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (p *ReadinessProbeRule) compile() error {
+	if len(p.Annotation) == 0 {
+		p.Annotation = defaultReadinessProbeAnnotation
+	}
+	if p.InitialDelaySeconds < 0 || p.PeriodSeconds < 0 {
+		return errors.New("readinessProbe rule needs non-negative initialDelaySeconds and periodSeconds")
+	}
+	return nil
+}
+
+func (p *SeccompProfileRule) compile() error {
+	switch p.Level {
+	case "":
+		p.Level = LevelPod
+	case LevelPod, LevelContainer:
+	default:
+		return fmt.Errorf("invalid level %q, expected %s or %s", p.Level, LevelPod, LevelContainer)
+	}
+	return nil
+}
+
+func (t *ProjectedTokenRule) compile() error {
+	if len(t.VolumeName) == 0 {
+		t.VolumeName = defaultProjectedTokenVolume
+	}
+	if len(t.Path) == 0 {
+		t.Path = defaultProjectedTokenPath
+	}
+	if t.ExpirationSeconds == 0 {
+		t.ExpirationSeconds = defaultProjectedTokenExpiration
+	}
+	if errs := validation.IsDNS1123Label(t.VolumeName); len(errs) > 0 {
+		return fmt.Errorf("invalid volumeName %q: %s", t.VolumeName, strings.Join(errs, ", "))
+	}
+	if !strings.HasPrefix(t.MountPath, "/") {
+		return fmt.Errorf("projectedToken rule needs an absolute mountPath, got %q", t.MountPath)
+	}
+	if t.ExpirationSeconds < minProjectedTokenExpiration {
+		return fmt.Errorf("expirationSeconds must be at least %d", minProjectedTokenExpiration)
+	}
+	return nil
+}
+
+func (d *DefaultServiceAccountWarningRule) compile() error {
+	return nil
+}
+
+func (d *DNSSearchRule) compile() error {
+	if len(d.Domains) == 0 {
+		return errors.New("dnsSearch rule needs at least one domain")
+	}
+	for _, domain := range d.Domains {
+		if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+			return fmt.Errorf("invalid search domain %q: %s", domain, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+func (p *StartupProbeRule) compile() error {
+	if p.FailureThreshold == 0 {
+		p.FailureThreshold = defaultStartupProbeFailureThreshold
+	}
+	if p.PeriodSeconds == 0 {
+		p.PeriodSeconds = defaultStartupProbePeriodSeconds
+	}
+	if p.FailureThreshold < 0 || p.PeriodSeconds < 0 {
+		return errors.New("startupProbe rule needs positive failureThreshold and periodSeconds")
+	}
+	return nil
+}
+
+func (u *RunAsRule) compile() error {
+	switch u.Level {
+	case "":
+		u.Level = LevelPod
+	case LevelPod, LevelContainer:
+	default:
+		return fmt.Errorf("invalid level %q, expected %s or %s", u.Level, LevelPod, LevelContainer)
+	}
+	if u.User == nil && u.Group == nil {
+		return errors.New("runAs rule needs a user or a group")
+	}
+	if (u.User != nil && *u.User < 0) || (u.Group != nil && *u.Group < 0) {
+		return errors.New("runAs rule needs non-negative ids")
+	}
+	return nil
+}
+
+func (a *PodAntiAffinityRule) compile() error {
+	if len(a.TopologyKey) == 0 {
+		a.TopologyKey = corev1.LabelHostname
+	}
+	if errs := validation.IsQualifiedName(a.TopologyKey); len(errs) > 0 {
+		return fmt.Errorf("invalid topologyKey %q: %s", a.TopologyKey, strings.Join(errs, ", "))
+	}
+	if a.Weight == 0 {
+		a.Weight = defaultPodAntiAffinityWeight
+	}
+	if a.Weight < 1 || a.Weight > 100 {
+		return fmt.Errorf("invalid weight %d, expected 1 to 100", a.Weight)
+	}
+	switch a.Type {
+	case "":
+		a.Type = AntiAffinityPreferred
+	case AntiAffinityPreferred, AntiAffinityRequired:
+	default:
+		return fmt.Errorf("invalid anti-affinity type %q, expected %s or %s", a.Type, AntiAffinityPreferred, AntiAffinityRequired)
+	}
+	return nil
+}
+
+func (t *TopologySpreadRule) compile() error {
+	if len(t.TopologyKey) == 0 {
+		t.TopologyKey = corev1.LabelTopologyZone
+	}
+	if errs := validation.IsQualifiedName(t.TopologyKey); len(errs) > 0 {
+		return fmt.Errorf("invalid topologyKey %q: %s", t.TopologyKey, strings.Join(errs, ", "))
+	}
+	if t.MaxSkew == 0 {
+		t.MaxSkew = defaultTopologySpreadMaxSkew
+	}
+	if t.MaxSkew < 0 {
+		return fmt.Errorf("invalid maxSkew %d, expected a positive value", t.MaxSkew)
+	}
+	switch t.WhenUnsatisfiable {
+	case "":
+		t.WhenUnsatisfiable = corev1.ScheduleAnyway
+	case corev1.ScheduleAnyway, corev1.DoNotSchedule:
+	default:
+		return fmt.Errorf("invalid whenUnsatisfiable %q, expected %s or %s", t.WhenUnsatisfiable, corev1.ScheduleAnyway, corev1.DoNotSchedule)
+	}
+	return nil
+}
+
+func (e *EnvRule) compile() error {
+	if len(e.Variables) == 0 {
+		return errors.New("env rule needs at least one variable")
+	}
+	names := map[string]bool{}
+	for _, variable := range e.Variables {
+		if len(variable.Name) == 0 {
+			return errors.New("env rule variables need a name")
+		}
+		if errs := validation.IsEnvVarName(variable.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid variable name %q: %s", variable.Name, strings.Join(errs, ", "))
+		}
+		if names[variable.Name] {
+			return fmt.Errorf("duplicate variable %q", variable.Name)
+		}
+		names[variable.Name] = true
+	}
+	return nil
+}
+
+func (p *PodDisruptionBudgetRule) compile() error {
+	if len(p.Annotation) == 0 {
+		p.Annotation = defaultPodDisruptionBudgetAnnotation
+	}
+	if errs := validation.IsQualifiedName(p.Annotation); len(errs) > 0 {
+		return fmt.Errorf("invalid annotation %q: %s", p.Annotation, strings.Join(errs, ", "))
+	}
+	if (len(p.Name) == 0) == (len(p.NameFromLabel) == 0) {
+		return errors.New("podDisruptionBudget rule needs exactly one of name or nameFromLabel")
+	}
+	if len(p.Name) > 0 {
+		if errs := validation.IsDNS1123Subdomain(p.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid name %q: %s", p.Name, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+func (q *GuaranteedQoSRule) compile() error {
+	if len(q.Annotation) == 0 {
+		q.Annotation = defaultQoSAnnotation
+	}
+	if errs := validation.IsQualifiedName(q.Annotation); len(errs) > 0 {
+		return fmt.Errorf("invalid annotation %q: %s", q.Annotation, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (t *TopologyAwareHintsRule) compile() error {
+	if len(t.Annotation) == 0 {
+		t.Annotation = defaultTopologyAwareHintsAnnotation
+	}
+	if errs := validation.IsQualifiedName(t.Annotation); len(errs) > 0 {
+		return fmt.Errorf("invalid annotation %q: %s", t.Annotation, strings.Join(errs, ", "))
+	}
+	if len(t.Value) == 0 {
+		t.Value = defaultTopologyAwareHintsValue
+	}
+	return nil
+}
+
+func (c *CostAllocationRule) compile() error {
+	if len(c.Annotations) == 0 {
+		return errors.New("costAllocation rule needs at least one annotation")
+	}
+	for i := range c.Annotations {
+		annotation := &c.Annotations[i]
+		if errs := validation.IsQualifiedName(annotation.Annotation); len(errs) > 0 {
+			return fmt.Errorf("invalid annotation %q: %s", annotation.Annotation, strings.Join(errs, ", "))
+		}
+		if len(annotation.FromLabel) == 0 {
+			annotation.FromLabel = annotation.Annotation
+		}
+		if errs := validation.IsQualifiedName(annotation.FromLabel); len(errs) > 0 {
+			return fmt.Errorf("invalid fromLabel %q: %s", annotation.FromLabel, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+func (t *TolerationsRule) compile() error {
+	if len(t.Tolerations) == 0 && !t.Spot {
+		return errors.New("tolerations rule needs at least one toleration or spot")
+	}
+	t.tolerations = append([]corev1.Toleration(nil), t.Tolerations...)
+	if t.Spot {
+		t.tolerations = append(t.tolerations, spotTolerations...)
+	}
+	for _, toleration := range t.Tolerations {
+		if len(toleration.Key) > 0 {
+			if errs := validation.IsQualifiedName(toleration.Key); len(errs) > 0 {
+				return fmt.Errorf("invalid toleration key %q: %s", toleration.Key, strings.Join(errs, ", "))
+			}
+		}
+		switch toleration.Operator {
+		case "", corev1.TolerationOpEqual:
+			if len(toleration.Key) == 0 {
+				return errors.New("tolerations without a key need operator Exists")
+			}
+		case corev1.TolerationOpExists:
+			if len(toleration.Value) > 0 {
+				return fmt.Errorf("toleration %q with operator Exists can't have a value", toleration.Key)
+			}
+		default:
+			return fmt.Errorf("invalid toleration operator %q, expected %s or %s", toleration.Operator, corev1.TolerationOpEqual, corev1.TolerationOpExists)
+		}
+		switch toleration.Effect {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return fmt.Errorf("invalid toleration effect %q", toleration.Effect)
+		}
+	}
+	return nil
+}
+
+func (g *ReadinessGateRule) compile() error {
+	if errs := validation.IsQualifiedName(string(g.ConditionType)); len(errs) > 0 {
+		return fmt.Errorf("invalid readiness gate condition type %q: %s", g.ConditionType, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (e *EmptyDirSizeLimitRule) compile() error {
+	if e.SizeLimit == nil {
+		sizeLimit := resource.MustParse(defaultEmptyDirSizeLimit)
+		e.SizeLimit = &sizeLimit
+	}
+	if e.SizeLimit.Sign() <= 0 {
+		return fmt.Errorf("emptyDir sizeLimit must be positive, got %s", e.SizeLimit.String())
+	}
+	return nil
+}
+
+func (f *FSGroupChangePolicyRule) compile() error {
+	switch f.Policy {
+	case "":
+		f.Policy = corev1.FSGroupChangeOnRootMismatch
+	case corev1.FSGroupChangeOnRootMismatch, corev1.FSGroupChangeAlways:
+	default:
+		return fmt.Errorf("unknown fsGroupChangePolicy %q, expected %s or %s", f.Policy, corev1.FSGroupChangeOnRootMismatch, corev1.FSGroupChangeAlways)
+	}
+	if f.FSGroup != nil && *f.FSGroup < 0 {
+		return fmt.Errorf("fsGroup must not be negative, got %d", *f.FSGroup)
+	}
+	return nil
+}
+
+func (d *WorkingDirRule) compile() error {
+	if !filepath.IsAbs(d.Path) {
+		return fmt.Errorf("workingDir path must be absolute, got %q", d.Path)
+	}
+	return nil
+}
+
+func (e *PrivilegeEscalationRule) compile() error {
+	return nil
+}
+
+var capabilityPattern = regexp.MustCompile(`^[A-Z][A-Z_]*$`)
+
+func (d *DropCapabilitiesRule) compile() error {
+	for _, capability := range d.Add {
+		if !capabilityPattern.MatchString(string(capability)) || capability == "ALL" {
+			return fmt.Errorf("invalid capability %q, expected a name like NET_BIND_SERVICE", capability)
+		}
+	}
+	return nil
+}
+
+func (l *LimitsFromRequestsRule) compile() error {
+	l.ratios = map[corev1.ResourceName]float64{}
+	for name, ratio := range map[corev1.ResourceName]float64{
+		corev1.ResourceCPU:              l.CPU,
+		corev1.ResourceMemory:           l.Memory,
+		corev1.ResourceEphemeralStorage: l.EphemeralStorage,
+	} {
+		if ratio == 0 {
+			continue
+		}
+		if ratio < 1 {
+			return fmt.Errorf("invalid %s ratio %g, limits can't be below the requests", name, ratio)
+		}
+		l.ratios[name] = ratio
+	}
+	if len(l.ratios) == 0 {
+		return errors.New("limitsFromRequests rule needs a ratio for at least one of cpu, memory or ephemeralStorage")
+	}
+	return nil
+}
+
+// memoryUnits are the units of MemoryEnvVar in bytes.
+var memoryUnits = map[string]int64{"B": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30}
+
+func (m *MemoryEnvRule) compile() error {
+	if len(m.Variables) == 0 {
+		return errors.New("memoryEnv rule needs at least one variable")
+	}
+	for i := range m.Variables {
+		variable := &m.Variables[i]
+		if errs := validation.IsEnvVarName(variable.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid variable name %q: %s", variable.Name, strings.Join(errs, ", "))
+		}
+		if variable.Ratio == 0 {
+			variable.Ratio = 1
+		}
+		if variable.Ratio < 0 || variable.Ratio > 1 {
+			return fmt.Errorf("variable %s: invalid ratio %g, expected a value between 0 and 1", variable.Name, variable.Ratio)
+		}
+		if len(variable.Unit) == 0 {
+			variable.Unit = "B"
+		}
+		if _, ok := memoryUnits[variable.Unit]; !ok {
+			return fmt.Errorf("variable %s: unknown unit %q, expected B, KiB, MiB or GiB", variable.Name, variable.Unit)
+		}
+		if len(variable.Value) == 0 {
+			variable.Value = "{{.}}"
+		}
+		value, err := template.New(variable.Name).Parse(variable.Value)
+		if err != nil {
+			return fmt.Errorf("variable %s: invalid value template: %v", variable.Name, err)
+		}
+		variable.value = value
+	}
+	return nil
+}
+
+func (p *LimitProfilesRule) compile() error {
+	if len(p.Label) == 0 {
+		p.Label = defaultLimitProfileLabel
+	}
+	if errs := validation.IsQualifiedName(p.Label); len(errs) > 0 {
+		return fmt.Errorf("invalid label %q: %s", p.Label, strings.Join(errs, ", "))
+	}
+	if len(p.Profiles) == 0 {
+		return errors.New("limitProfiles rule needs at least one profile")
+	}
+	for name, profile := range p.Profiles {
+		if profile == nil {
+			return fmt.Errorf("profile %q has no limits", name)
+		}
+		if err := profile.compile(); err != nil {
+			return fmt.Errorf("profile %q: %v", name, err)
+		}
+	}
+	if _, ok := p.Profiles[p.Default]; len(p.Default) > 0 && !ok {
+		return fmt.Errorf("unknown default profile %q", p.Default)
+	}
+	return nil
+}
+
+func (t *StdinTTYRule) compile() error {
+	if len(t.Annotation) == 0 {
+		t.Annotation = defaultInteractiveAnnotation
+	}
+	if errs := validation.IsQualifiedName(t.Annotation); len(errs) > 0 {
+		return fmt.Errorf("invalid annotation %q: %s", t.Annotation, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (a *PreferredNodeAffinityRule) compile() error {
+	if len(a.Preferences) == 0 {
+		return errors.New("preferredNodeAffinity rule needs at least one preference")
+	}
+	for i, preference := range a.Preferences {
+		if preference.Weight < 1 || preference.Weight > 100 {
+			return fmt.Errorf("preference %d: invalid weight %d, expected 1 to 100", i, preference.Weight)
+		}
+		if len(preference.Preference.MatchExpressions) == 0 && len(preference.Preference.MatchFields) == 0 {
+			return fmt.Errorf("preference %d needs matchExpressions or matchFields", i)
+		}
+		for _, requirement := range preference.Preference.MatchExpressions {
+			if errs := validation.IsQualifiedName(requirement.Key); len(errs) > 0 {
+				return fmt.Errorf("preference %d: invalid key %q: %s", i, requirement.Key, strings.Join(errs, ", "))
+			}
+			switch requirement.Operator {
+			case corev1.NodeSelectorOpIn, corev1.NodeSelectorOpNotIn, corev1.NodeSelectorOpExists,
+				corev1.NodeSelectorOpDoesNotExist, corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+			default:
+				return fmt.Errorf("preference %d: invalid operator %q", i, requirement.Operator)
+			}
+		}
+	}
+	return nil
+}
+
+func (h *PostStartRule) compile() error {
+	switch {
+	case h.Exec != nil && h.HTTPGet != nil:
+		return errors.New("postStart rule needs either exec or httpGet, not both")
+	case h.TCPSocket != nil:
+		return errors.New("postStart rule doesn't support tcpSocket, the kubelet doesn't run it")
+	case h.Exec != nil:
+		if len(h.Exec.Command) == 0 {
+			return errors.New("postStart rule needs an exec command")
+		}
+	case h.HTTPGet != nil:
+		if h.HTTPGet.Port.IntValue() == 0 && len(h.HTTPGet.Port.StrVal) == 0 {
+			return errors.New("postStart rule needs an httpGet port")
+		}
+	default:
+		return errors.New("postStart rule needs exec or httpGet")
+	}
+	return nil
+}
+
+func (h *HostPortsRule) compile() error {
+	switch h.Action {
+	case "":
+		h.Action = HostPortsDeny
+	case HostPortsDeny, HostPortsStrip:
+	default:
+		return fmt.Errorf("invalid hostPorts action %q, expected %s or %s", h.Action, HostPortsDeny, HostPortsStrip)
+	}
+	return nil
+}
+
+// safeSysctls are the sysctls the kubelet allows without --allowed-unsafe-sysctls.
+var safeSysctls = map[string]bool{
+	"kernel.shm_rmid_forced":              true,
+	"net.ipv4.ip_local_port_range":        true,
+	"net.ipv4.tcp_syncookies":             true,
+	"net.ipv4.ping_group_range":           true,
+	"net.ipv4.ip_unprivileged_port_start": true,
+}
+
+var sysctlPattern = regexp.MustCompile(`^([a-z0-9]([-_a-z0-9]*[a-z0-9])?[./])*[a-z0-9]([-_a-z0-9]*[a-z0-9])?$`)
+
+func (s *SysctlsRule) compile() error {
+	if len(s.Sysctls) == 0 {
+		return errors.New("sysctls rule needs at least one sysctl")
+	}
+	allowed := map[string]bool{}
+	for _, name := range s.AllowedUnsafeSysctls {
+		allowed[name] = true
+	}
+	names := map[string]bool{}
+	for _, sysctl := range s.Sysctls {
+		if !sysctlPattern.MatchString(sysctl.Name) {
+			return fmt.Errorf("invalid sysctl name %q", sysctl.Name)
+		}
+		if !safeSysctls[sysctl.Name] && !allowed[sysctl.Name] {
+			return fmt.Errorf("sysctl %s is not safe, list it in allowedUnsafeSysctls if the kubelets allow it", sysctl.Name)
+		}
+		if names[sysctl.Name] {
+			return fmt.Errorf("duplicate sysctl %s", sysctl.Name)
+		}
+		names[sysctl.Name] = true
+	}
+	return nil
+}
+
+func (m *MeshSidecarRule) compile() error {
+	if m.Containers == nil {
+		m.Containers = []string{"istio-proxy", "linkerd-proxy"}
+	}
+	if m.InjectAnnotations == nil {
+		m.InjectAnnotations = []string{"sidecar.istio.io/inject", "linkerd.io/inject"}
+	}
+	if len(m.Annotations) == 0 {
+		return errors.New("meshSidecar rule needs at least one annotation")
+	}
+	for _, key := range m.InjectAnnotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid inject annotation %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	for key := range m.Annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid annotation %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+func (d *SubdomainRule) compile() error {
+	if (len(d.Subdomain) == 0) == (len(d.FromLabel) == 0) {
+		return errors.New("subdomain rule needs exactly one of subdomain or fromLabel")
+	}
+	if len(d.Subdomain) > 0 {
+		if errs := validation.IsDNS1123Label(d.Subdomain); len(errs) > 0 {
+			return fmt.Errorf("invalid subdomain %q: %s", d.Subdomain, strings.Join(errs, ", "))
+		}
+	}
+	if len(d.FromLabel) > 0 {
+		if errs := validation.IsQualifiedName(d.FromLabel); len(errs) > 0 {
+			return fmt.Errorf("invalid label %q: %s", d.FromLabel, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+func (a *AnnotationsRule) compile() error {
+	if len(a.Annotations) == 0 {
+		return errors.New("annotations rule needs at least one annotation")
+	}
+	for key := range a.Annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid annotation %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
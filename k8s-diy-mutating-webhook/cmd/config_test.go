@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFormats(t *testing.T) {
+	yamlConfig := `
+managedBy:
+  enabled: true
+rules:
+- name: limits
+  selector:
+    containerNamePattern: ^app
+  limits:
+    cpu: 100m
+`
+	jsonConfig := `{
+  "managedBy": {"enabled": true},
+  "rules": [{"name": "limits", "selector": {"containerNamePattern": "^app"}, "limits": {"cpu": "100m"}}]
+}`
+	want, err := loadConfig(writeConfig(t, "config.yaml", yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		config string
+	}{
+		{name: "config.yml", config: yamlConfig},
+		{name: "config.json", config: jsonConfig},
+		{name: "config.JSON", config: jsonConfig},
+		{name: "config", config: jsonConfig},
+		{name: "config.conf", config: yamlConfig},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := loadConfig(writeConfig(t, test.name, test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got config %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{name: "config.json", config: yamlConfig, err: "can't parse JSON config file"},
+		{name: "config.yaml", config: "rules: [", err: "can't parse YAML config file"},
+		{name: "config", config: `{"rules": [}`, err: "can't parse JSON config file"},
+		{name: "config.json", config: `{"rulez": []}`, err: `unknown field "rulez"`},
+	} {
+		t.Run(test.name+" error", func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, test.name, test.config))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEmbedded(t *testing.T) {
+	got, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("embedded config: %v", err)
+	}
+	want, err := loadConfig(writeConfig(t, embeddedConfigName, string(embeddedConfig)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got config %+v, want the embedded config %+v", got, want)
+	}
+
+	// Without a config file pods still get default limits.
+	_, patched := mutatePod(t, testPod(t, "spec:\n  containers:\n  - name: app\n"), got, patchOptions{})
+	expectPod(t, patched, testPod(t, "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {cpu: 100m, memory: 100Mi}\n"))
+}
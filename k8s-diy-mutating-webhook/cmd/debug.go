@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// debugPatchResponse is returned by /debug/patch.
+type debugPatchResponse struct {
+	Patch    json.RawMessage `json:"patch"`
+	Warnings []string        `json:"warnings,omitempty"`
+	Denials  []string        `json:"denials,omitempty"`
+	// Trace explains for every rule why it did or didn't change the pod.
+	Trace []ruleTrace `json:"trace"`
+	// Pod is the input pod with the patch applied. Sensitive env values are masked in it and in the patch.
+	Pod json.RawMessage `json:"pod"`
+}
+
+// debugPatch computes the patch for the pod in the request body (YAML or JSON) and returns it together
+// with the patched pod and the rule evaluation trace. Applying the patch here also verifies that it applies
+// cleanly. The values of sensitive env vars are masked, like in the logs.
+func (wh *mutatingWebhook) debugPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeErrorResponse(w, errorLogger, errors.New(fmt.Sprintf("can't read request body: %v", err)))
+		return
+	}
+	pod := corev1.Pod{}
+	if err := yaml.Unmarshal(body, &pod); err != nil {
+		writeErrorResponse(w, errorLogger, errors.New(fmt.Sprintf("can't decode pod: %v", err)))
+		return
+	}
+
+	config := wh.currentConfig()
+	result, err := computePatch(&pod, config, patchOptions{trace: true, skipMetrics: true})
+	if err != nil {
+		writeErrorResponse(w, errorLogger, errors.New(fmt.Sprintf("can't compute patch: %v", err)))
+		return
+	}
+	patched, err := applyPatch(&pod, result.patch)
+	if err != nil {
+		writeErrorResponse(w, errorLogger, err)
+		return
+	}
+
+	mutated := corev1.Pod{}
+	if err := json.Unmarshal(patched, &mutated); err != nil {
+		writeErrorResponse(w, errorLogger, errors.New(fmt.Sprintf("can't decode patched pod: %v", err)))
+		return
+	}
+	redactor := config.envRedactor(&mutated)
+	redactedPatch, err := redactor.redactPatch(result.patch)
+	if err != nil {
+		writeErrorResponse(w, errorLogger, err)
+		return
+	}
+	redactedPod, err := redactor.redactJSON(patched)
+	if err != nil {
+		writeErrorResponse(w, errorLogger, err)
+		return
+	}
+
+	resp, err := json.Marshal(debugPatchResponse{
+		Patch:    redactedPatch,
+		Warnings: result.warnings,
+		Denials:  result.denials,
+		Trace:    result.trace,
+		Pod:      redactedPod,
+	})
+	if err != nil {
+		writeErrorResponse(w, errorLogger, errors.New(fmt.Sprintf("not possible marshall response: %v", err)))
+		return
+	}
+
+	w.Header().Set(ContentTypeKey, ContentTypeJSON)
+	w.Write(resp)
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// debugPatch posts the pod manifest to /debug/patch and decodes the response.
+func debugPatch(t *testing.T, wh *mutatingWebhook, manifest string) *debugPatchResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	wh.debugPatch(w, httptest.NewRequest(http.MethodPost, "/debug/patch", strings.NewReader(manifest)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	response := &debugPatchResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+		t.Fatalf("can't decode response: %v", err)
+	}
+	return response
+}
+
+func TestDebugPatchReturnsPatchedPod(t *testing.T) {
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m, memory: 100Mi}}]\n")
+	response := debugPatch(t, wh, cachedPod)
+
+	var patch []patchOperation
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch[0].Path != "/spec/containers/0/resources/limits" {
+		t.Errorf("got patch %s, want the limits", response.Patch)
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(response.Pod, pod); err != nil {
+		t.Fatal(err)
+	}
+	limits := pod.Spec.Containers[0].Resources.Limits
+	if !limits.Cpu().Equal(resource.MustParse("100m")) || !limits.Memory().Equal(resource.MustParse("100Mi")) {
+		t.Errorf("got limits %v in the patched pod", limits)
+	}
+	if pod.Name != "web" {
+		t.Errorf("got pod name %q, want the input pod", pod.Name)
+	}
+}
+
+func TestDebugPatchTrace(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, `
+namespaceRules:
+  default: [limits, search, pull-policy]
+rules:
+- name: limits
+  limits: {cpu: 100m}
+- name: search
+  selector:
+    podSelector: {matchLabels: {app: api}}
+  dnsSearch: {domains: [example.org]}
+- name: pull-policy
+  imagePullPolicy: {default: IfNotPresent}
+- name: dns
+  dnsSearch: {domains: [example.com]}
+`)
+	response := debugPatch(t, wh, cachedPod+"    imagePullPolicy: Always\n")
+	want := []ruleTrace{
+		{Rule: "limits", Applied: true, Reason: "1 patch operations"},
+		{Rule: "search", Reason: "pod selector doesn't match"},
+		{Rule: "pull-policy", Reason: "nothing to change in 1 matched containers"},
+		{Rule: "dns", Reason: "rule is not enabled in namespace default"},
+	}
+	if !reflect.DeepEqual(response.Trace, want) {
+		t.Errorf("got trace %+v, want %+v", response.Trace, want)
+	}
+
+	// Admission requests don't pay for the trace.
+	if result, _ := mutatePod(t, testPod(t, cachedPod), wh.config, patchOptions{}); result.trace != nil {
+		t.Errorf("got trace %+v without the trace option", result.trace)
+	}
+}
+
+func TestDebugPatchErrors(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "rules: []\n")
+	for _, test := range []struct {
+		name   string
+		method string
+		body   string
+		code   int
+	}{
+		{name: "get", method: http.MethodGet, code: http.StatusMethodNotAllowed},
+		{name: "invalid pod", method: http.MethodPost, body: "spec: [", code: http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			wh.debugPatch(w, httptest.NewRequest(test.method, "/debug/patch", strings.NewReader(test.body)))
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Decisions of the decision records.
+const (
+	DecisionAllow  = "allow"
+	DecisionMutate = "mutate"
+	DecisionDeny   = "deny"
+)
+
+// decisionRecord is one line of the decisions stream. Fields are only ever added to it, so consumers can rely
+// on the existing ones.
+type decisionRecord struct {
+	Time      time.Time `json:"time"`
+	Webhook   string    `json:"webhook"`
+	UID       types.UID `json:"uid"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Operation string    `json:"operation"`
+	// Decision is allow, mutate or deny.
+	Decision string `json:"decision"`
+	// Rules are the rules that changed the object, in config order.
+	Rules    []string `json:"rules"`
+	Reason   string   `json:"reason,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// decisionLog writes a JSON line per admission decision, apart from the operational logs, for audit
+// pipelines. A nil decisionLog discards the decisions.
+type decisionLog struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// openDecisionLog appends the decisions to the file at path, or writes them to stdout for -.
+func openDecisionLog(path string) (*decisionLog, error) {
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+	return &decisionLog{encoder: json.NewEncoder(out)}, nil
+}
+
+// record writes the decision of the response to the request. rules are the rules that changed the object.
+func (d *decisionLog) record(webhook string, request *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse, rules []string) {
+	if d == nil || request == nil {
+		return
+	}
+	record := decisionRecord{
+		Time:      now().UTC(),
+		Webhook:   webhook,
+		UID:       request.UID,
+		Kind:      request.Kind.Kind,
+		Namespace: request.Namespace,
+		Name:      request.Name,
+		Operation: string(request.Operation),
+		Decision:  DecisionAllow,
+		Rules:     append([]string{}, rules...),
+		Warnings:  response.Warnings,
+	}
+	switch {
+	case !response.Allowed:
+		record.Decision = DecisionDeny
+		if response.Result != nil {
+			record.Reason = response.Result.Message
+		}
+	case len(response.Patch) > 0:
+		record.Decision = DecisionMutate
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.encoder.Encode(record); err != nil {
+		errorLogger.Printf("can't write decision: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestMutateRecordsDecisions(t *testing.T) {
+	captureLogs(t)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := now
+	now = func() time.Time { return at }
+	t.Cleanup(func() { now = clock })
+
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}, {name: host-ports, hostPorts: {}}]\n")
+	decisions := &bytes.Buffer{}
+	wh.decisions = &decisionLog{encoder: json.NewEncoder(decisions)}
+
+	unchanged := testPod(t, cachedPod)
+	unchanged.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+	denied := testPod(t, cachedPod)
+	denied.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 80, HostPort: 80}}
+	for _, pod := range []*corev1.Pod{testPod(t, cachedPod), unchanged, denied} {
+		review := podReview(t, pod)
+		review.Request.Name = pod.Name
+		admissionResponse(t, wh.mutate, review)
+	}
+
+	var records []decisionRecord
+	decoder := json.NewDecoder(decisions)
+	for decoder.More() {
+		var record decisionRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	want := []decisionRecord{
+		{Decision: DecisionMutate, Rules: []string{"limits"}},
+		{Decision: DecisionAllow, Rules: []string{}},
+		// The rules that fired are recorded for denied pods too, although their changes aren't returned.
+		{Decision: DecisionDeny, Rules: []string{"limits"}, Reason: "test-webhook: host ports are declared by containers app"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got decisions %+v, want %d", records, len(want))
+	}
+	for i, record := range records {
+		if !record.Time.Equal(at) || record.Webhook != "test-webhook" || record.UID != "test-uid" || record.Kind != "Pod" ||
+			record.Namespace != "default" || record.Name != "web" || record.Operation != "CREATE" {
+			t.Errorf("decision %d: got request fields %+v", i, record)
+		}
+		if record.Decision != want[i].Decision || !reflect.DeepEqual(record.Rules, want[i].Rules) || record.Reason != want[i].Reason {
+			t.Errorf("decision %d: got %s by %q with reason %q, want %s by %q with reason %q", i, record.Decision, record.Rules, record.Reason, want[i].Decision, want[i].Rules, want[i].Reason)
+		}
+	}
+}
+
+func TestOpenDecisionLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+	if err := ioutil.WriteFile(path, []byte("{}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	decisions, err := openDecisionLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := podReview(t, testPod(t, cachedPod))
+	decisions.record("test-webhook", review.Request, &admissionv1.AdmissionResponse{Allowed: true}, nil)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Decisions are appended to the file.
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != "{}" || !strings.Contains(lines[1], `"decision":"allow"`) {
+		t.Errorf("got decisions file %q, want the decision appended", data)
+	}
+
+	// A nil decisionLog discards the decisions.
+	var disabled *decisionLog
+	disabled.record("test-webhook", review.Request, &admissionv1.AdmissionResponse{Allowed: true}, nil)
+
+	if err := runWithFlags(t, "--decisions-file", filepath.Join(t.TempDir(), "missing", "decisions.jsonl")); err == nil || !strings.Contains(err.Error(), "can't open decisions file") {
+		t.Errorf("got error %v, want the decisions file rejected", err)
+	}
+}
@@ -0,0 +1,359 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/pflag"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// writeConfig writes the config to a file with the name in a temporary directory and returns its path.
+func writeConfig(t *testing.T, name, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testConfig loads the YAML config the way --config does.
+func testConfig(t *testing.T, config string) *Config {
+	t.Helper()
+	c, err := loadConfig(writeConfig(t, "config.yaml", config))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return c
+}
+
+// testPod decodes the YAML pod manifest.
+func testPod(t *testing.T, manifest string) *corev1.Pod {
+	t.Helper()
+	pod := &corev1.Pod{}
+	if err := yaml.UnmarshalStrict([]byte(manifest), pod); err != nil {
+		t.Fatalf("can't decode pod: %v", err)
+	}
+	return pod
+}
+
+// mutatePod runs computePatch and returns the result with the pod as patched by it.
+func mutatePod(t *testing.T, pod *corev1.Pod, config *Config, opts patchOptions) (*mutationResult, *corev1.Pod) {
+	t.Helper()
+	result, err := computePatch(pod, config, opts)
+	if err != nil {
+		t.Fatalf("computePatch: %v", err)
+	}
+	patched, err := patchedPod(pod, result.patch)
+	if err != nil {
+		t.Fatalf("patch doesn't apply: %v", err)
+	}
+	return result, patched
+}
+
+// testWebhook returns a webhook with the config, set up like runMutatingWebhook does with the default flags.
+func testWebhook(t *testing.T, config string) *mutatingWebhook {
+	t.Helper()
+	return &mutatingWebhook{
+		name:                 "test-webhook",
+		config:               testConfig(t, config),
+		configReloadAttempts: 1,
+		requestLogSampleRate: 1,
+	}
+}
+
+// podReview returns the review of a request creating the pod in its namespace.
+func podReview(t *testing.T, pod *corev1.Pod) *admissionv1.AdmissionReview {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: pod.Namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// deploymentReview returns the review of a request creating the Deployment in its namespace.
+func deploymentReview(t *testing.T, deployment *appsv1.Deployment) *admissionv1.AdmissionReview {
+	t.Helper()
+	deployment.APIVersion, deployment.Kind = "apps/v1", "Deployment"
+	raw, err := json.Marshal(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := podReview(t, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: deployment.Namespace}})
+	review.Request.Kind = metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	review.Request.Resource = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	review.Request.Object.Raw = raw
+	return review
+}
+
+// postReview sends the review to the handler as JSON and returns the recorded response.
+func postReview(t *testing.T, handler http.HandlerFunc, review *admissionv1.AdmissionReview) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	r.Header.Set(ContentTypeKey, ContentTypeJSON)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// admissionResponse sends the review to the handler and decodes the admission response it answers with.
+func admissionResponse(t *testing.T, handler http.HandlerFunc, review *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	t.Helper()
+	w := postReview(t, handler, review)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	response := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+		t.Fatalf("can't decode response: %v", err)
+	}
+	if response.Response == nil {
+		t.Fatalf("review without response: %s", w.Body)
+	}
+	return response.Response
+}
+
+// resetMetrics replaces the collectors with new ones, so the test counts from zero.
+func resetMetrics(t *testing.T) {
+	t.Helper()
+	newMetrics(defaultMetricsPrefix)
+}
+
+// captureLogs redirects both loggers into the returned buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	out, errOut := logger.Writer(), errorLogger.Writer()
+	logger.SetOutput(buffer)
+	errorLogger.SetOutput(buffer)
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		errorLogger.SetOutput(errOut)
+	})
+	return buffer
+}
+
+// runWithFlags runs the root command with the flags on top of a TLS key pair, up to the error it returns.
+// It is meant for rejected flags, it would serve otherwise. The flags are reset when the test ends.
+func runWithFlags(t *testing.T, args ...string) error {
+	t.Helper()
+	captureLogs(t)
+	registerer, prefix := prometheus.DefaultRegisterer, logger.Prefix()
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+	t.Cleanup(func() {
+		prometheus.DefaultRegisterer = registerer
+		logger.SetPrefix(prefix)
+		errorLogger.SetPrefix(prefix)
+		rootCmd.Flags().VisitAll(func(f *pflag.Flag) {
+			if slice, ok := f.Value.(pflag.SliceValue); ok {
+				slice.Replace(nil)
+			} else {
+				f.Value.Set(f.DefValue)
+			}
+			f.Changed = false
+		})
+	})
+	if err := rootCmd.Flags().Parse(append([]string{"--tls-cert", "tls.crt", "--tls-key", "tls.key"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return runMutatingWebhook(rootCmd, nil)
+}
+
+// testCA issues the certificates of TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for the common name, valid for 127.0.0.1, with the key usage.
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTestServer serves the webhook server built from the options on a local port until the test ends,
+// and returns its address with the CA of its certificate.
+func serveTestServer(t *testing.T, opts serverOptions, wh *mutatingWebhook) (string, *testCA) {
+	t.Helper()
+	ca := newTestCA(t)
+	server := newServer(ca.issue(t, "webhook", x509.ExtKeyUsageServerAuth, time.Now().Add(time.Hour)), opts, wh)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return listener.Addr().String(), ca
+}
+
+// testClient returns a client trusting the CA, sending the client certificates if any.
+func testClient(ca *testCA, certs ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: ca.pool, Certificates: certs},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+// patchTest is a computePatch case: the pod as patched by the rules of the config.
+type patchTest struct {
+	name   string
+	config string
+	pod    string
+	opts   patchOptions
+	// want is the patched pod, empty if the pod is left unchanged.
+	want string
+	// warnings and denials are substrings of the expected warnings and denials, in order.
+	warnings []string
+	denials  []string
+}
+
+func runPatchTests(t *testing.T, tests []patchTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(t, test.pod)
+			result, patched := mutatePod(t, pod, testConfig(t, test.config), test.opts)
+			want := pod
+			if len(test.want) > 0 {
+				want = testPod(t, test.want)
+			}
+			expectPod(t, patched, want)
+			expectMessages(t, "warnings", result.warnings, test.warnings)
+			expectMessages(t, "denials", result.denials, test.denials)
+		})
+	}
+}
+
+// expectPod compares the pods as YAML, which also shows the difference.
+func expectPod(t *testing.T, got, want *corev1.Pod) {
+	t.Helper()
+	gotYAML, err := yaml.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantYAML, err := yaml.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotYAML) != string(wantYAML) {
+		t.Errorf("got pod\n%s\nwant\n%s", gotYAML, wantYAML)
+	}
+}
+
+// expectMessages checks that every message contains the expected substring at its position.
+func expectMessages(t *testing.T, kind string, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got %s %q, want %d", kind, got, len(want))
+		return
+	}
+	for i := range want {
+		if !strings.Contains(got[i], want[i]) {
+			t.Errorf("got %s %q, want %q", kind, got[i], want[i])
+		}
+	}
+}
+
+// configErrorTest is a config loadConfig rejects, err is a substring of the error.
+type configErrorTest struct {
+	name   string
+	config string
+	err    string
+}
+
+func runConfigErrorTests(t *testing.T, tests []configErrorTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, "config.yaml", test.config))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
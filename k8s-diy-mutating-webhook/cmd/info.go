@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// version and commit are set at build time with -ldflags "-X github.com/dirien/k8s-diy-mutating-webhook/cmd.version=...".
+// Without it, the commit is taken from the VCS information Go embeds in the binary.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// startTime is when the webhook process started.
+var startTime = time.Now()
+
+// infoResponse is returned by /info.
+type infoResponse struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	StartTime time.Time `json:"startTime"`
+	Uptime    string    `json:"uptime"`
+	// ConfigHash is the SHA-256 of the active config, to tell whether instances run the same config.
+	ConfigHash string   `json:"configHash"`
+	Rules      []string `json:"rules"`
+}
+
+// buildCommit returns the commit set at build time, or the VCS revision embedded by Go.
+func buildCommit() string {
+	if len(commit) > 0 {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// configHash returns the SHA-256 of the config, as JSON with the defaults applied.
+func configHash(config *Config) (string, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// info returns the build and runtime information of the instance.
+func (wh *mutatingWebhook) info(w http.ResponseWriter, _ *http.Request) {
+	config := wh.currentConfig()
+	hash, err := configHash(config)
+	if err != nil {
+		writeErrorResponse(w, errorLogger, errors.New(fmt.Sprintf("can't hash config: %v", err)))
+		return
+	}
+	rules := make([]string, 0, len(config.Rules))
+	for _, rule := range config.Rules {
+		rules = append(rules, rule.Name)
+	}
+
+	resp, err := json.Marshal(infoResponse{
+		Version:    version,
+		Commit:     buildCommit(),
+		StartTime:  startTime,
+		Uptime:     time.Since(startTime).Round(time.Second).String(),
+		ConfigHash: hash,
+		Rules:      rules,
+	})
+	if err != nil {
+		writeErrorResponse(w, errorLogger, errors.New(fmt.Sprintf("not possible marshall response: %v", err)))
+		return
+	}
+
+	w.Header().Set(ContentTypeKey, ContentTypeJSON)
+	w.Write(resp)
+}
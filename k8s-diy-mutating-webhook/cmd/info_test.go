@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}, {name: pull, imagePullPolicy: {default: Always}}]\n")
+	w := httptest.NewRecorder()
+	wh.info(w, httptest.NewRequest(http.MethodGet, "/info", nil))
+	if w.Code != http.StatusOK || w.Header().Get(ContentTypeKey) != ContentTypeJSON {
+		t.Fatalf("got status %d and headers %v: %s", w.Code, w.Header(), w.Body)
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatalf("can't decode response: %v", err)
+	}
+	for _, field := range []string{"version", "commit", "startTime", "uptime", "configHash", "rules"} {
+		if value, ok := fields[field]; !ok || value == "" {
+			t.Errorf("got no %s in %s", field, w.Body)
+		}
+	}
+
+	info := infoResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := configHash(wh.currentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ConfigHash != hash || len(hash) != 64 {
+		t.Errorf("got config hash %q, want %q", info.ConfigHash, hash)
+	}
+	if want := []string{"limits", "pull"}; !reflect.DeepEqual(info.Rules, want) {
+		t.Errorf("got rules %v, want %v", info.Rules, want)
+	}
+}
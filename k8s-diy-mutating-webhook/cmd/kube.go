@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// informerResync is the resync period of the informers, which only refreshes the caches.
+const informerResync = 10 * time.Minute
+
+// Policies for informer caches that don't sync in time, set with --kube-api-failure-policy.
+const (
+	// KubeAPIFailOpen starts anyway, rules selecting namespaces by label don't match and LimitRanges aren't
+	// found until the caches sync.
+	KubeAPIFailOpen = "fail-open"
+	// KubeAPIFailClosed fails the start.
+	KubeAPIFailClosed = "fail-closed"
+)
+
+// newKubernetesClient returns a client from the kubeconfig file, or the in-cluster config if the path is empty.
+func newKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	var restConfig *rest.Config
+	var err error
+	if len(kubeconfig) > 0 {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// newNamespaceLister starts watching the namespaces and returns a lister once the cache is filled.
+func newNamespaceLister(client kubernetes.Interface, timeout time.Duration, policy string) (corev1listers.NamespaceLister, error) {
+	factory := informers.NewSharedInformerFactory(client, informerResync)
+	informer := factory.Core().V1().Namespaces()
+	lister := informer.Lister()
+	factory.Start(nil)
+	if err := waitForCacheSync("namespace", informer.Informer().HasSynced, timeout, policy); err != nil {
+		return nil, err
+	}
+	return lister, nil
+}
+
+// newLimitRangeLister starts watching the LimitRanges of all namespaces and returns a lister once the cache
+// is filled.
+func newLimitRangeLister(client kubernetes.Interface, timeout time.Duration, policy string) (corev1listers.LimitRangeLister, error) {
+	factory := informers.NewSharedInformerFactory(client, informerResync)
+	informer := factory.Core().V1().LimitRanges()
+	lister := informer.Lister()
+	factory.Start(nil)
+	if err := waitForCacheSync("limit range", informer.Informer().HasSynced, timeout, policy); err != nil {
+		return nil, err
+	}
+	return lister, nil
+}
+
+// waitForCacheSync waits up to timeout for an informer cache to fill. Admission only reads the caches, so a
+// slow API server can only hold up the start. If the cache isn't filled in time, fail-closed returns an error
+// and fail-open carries on, the cache keeps syncing in the background and is empty until it is done.
+func waitForCacheSync(name string, synced cache.InformerSynced, timeout time.Duration, policy string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if cache.WaitForCacheSync(ctx.Done(), synced) {
+		return nil
+	}
+	if policy == KubeAPIFailClosed {
+		return fmt.Errorf("can't sync the %s cache within %s", name, timeout)
+	}
+	errorLogger.Printf("WARNING: the %s cache didn't sync within %s, it is empty until it does", name, timeout)
+	return nil
+}
+
+// namespaceLabels returns the labels of the namespace, or nil if there is no lister or the namespace is unknown.
+func (wh *mutatingWebhook) namespaceLabels(name string) map[string]string {
+	if wh.namespaceLister == nil {
+		return nil
+	}
+	namespace, err := wh.namespaceLister.Get(name)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			errorLogger.Printf("can't get namespace %s: %v", name, err)
+		}
+		return nil
+	}
+	if namespace.Labels == nil {
+		return map[string]string{}
+	}
+	return namespace.Labels
+}
+
+// limitRangeDefaults reports whether a LimitRange of the namespace defaults container limits. Without a lister,
+// like in simulations, it reports false.
+func (wh *mutatingWebhook) limitRangeDefaults(namespace string) bool {
+	if wh.limitRangeLister == nil {
+		return false
+	}
+	limitRanges, err := wh.limitRangeLister.LimitRanges(namespace).List(labels.Everything())
+	if err != nil {
+		errorLogger.Printf("can't list limit ranges of namespace %s: %v", namespace, err)
+		return false
+	}
+	for _, limitRange := range limitRanges {
+		for _, item := range limitRange.Spec.Limits {
+			if item.Type == corev1.LimitTypeContainer && len(item.Default) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
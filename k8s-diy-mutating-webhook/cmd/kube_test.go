@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMutateSelectsNamespacesByLabel(t *testing.T) {
+	captureLogs(t)
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"environment": "dev"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod", Labels: map[string]string{"environment": "prod"}}},
+	)
+	wh := testWebhook(t, `
+rules:
+- name: debug-env
+  selector:
+    namespaceSelector: {matchLabels: {environment: dev}}
+  env:
+    variables: [{name: GOTRACEBACK, value: all}]
+`)
+	if !wh.config.needsNamespaces() {
+		t.Fatal("config with a namespace selector doesn't need namespaces")
+	}
+	lister, err := newNamespaceLister(client, time.Second, KubeAPIFailClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh.namespaceLister = lister
+
+	for _, test := range []struct {
+		namespace string
+		injected  bool
+	}{
+		{namespace: "dev", injected: true},
+		{namespace: "prod"},
+		{namespace: "unknown"},
+	} {
+		pod := testPod(t, cachedPod)
+		pod.Namespace = test.namespace
+		response := admissionResponse(t, wh.mutate, podReview(t, pod))
+		if injected := strings.Contains(string(response.Patch), "GOTRACEBACK"); injected != test.injected {
+			t.Errorf("namespace %s: got patch %s, want injected %v", test.namespace, response.Patch, test.injected)
+		}
+	}
+}
+
+func TestNamespaceListerTimeout(t *testing.T) {
+	logs := captureLogs(t)
+	for _, test := range []struct {
+		policy string
+		err    string
+	}{
+		{policy: KubeAPIFailClosed, err: "can't sync the namespace cache within 50ms"},
+		{policy: KubeAPIFailOpen},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			// The API server doesn't answer the namespace list until the test ends.
+			client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev"}})
+			unblock := make(chan struct{})
+			t.Cleanup(func() { close(unblock) })
+			client.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+				<-unblock
+				return false, nil, nil
+			})
+
+			start := time.Now()
+			lister, err := newNamespaceLister(client, 50*time.Millisecond, test.policy)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("waited %s for the cache", elapsed)
+			}
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The webhook starts with an empty cache, so the namespace has no labels yet.
+			wh := &mutatingWebhook{namespaceLister: lister}
+			if labels := wh.namespaceLabels("dev"); labels != nil {
+				t.Errorf("got labels %v from an unsynced cache", labels)
+			}
+			if !strings.Contains(logs.String(), "WARNING: the namespace cache didn't sync within 50ms") {
+				t.Errorf("got logs %q, want the sync warning", logs)
+			}
+		})
+	}
+}
+
+func TestMutateSkipsLimitsWithLimitRange(t *testing.T) {
+	captureLogs(t)
+	client := fake.NewSimpleClientset(
+		&corev1.LimitRange{
+			ObjectMeta: metav1.ObjectMeta{Name: "defaults", Namespace: "dev"},
+			Spec: corev1.LimitRangeSpec{Limits: []corev1.LimitRangeItem{{
+				Type:    corev1.LimitTypeContainer,
+				Default: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m")},
+			}}},
+		},
+		// A LimitRange without container defaults doesn't limit the containers.
+		&corev1.LimitRange{
+			ObjectMeta: metav1.ObjectMeta{Name: "max", Namespace: "staging"},
+			Spec: corev1.LimitRangeSpec{Limits: []corev1.LimitRangeItem{{
+				Type: corev1.LimitTypePod,
+				Max:  corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+			}}},
+		},
+	)
+	config := "rules: [{name: limits, limits: {cpu: 100m, skipWithLimitRange: true}}]\n"
+	wh := testWebhook(t, config)
+	if !wh.config.needsLimitRanges() {
+		t.Fatal("config skipping limits with a LimitRange doesn't need LimitRanges")
+	}
+	lister, err := newLimitRangeLister(client, time.Second, KubeAPIFailClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh.limitRangeLister = lister
+	// Without a client the LimitRanges are unknown and the limits are set.
+	withoutClient := testWebhook(t, config)
+
+	for _, test := range []struct {
+		wh        *mutatingWebhook
+		namespace string
+		patched   bool
+	}{
+		{wh: wh, namespace: "dev", patched: false},
+		{wh: wh, namespace: "staging", patched: true},
+		{wh: wh, namespace: "prod", patched: true},
+		{wh: withoutClient, namespace: "dev", patched: true},
+	} {
+		pod := testPod(t, cachedPod)
+		pod.Namespace = test.namespace
+		response := admissionResponse(t, test.wh.mutate, podReview(t, pod))
+		if patched := len(response.Patch) > 0; patched != test.patched {
+			t.Errorf("namespace %s, lister %v: got patch %s, want patched %v", test.namespace, test.wh.limitRangeLister != nil, response.Patch, test.patched)
+		}
+	}
+
+	// The LimitRange cache is only started with the webhook, so a reload can't turn the option on.
+	withoutClient.config = testConfig(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	withoutClient.configFile = writeConfig(t, "config.yaml", config)
+	if err := withoutClient.reloadConfig(); err == nil || !strings.Contains(err.Error(), "restart the webhook to start the LimitRange cache") {
+		t.Errorf("got error %v, want the reload rejected", err)
+	}
+}
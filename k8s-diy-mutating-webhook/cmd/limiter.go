@@ -0,0 +1,38 @@
+package cmd
+
+import "sync"
+
+// namespaceLimiter caps the requests processed at once per namespace, so a single namespace can't take all
+// processing slots. Namespaces are only tracked while they have requests in flight, which bounds its memory.
+type namespaceLimiter struct {
+	limit int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newNamespaceLimiter(limit int) *namespaceLimiter {
+	return &namespaceLimiter{limit: limit, inFlight: map[string]int{}}
+}
+
+// acquire takes a slot of the namespace, it reports false if the namespace is at its limit.
+func (l *namespaceLimiter) acquire(namespace string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[namespace] >= l.limit {
+		return false
+	}
+	l.inFlight[namespace]++
+	return true
+}
+
+// release returns a slot taken by acquire.
+func (l *namespaceLimiter) release(namespace string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[namespace] <= 1 {
+		delete(l.inFlight, namespace)
+		return
+	}
+	l.inFlight[namespace]--
+}
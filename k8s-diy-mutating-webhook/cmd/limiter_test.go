@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMutateLimitsNamespaces(t *testing.T) {
+	resetMetrics(t)
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	wh.namespaceLimiter = newNamespaceLimiter(1)
+	mutate := func(namespace string) (patched bool, warnings []string) {
+		pod := testPod(t, cachedPod)
+		pod.Namespace = namespace
+		response := admissionResponse(t, wh.mutate, podReview(t, pod))
+		if !response.Allowed {
+			t.Fatalf("pod of namespace %s denied: %v", namespace, response.Result)
+		}
+		return len(response.Patch) > 0, response.Warnings
+	}
+
+	// A request of team-a holds the only slot of its namespace.
+	if !wh.namespaceLimiter.acquire("team-a") {
+		t.Fatal("can't take the slot of team-a")
+	}
+	if patched, warnings := mutate("team-a"); patched || len(warnings) != 1 || !strings.Contains(warnings[0], "too many requests of namespace team-a in flight") {
+		t.Errorf("team-a at its limit: got patched %v and warnings %q, want admitted without mutation", patched, warnings)
+	}
+	if patched, warnings := mutate("team-b"); !patched || len(warnings) > 0 {
+		t.Errorf("team-b: got patched %v and warnings %q, want mutated", patched, warnings)
+	}
+	if shed := testutil.ToFloat64(shedRequests); shed != 1 {
+		t.Errorf("counted %v shed requests, want 1", shed)
+	}
+
+	wh.namespaceLimiter.release("team-a")
+	if patched, _ := mutate("team-a"); !patched {
+		t.Error("team-a after the release: got no patch")
+	}
+	if tracked := len(wh.namespaceLimiter.inFlight); tracked > 0 {
+		t.Errorf("got %d namespaces tracked without requests in flight", tracked)
+	}
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fieldSet is a FieldsV1 set under construction: nested maps keyed by f:<field> and k:<list key>, with "."
+// marking a field the manager created along with its children.
+type fieldSet map[string]interface{}
+
+func (s fieldSet) child(key string) fieldSet {
+	child, ok := s[key].(fieldSet)
+	if !ok {
+		child = fieldSet{}
+		s[key] = child
+	}
+	return child
+}
+
+// addValue marks the fields of value, as created by the manager, below s.
+func (s fieldSet) addValue(value interface{}) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	s["."] = fieldSet{}
+	for name, field := range object {
+		s.child("f:" + name).addValue(field)
+	}
+}
+
+// containerLists are the lists of the pod spec keyed by the container name.
+var containerLists = map[string]func(*corev1.PodSpec) []corev1.Container{
+	"containers":     func(spec *corev1.PodSpec) []corev1.Container { return spec.Containers },
+	"initContainers": func(spec *corev1.PodSpec) []corev1.Container { return spec.InitContainers },
+}
+
+// managedFieldsPatch returns the operation adding a managedFields entry of the manager for the fields the
+// patch sets, to the object with the existing entries. The API server tracks the fields of the request, not
+// the ones webhooks set, so without an entry nobody owns them.
+//
+// Limitations: only container lists are keyed, by name. Fields inside other lists, like tolerations or volumes,
+// are recorded as the whole list field, and removed fields aren't recorded. The API server validates the
+// entries but doesn't reconcile them with the object, and drops the managed fields of the request if it
+// can't decode them. Server-side apply semantics differ slightly between Kubernetes versions.
+func managedFieldsPatch(patch []patchOperation, pod *corev1.Pod, existing []metav1.ManagedFieldsEntry, manager, apiVersion string) (*patchOperation, error) {
+	fields := fieldSet{}
+	for _, op := range patch {
+		if op.Op != "add" && op.Op != "replace" {
+			continue
+		}
+		data, err := json.Marshal(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		addPath(fields, op.Path, value, pod)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	entry := metav1.ManagedFieldsEntry{
+		Manager:    manager,
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		APIVersion: apiVersion,
+		Time:       &metav1.Time{Time: now().UTC()},
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: raw},
+	}
+	op := appendPatch("/metadata/managedFields", len(existing) == 0, entry)
+	return &op, nil
+}
+
+// addPath marks the field at the JSONPatch path as set to value.
+func addPath(fields fieldSet, path string, value interface{}, pod *corev1.Pod) {
+	tokens := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	node := fields
+	for i, token := range tokens {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		if token != "-" && !isArrayIndex(token) {
+			node = node.child("f:" + token)
+			continue
+		}
+		if i == 0 {
+			return
+		}
+		containers, ok := containerLists[tokens[i-1]]
+		if !ok {
+			// Items of lists other than containers aren't keyed, the list field stands for them.
+			return
+		}
+		name := ""
+		if i == len(tokens)-1 {
+			if object, ok := value.(map[string]interface{}); ok {
+				name, _ = object["name"].(string)
+			}
+		} else if index, err := strconv.Atoi(token); err == nil && index < len(containers(&pod.Spec)) {
+			name = containers(&pod.Spec)[index].Name
+		}
+		if len(name) == 0 {
+			return
+		}
+		node = node.child(fmt.Sprintf(`k:{"name":%q}`, name))
+	}
+	node.addValue(value)
+}
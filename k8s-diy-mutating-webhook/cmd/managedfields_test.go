@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestManagedFieldsPatch(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := now
+	now = func() time.Time { return at }
+	t.Cleanup(func() { now = clock })
+
+	pod := testPod(t, "spec:\n  containers:\n  - name: app\n  - name: sidecar\n")
+	for _, test := range []struct {
+		name     string
+		patch    []patchOperation
+		existing []metav1.ManagedFieldsEntry
+		path     string
+		fields   string
+	}{
+		{
+			name:   "container field",
+			patch:  []patchOperation{{Op: "add", Path: "/spec/containers/1/resources", Value: map[string]interface{}{"limits": map[string]string{"cpu": "100m"}}}},
+			path:   "/metadata/managedFields",
+			fields: `{"f:spec":{"f:containers":{"k:{\"name\":\"sidecar\"}":{"f:resources":{".":{},"f:limits":{".":{},"f:cpu":{}}}}}}}`,
+		},
+		{
+			name:   "appended container",
+			patch:  []patchOperation{{Op: "add", Path: "/spec/containers/-", Value: map[string]string{"name": "proxy", "image": "envoy"}}},
+			path:   "/metadata/managedFields",
+			fields: `{"f:spec":{"f:containers":{"k:{\"name\":\"proxy\"}":{".":{},"f:image":{},"f:name":{}}}}}`,
+		},
+		{
+			name:     "list item and escaped key next to existing entries",
+			patch:    []patchOperation{{Op: "add", Path: "/spec/volumes/-", Value: map[string]string{"name": "scratch"}}, {Op: "add", Path: "/metadata/labels/app.kubernetes.io~1managed-by", Value: "diy-webhook"}, {Op: "remove", Path: "/spec/hostNetwork"}},
+			existing: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+			path:     "/metadata/managedFields/-",
+			fields:   `{"f:metadata":{"f:labels":{"f:app.kubernetes.io/managed-by":{}}},"f:spec":{"f:volumes":{}}}`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			op, err := managedFieldsPatch(test.patch, pod, test.existing, "diy-webhook", "v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if op == nil || op.Path != test.path {
+				t.Fatalf("got operation %+v, want one adding to %s", op, test.path)
+			}
+			entry, ok := op.Value.(metav1.ManagedFieldsEntry)
+			if ok && len(test.existing) == 0 {
+				t.Fatalf("got entry %+v, want it in a new list", op.Value)
+			}
+			if !ok {
+				entries, _ := op.Value.([]interface{})
+				if len(entries) != 1 {
+					t.Fatalf("got value %+v, want a list with one entry", op.Value)
+				}
+				entry = entries[0].(metav1.ManagedFieldsEntry)
+			}
+			if entry.Manager != "diy-webhook" || entry.Operation != metav1.ManagedFieldsOperationUpdate || entry.APIVersion != "v1" || !entry.Time.Time.Equal(at) || entry.FieldsType != "FieldsV1" {
+				t.Errorf("got entry %+v", entry)
+			}
+			if fields := string(entry.FieldsV1.Raw); fields != test.fields {
+				t.Errorf("got fields %s, want %s", fields, test.fields)
+			}
+		})
+	}
+
+	if op, err := managedFieldsPatch([]patchOperation{{Op: "remove", Path: "/spec/hostNetwork"}}, pod, nil, "diy-webhook", "v1"); err != nil || op != nil {
+		t.Errorf("got operation %+v and error %v for a patch without set fields", op, err)
+	}
+}
+
+func TestMutateRecordsManagedFields(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "managedFields: {enabled: true, manager: platform-webhook}\nrules: [{name: limits, limits: {cpu: 100m}}]\n")
+	response := admissionResponse(t, wh.mutate, podReview(t, testPod(t, cachedPod)))
+	var patch []struct {
+		Path  string
+		Value json.RawMessage
+	}
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) == 0 || patch[len(patch)-1].Path != "/metadata/managedFields" {
+		t.Fatalf("got patch %s, want the managed fields added last", response.Patch)
+	}
+	var entries []metav1.ManagedFieldsEntry
+	if err := json.Unmarshal(patch[len(patch)-1].Value, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Manager != "platform-webhook" {
+		t.Errorf("got managed fields %+v, want an entry of platform-webhook", entries)
+	}
+
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "long manager", config: "managedFields: {enabled: true, manager: " + strings.Repeat("m", 129) + "}\n", err: "longer than 128 characters"},
+	})
+}
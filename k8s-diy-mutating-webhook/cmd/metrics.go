@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultMetricsPrefix is the default namespace of the metric names, set with --metrics-prefix.
+const defaultMetricsPrefix = "diy_webhook"
+
+// maxTrackedNamespaces caps the memory used to count distinct namespaces.
+const maxTrackedNamespaces = 10000
+
+// otherLabelValue replaces the label values beyond a labelCap.
+const otherLabelValue = "other"
+
+var metricsPrefixPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var (
+	admissionRequests      prometheus.Counter
+	invalidPatchOperations *prometheus.CounterVec
+	ruleWarnings           *prometheus.CounterVec
+	dryRunOperations       *prometheus.CounterVec
+	ruleDenials            *prometheus.CounterVec
+	inFlightRequests       prometheus.Gauge
+	shedRequests           prometheus.Counter
+	responseCacheHits      prometheus.Counter
+	largeObjects           prometheus.Counter
+	mutatedNamespaces      prometheus.Gauge
+	ruleDuration           *prometheus.HistogramVec
+	certExpiry             prometheus.Gauge
+)
+
+func init() {
+	newMetrics(defaultMetricsPrefix)
+}
+
+// newMetrics creates the collectors with names prefixed by prefix. They are exported once registerMetrics is
+// called.
+func newMetrics(prefix string) {
+	admissionRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "admission_requests_total",
+		Help:      "Number of admission requests received, including the ones left out of the sampled request log.",
+	})
+	invalidPatchOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "invalid_patch_operations_total",
+		Help:      "Number of patch operations that failed validation before being sent in a response.",
+	}, []string{"rule"})
+	ruleWarnings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "rule_warnings_total",
+		Help:      "Number of warnings returned by rules, counted even when the rule's log lines are sampled.",
+	}, []string{"rule", "namespace"})
+	dryRunOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "dry_run_operations_total",
+		Help:      "Number of patch operations of dry-run rules that were left out of the responses.",
+	}, []string{"rule"})
+	ruleDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "rule_denials_total",
+		Help:      "Number of pods denied by rules, including the denials of dry-run rules that weren't enforced.",
+	}, []string{"rule", "namespace"})
+	inFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: prefix,
+		Name:      "in_flight_requests",
+		Help:      "Number of admission requests being processed.",
+	})
+	shedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "shed_requests_total",
+		Help:      "Number of admission requests admitted without mutation because too many were in flight, overall or in their namespace.",
+	})
+	responseCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "response_cache_hits_total",
+		Help:      "Number of admission requests answered with the cached mutation result of an identical object.",
+	})
+	largeObjects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "large_objects_total",
+		Help:      "Number of admitted objects larger than --large-object-warning-bytes.",
+	})
+	mutatedNamespaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: prefix,
+		Name:      "mutated_namespaces",
+		Help:      "Number of distinct namespaces pods were mutated in since the start, capped at 10000.",
+	})
+	ruleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prefix,
+		Name:      "rule_evaluation_duration_seconds",
+		Help:      "Time taken by rules to compute their patch operations, for the rules whose selectors matched.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5},
+	}, []string{"rule"})
+	certExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: prefix,
+		Name:      "cert_expiry_seconds",
+		Help:      "Seconds until the serving TLS certificate expires, negative once it expired.",
+	})
+}
+
+// registerMetrics recreates the collectors with the metrics prefix and registers them for export.
+func registerMetrics(prefix string) error {
+	if !metricsPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("invalid metrics prefix %q, expected letters, digits and underscores", prefix)
+	}
+	newMetrics(prefix)
+	prometheus.MustRegister(admissionRequests, invalidPatchOperations, ruleWarnings, dryRunOperations, ruleDenials, inFlightRequests, shedRequests, responseCacheHits, largeObjects, mutatedNamespaces, ruleDuration, certExpiry)
+	return nil
+}
+
+// namespaceSet tracks distinct namespaces for the mutated_namespaces gauge. It exposes the set size instead
+// of a label per namespace, so the metric cardinality stays constant.
+type namespaceSet struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func (s *namespaceSet) add(namespace string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = map[string]struct{}{}
+	}
+	if _, ok := s.seen[namespace]; ok || len(s.seen) >= maxTrackedNamespaces {
+		return
+	}
+	s.seen[namespace] = struct{}{}
+	mutatedNamespaces.Set(float64(len(s.seen)))
+}
+
+// labelCap bounds the distinct values of a metric label. The first max values are kept, later ones are
+// reported as other, so a growing number of namespaces can't blow up the series count.
+type labelCap struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newLabelCap(max int) *labelCap {
+	return &labelCap{max: max, seen: map[string]struct{}{}}
+}
+
+// value returns the label value to export for v.
+func (c *labelCap) value(v string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[v]; ok {
+		return v
+	}
+	if len(c.seen) >= c.max {
+		return otherLabelValue
+	}
+	c.seen[v] = struct{}{}
+	return v
+}
+
+// runMetricsServer serves the Prometheus metrics, the instance info, and the debug endpoints if enabled, over
+// plain HTTP on the given port. With tracing, the metrics are also offered in the OpenMetrics format, the
+// only one that carries the trace ID exemplars.
+func runMetricsServer(port int, wh *mutatingWebhook) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: wh.tracing,
+	})))
+	mux.HandleFunc("/info", wh.info)
+	if wh.debug {
+		mux.Handle("/debug/patch", gzipHandler(http.HandlerFunc(wh.debugPatch)))
+	}
+	server := http.Server{
+		Addr:     fmt.Sprintf(":%d", port),
+		Handler:  mux,
+		ErrorLog: errorLogger,
+	}
+
+	if err := server.ListenAndServe(); err != nil {
+		errorLogger.Printf("metrics server stopped: %v", err)
+	}
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.writer.Write(b)
+}
+
+// acceptsGzip reports whether the Accept-Encoding header lists gzip without a q value of 0, which refuses it.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if q, err := strconv.ParseFloat(value, 64); strings.EqualFold(name, "q") && err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipHandler compresses the responses of h for clients that accept gzip. The metrics handler compresses
+// on its own, so this is only used for the debug endpoints.
+func gzipHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		defer writer.Close()
+		h.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, writer: writer}, r)
+	})
+}
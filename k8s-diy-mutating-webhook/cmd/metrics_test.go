@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestGzipHandler(t *testing.T) {
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	handler := gzipHandler(http.HandlerFunc(wh.debugPatch))
+	for _, test := range []struct {
+		acceptEncoding string
+		gzip           bool
+	}{
+		{acceptEncoding: ""},
+		{acceptEncoding: "gzip, deflate", gzip: true},
+		{acceptEncoding: "deflate, GZIP;q=0.5", gzip: true},
+		{acceptEncoding: "gzip;q=0, deflate"},
+		{acceptEncoding: "deflate, gzip; q=0.0"},
+	} {
+		acceptEncoding := test.acceptEncoding
+		r := httptest.NewRequest(http.MethodPost, "/debug/patch", strings.NewReader(cachedPod))
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		body := w.Body.Bytes()
+		if !test.gzip {
+			if encoding := w.Header().Get("Content-Encoding"); len(encoding) > 0 {
+				t.Errorf("got Content-Encoding %q with Accept-Encoding %q", encoding, acceptEncoding)
+			}
+		} else {
+			if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+				t.Fatalf("got Content-Encoding %q, want gzip", encoding)
+			}
+			reader, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = ioutil.ReadAll(reader); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" || !strings.Contains(string(body), `"patch"`) {
+			t.Errorf("Accept-Encoding %q: got headers %v and body %s", acceptEncoding, w.Header(), body)
+		}
+	}
+}
+
+func TestMutateDoesNotCompress(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	body, err := json.Marshal(podReview(t, testPod(t, cachedPod)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	r.Header.Set(ContentTypeKey, ContentTypeJSON)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	wh.mutate(w, r)
+	if encoding := w.Header().Get("Content-Encoding"); w.Code != http.StatusOK || len(encoding) > 0 {
+		t.Errorf("got status %d and Content-Encoding %q, want an uncompressed admission response", w.Code, encoding)
+	}
+}
+
+func TestMutatedNamespaces(t *testing.T) {
+	resetMetrics(t)
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	for _, namespace := range []string{"team-a", "team-b", "team-a"} {
+		pod := testPod(t, cachedPod)
+		pod.Namespace = namespace
+		admissionResponse(t, wh.mutate, podReview(t, pod))
+	}
+	// Pods left unchanged don't count their namespace.
+	unchanged := testPod(t, cachedPod)
+	unchanged.Namespace = "team-c"
+	unchanged.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+	admissionResponse(t, wh.mutate, podReview(t, unchanged))
+
+	if count := testutil.ToFloat64(mutatedNamespaces); count != 2 {
+		t.Errorf("got %v mutated namespaces, want 2", count)
+	}
+
+	var namespaces namespaceSet
+	for i := 0; i < maxTrackedNamespaces+10; i++ {
+		namespaces.add(fmt.Sprintf("namespace-%d", i))
+	}
+	if count := testutil.ToFloat64(mutatedNamespaces); count != maxTrackedNamespaces {
+		t.Errorf("got %v mutated namespaces, want the cap of %d", count, maxTrackedNamespaces)
+	}
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	resetMetrics(t)
+	t.Cleanup(func() { newMetrics(defaultMetricsPrefix) })
+	// The prefix is registered before the rejected flag fails the run.
+	if err := runWithFlags(t, "--metrics-prefix", "acme_admission", "--max-in-flight", "-1"); err == nil {
+		t.Fatal("got no error for --max-in-flight -1")
+	}
+	ruleWarnings.WithLabelValues("limits", "default").Inc()
+	families, err := prometheus.DefaultRegisterer.(prometheus.Gatherer).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+		if !strings.HasPrefix(family.GetName(), "acme_admission_") {
+			t.Errorf("got metric %s without the prefix", family.GetName())
+		}
+	}
+	for _, name := range []string{"acme_admission_admission_requests_total", "acme_admission_in_flight_requests", "acme_admission_rule_warnings_total"} {
+		if !names[name] {
+			t.Errorf("got metrics %v, want %s", names, name)
+		}
+	}
+
+	if err := runWithFlags(t, "--metrics-prefix", "acme-admission"); err == nil || !strings.Contains(err.Error(), `invalid metrics prefix "acme-admission"`) {
+		t.Errorf("got error %v, want the prefix rejected", err)
+	}
+}
+
+func TestRuleDuration(t *testing.T) {
+	resetMetrics(t)
+	captureLogs(t)
+	config := testConfig(t, `
+rules:
+- name: limits
+  limits: {cpu: 100m}
+- name: api-working-dir
+  selector:
+    podSelector: {matchLabels: {app: api}}
+  workingDir: {path: /app}
+`)
+	for i := 0; i < 3; i++ {
+		mutatePod(t, testPod(t, cachedPod), config, patchOptions{})
+	}
+	// Like the debug endpoint and simulations.
+	mutatePod(t, testPod(t, cachedPod), config, patchOptions{skipMetrics: true})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(ruleDuration)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]uint64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "rule" {
+					counts[label.GetValue()] = metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	// Rules whose selectors don't match aren't evaluated, runs skipping the metrics aren't observed.
+	if len(counts) != 1 || counts["limits"] != 3 {
+		t.Errorf("got evaluation counts %v, want 3 for limits only", counts)
+	}
+}
+
+func TestRuleMetricNamespaces(t *testing.T) {
+	resetMetrics(t)
+	captureLogs(t)
+	config := testConfig(t, "rules: [{name: service-account, metricNamespaces: 2, defaultServiceAccountWarning: {}}]\n")
+	for _, namespace := range []string{"team-a", "team-b", "team-c", "team-a", "team-d"} {
+		pod := testPod(t, cachedPod)
+		pod.Namespace = namespace
+		mutatePod(t, pod, config, patchOptions{})
+	}
+	// team-c and team-d are beyond the cap of 2 and counted as other.
+	if series := testutil.CollectAndCount(ruleWarnings); series != 3 {
+		t.Errorf("got %d warning series, want 3", series)
+	}
+	for namespace, want := range map[string]float64{"team-a": 2, "team-b": 1, otherLabelValue: 2} {
+		if got := testutil.ToFloat64(ruleWarnings.WithLabelValues("service-account", namespace)); got != want {
+			t.Errorf("namespace %s: got %v warnings, want %v", namespace, got, want)
+		}
+	}
+
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "negative cap", config: "rules: [{name: limits, metricNamespaces: -1, limits: {cpu: 100m}}]\n", err: "invalid metricNamespaces -1"},
+	})
+}
@@ -1,21 +1,35 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
 	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var rootCmd = &cobra.Command{
@@ -23,16 +37,57 @@ var rootCmd = &cobra.Command{
 	Short: "Kubernetes DIY mutating webhook",
 	Long: `Kubernetes DIY mutating webhook.
 Example:
-mutating-webhook --port <port> --tls-cert <tls_cert> --tls-key <tls_key>`,
+mutating-webhook --port <port> --tls-cert <tls_cert> --tls-key <tls_key> [--config <config>]
+
+The config file is reloaded on SIGHUP.`,
 	RunE: runMutatingWebhook,
 }
 
-var logger = log.New(os.Stdout, "", log.LstdFlags)
+// logger logs informational lines, errorLogger warnings and errors. Both write to stdout unless the
+// errors are split off to stderr with --log-errors-to-stderr.
+var (
+	logger      = log.New(os.Stdout, "", log.LstdFlags)
+	errorLogger = log.New(os.Stdout, "", log.LstdFlags)
+)
 
 func init() {
 	rootCmd.Flags().String("tls-cert", "", "TLS Certificate")
 	rootCmd.Flags().String("tls-key", "", "Key for TLS Certificate")
+	rootCmd.Flags().Duration("cert-expiry-warning", 30*24*time.Hour, "Warn when the TLS certificate expires within this duration, checked at the start and hourly. 0 disables the warning")
 	rootCmd.Flags().Int("port", 8443, "Port to listen on")
+	rootCmd.Flags().Int("metrics-port", 8080, "Port to serve metrics on, 0 disables the metrics listener")
+	rootCmd.Flags().String("metrics-prefix", defaultMetricsPrefix, "Prefix of the exported metric names")
+	rootCmd.Flags().String("client-ca", "", "CA bundle to verify client certificates against, requires clients to present one")
+	rootCmd.Flags().StringSlice("allowed-client-cns", nil, "Common names of the client certificates allowed to connect, like the API server identity. Requires --client-ca")
+	rootCmd.Flags().Bool("tls-session-tickets", true, "Enable TLS session tickets for session resumption")
+	rootCmd.Flags().Bool("disable-http2", false, "Serve HTTP/1.1 only, works around HTTP/2 connection issues between some API servers and webhooks")
+	rootCmd.Flags().Int("max-header-bytes", 64<<10, "Maximum size of the request headers in bytes")
+	rootCmd.Flags().Int("large-object-warning-bytes", 1<<20, "Warn about objects larger than this many bytes, which get close to the etcd object size limit. 0 disables the warning")
+	rootCmd.Flags().Int("max-in-flight", 0, "Maximum number of requests processed at once, more are admitted without mutation. 0 is unlimited")
+	rootCmd.Flags().Int("max-in-flight-per-namespace", 0, "Maximum number of requests of a namespace processed at once, more are admitted without mutation. 0 is unlimited")
+	rootCmd.Flags().Int("response-cache-size", 0, "Number of mutation results of identical objects to reuse, 0 disables the cache. Not used with the timestamp annotation")
+	rootCmd.Flags().Duration("response-cache-ttl", 10*time.Second, "How long a cached mutation result is reused")
+	rootCmd.Flags().Bool("keep-alives", true, "Enable HTTP keep-alives, disabling closes every connection after its request")
+	rootCmd.Flags().Duration("tcp-keep-alive-period", 0, "Period of the TCP keep-alive probes, 0 uses the Go default and a negative value disables them")
+	rootCmd.Flags().Bool("enable-tracing", false, "Continue the OpenTelemetry traces propagated by the API server, log their trace IDs and add them as exemplars to the OpenMetrics latency histograms")
+	rootCmd.Flags().Bool("enable-debug", false, "Serve the /debug endpoints on the metrics listener, don't use in production")
+	rootCmd.Flags().String("config", "", "Path to the mutation config file, the config embedded in the binary is used if not set")
+	rootCmd.Flags().Int("config-reload-attempts", 3, "How often to read a config file that can't be read on reload before keeping the current config, with backoff in between")
+	rootCmd.Flags().String("kubeconfig", "", "Path to a kubeconfig, used to look up namespaces and LimitRanges when the config needs them. Defaults to the in-cluster config")
+	rootCmd.Flags().Duration("kube-api-timeout", 30*time.Second, "How long to wait for the namespace cache to sync at the start")
+	rootCmd.Flags().String("kube-api-failure-policy", KubeAPIFailClosed, "What to do when the namespace cache doesn't sync in time: fail-closed fails the start, fail-open starts and doesn't match namespace selectors until it syncs")
+	rootCmd.Flags().Int("request-log-sample-rate", 1, "Log only 1 in N admission requests, warnings and errors are always logged")
+	rootCmd.Flags().String("decisions-file", "", "File to append a JSON line per admission decision to, - writes them to stdout. Empty disables the decisions stream")
+	rootCmd.Flags().Bool("log-errors-to-stderr", false, "Write warnings and errors to stderr and only the informational lines to stdout")
+	rootCmd.Flags().String("webhook-name", filepath.Base(os.Args[0]), "Name included in warnings, audit annotations and logs")
+
+	// Failure injection for testing the API server's failure handling, never enable it in production.
+	rootCmd.Flags().Float64("chaos-error-rate", 0, "Fraction of requests failed on purpose, between 0 and 1")
+	rootCmd.Flags().Duration("chaos-delay", 0, "Delay added to the requests selected by --chaos-delay-rate")
+	rootCmd.Flags().Float64("chaos-delay-rate", 1, "Fraction of requests delayed by --chaos-delay, between 0 and 1")
+	for _, name := range []string{"chaos-error-rate", "chaos-delay", "chaos-delay-rate"} {
+		cobra.CheckErr(rootCmd.Flags().MarkHidden(name))
+	}
 }
 
 func runMutatingWebhook(cmd *cobra.Command, _ []string) error {
@@ -54,135 +109,790 @@ func runMutatingWebhook(cmd *cobra.Command, _ []string) error {
 	if err != nil {
 		return err
 	}
-	err = runMutatingWebhookServer(tlsCert, tlsKey, port)
+	configFile, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	webhookName, err := cmd.Flags().GetString("webhook-name")
+	if err != nil {
+		return err
+	}
+	logger.SetPrefix(fmt.Sprintf("[%s] ", webhookName))
+	errorLogger.SetPrefix(logger.Prefix())
+	logErrorsToStderr, err := cmd.Flags().GetBool("log-errors-to-stderr")
+	if err != nil {
+		return err
+	}
+	if logErrorsToStderr {
+		errorLogger.SetOutput(os.Stderr)
+	}
+	metricsPort, err := cmd.Flags().GetInt("metrics-port")
+	if err != nil {
+		return err
+	}
+	metricsPrefix, err := cmd.Flags().GetString("metrics-prefix")
+	if err != nil {
+		return err
+	}
+	if err := registerMetrics(metricsPrefix); err != nil {
+		return err
+	}
+	certExpiryWarning, err := cmd.Flags().GetDuration("cert-expiry-warning")
+	if err != nil {
+		return err
+	}
+	if certExpiryWarning < 0 {
+		return errors.New("please provide a cert expiry warning of at least 0")
+	}
+	clientCA, err := cmd.Flags().GetString("client-ca")
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if len(clientCA) > 0 {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return fmt.Errorf("can't read client CA: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("please provide a client CA with at least one PEM certificate")
+		}
+	}
+	allowedClientCNs, err := cmd.Flags().GetStringSlice("allowed-client-cns")
+	if err != nil {
+		return err
+	}
+	if len(allowedClientCNs) > 0 && clientCAs == nil {
+		return errors.New("please provide a client CA to verify the allowed client CNs against")
+	}
+	sessionTickets, err := cmd.Flags().GetBool("tls-session-tickets")
+	if err != nil {
+		return err
+	}
+	disableHTTP2, err := cmd.Flags().GetBool("disable-http2")
+	if err != nil {
+		return err
+	}
+	maxHeaderBytes, err := cmd.Flags().GetInt("max-header-bytes")
+	if err != nil {
+		return err
+	}
+	if maxHeaderBytes <= 0 {
+		return errors.New("please provide a positive maximum header size")
+	}
+	keepAlives, err := cmd.Flags().GetBool("keep-alives")
+	if err != nil {
+		return err
+	}
+	tcpKeepAlivePeriod, err := cmd.Flags().GetDuration("tcp-keep-alive-period")
+	if err != nil {
+		return err
+	}
+	enableDebug, err := cmd.Flags().GetBool("enable-debug")
+	if err != nil {
+		return err
+	}
+	enableTracing, err := cmd.Flags().GetBool("enable-tracing")
+	if err != nil {
+		return err
+	}
+	if enableTracing {
+		setupTracing()
+	}
+	maxInFlight, err := cmd.Flags().GetInt("max-in-flight")
+	if err != nil {
+		return err
+	}
+	if maxInFlight < 0 {
+		return errors.New("please provide a non-negative maximum of in-flight requests")
+	}
+	maxInFlightPerNamespace, err := cmd.Flags().GetInt("max-in-flight-per-namespace")
+	if err != nil {
+		return err
+	}
+	if maxInFlightPerNamespace < 0 {
+		return errors.New("please provide a non-negative maximum of in-flight requests per namespace")
+	}
+	largeObjectWarningBytes, err := cmd.Flags().GetInt("large-object-warning-bytes")
+	if err != nil {
+		return err
+	}
+	if largeObjectWarningBytes < 0 {
+		return errors.New("please provide a non-negative large object warning size")
+	}
+	responseCacheSize, err := cmd.Flags().GetInt("response-cache-size")
+	if err != nil {
+		return err
+	}
+	if responseCacheSize < 0 {
+		return errors.New("please provide a non-negative response cache size")
+	}
+	responseCacheTTL, err := cmd.Flags().GetDuration("response-cache-ttl")
+	if err != nil {
+		return err
+	}
+	if responseCacheTTL <= 0 {
+		return errors.New("please provide a positive response cache ttl")
+	}
+	requestLogSampleRate, err := cmd.Flags().GetInt("request-log-sample-rate")
+	if err != nil {
+		return err
+	}
+	if requestLogSampleRate < 1 {
+		return errors.New("please provide a request log sample rate of at least 1")
+	}
+	configReloadAttempts, err := cmd.Flags().GetInt("config-reload-attempts")
+	if err != nil {
+		return err
+	}
+	if configReloadAttempts < 1 {
+		return errors.New("please provide a config reload attempts count of at least 1")
+	}
+	chaos, err := chaosFlags(cmd)
+	if err != nil {
+		return err
+	}
+	if chaos.errorRate > 0 {
+		errorLogger.Printf("WARNING: failure injection is enabled, failing %.0f%% of requests", chaos.errorRate*100)
+	}
+	if chaos.delay > 0 && chaos.delayRate > 0 {
+		errorLogger.Printf("WARNING: failure injection is enabled, delaying %.0f%% of requests by %s", chaos.delayRate*100, chaos.delay)
+	}
+	wh := &mutatingWebhook{
+		name:                 webhookName,
+		configFile:           configFile,
+		configReloadAttempts: configReloadAttempts,
+		config:               config,
+		debug:                enableDebug,
+		tracing:              enableTracing,
+		maxInFlight:          int64(maxInFlight),
+		requestLogSampleRate: int64(requestLogSampleRate),
+		largeObjectBytes:     largeObjectWarningBytes,
+	}
+	if responseCacheSize > 0 {
+		if config.Timestamp.Enabled {
+			errorLogger.Print("WARNING: the response cache is disabled, cached patches would carry stale timestamp annotations")
+		} else {
+			wh.responseCache = newResponseCache(responseCacheSize, responseCacheTTL)
+		}
+	}
+	if maxInFlightPerNamespace > 0 {
+		wh.namespaceLimiter = newNamespaceLimiter(maxInFlightPerNamespace)
+	}
+	decisionsFile, err := cmd.Flags().GetString("decisions-file")
+	if err != nil {
+		return err
+	}
+	if len(decisionsFile) > 0 {
+		if wh.decisions, err = openDecisionLog(decisionsFile); err != nil {
+			return fmt.Errorf("can't open decisions file: %v", err)
+		}
+	}
+	if config.needsNamespaces() || config.needsLimitRanges() {
+		kubeconfig, err := cmd.Flags().GetString("kubeconfig")
+		if err != nil {
+			return err
+		}
+		kubeAPITimeout, err := cmd.Flags().GetDuration("kube-api-timeout")
+		if err != nil {
+			return err
+		}
+		if kubeAPITimeout <= 0 {
+			return errors.New("please provide a kube API timeout greater than 0")
+		}
+		kubeAPIFailurePolicy, err := cmd.Flags().GetString("kube-api-failure-policy")
+		if err != nil {
+			return err
+		}
+		if kubeAPIFailurePolicy != KubeAPIFailOpen && kubeAPIFailurePolicy != KubeAPIFailClosed {
+			return fmt.Errorf("please provide a kube API failure policy of %s or %s", KubeAPIFailOpen, KubeAPIFailClosed)
+		}
+		client, err := newKubernetesClient(kubeconfig)
+		if err != nil {
+			return fmt.Errorf("can't create kubernetes client: %v", err)
+		}
+		if config.needsNamespaces() {
+			if wh.namespaceLister, err = newNamespaceLister(client, kubeAPITimeout, kubeAPIFailurePolicy); err != nil {
+				return err
+			}
+		}
+		if config.needsLimitRanges() {
+			if wh.limitRangeLister, err = newLimitRangeLister(client, kubeAPITimeout, kubeAPIFailurePolicy); err != nil {
+				return err
+			}
+		}
+	}
+	opts := serverOptions{
+		port:              port,
+		metricsPort:       metricsPort,
+		sessionTickets:    sessionTickets,
+		certExpiryWarning: certExpiryWarning,
+		clientCAs:         clientCAs,
+		allowedClientCNs:  allowedClientCNs,
+		disableHTTP2:      disableHTTP2,
+		maxHeaderBytes:    maxHeaderBytes,
+		keepAlives:        keepAlives,
+		tcpKeepAlive:      tcpKeepAlivePeriod,
+		chaos:             chaos,
+	}
+	go wh.reloadOnSignal()
+	err = runMutatingWebhookServer(tlsCert, tlsKey, opts, wh)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// chaosFlags reads the failure injection flags.
+func chaosFlags(cmd *cobra.Command) (chaosOptions, error) {
+	opts := chaosOptions{}
+	var err error
+	if opts.errorRate, err = cmd.Flags().GetFloat64("chaos-error-rate"); err != nil {
+		return opts, err
+	}
+	if opts.delay, err = cmd.Flags().GetDuration("chaos-delay"); err != nil {
+		return opts, err
+	}
+	if opts.delayRate, err = cmd.Flags().GetFloat64("chaos-delay-rate"); err != nil {
+		return opts, err
+	}
+	if opts.errorRate < 0 || opts.errorRate > 1 || opts.delayRate < 0 || opts.delayRate > 1 {
+		return opts, errors.New("please provide chaos rates between 0 and 1")
+	}
+	if opts.delay < 0 {
+		return opts, errors.New("please provide a non-negative chaos delay")
+	}
+	return opts, nil
+}
+
 func Execute() {
 	cobra.CheckErr(rootCmd.Execute())
 }
 
 const (
-	ContentTypeJSON = "application/json"
-	ContentTypeKey  = "Content-Type"
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/vnd.kubernetes.protobuf"
+	ContentTypeKey      = "Content-Type"
 )
 
-func admissionReviewFromRequest(r *http.Request, deserializer runtime.Decoder) (*admissionv1.AdmissionReview, error) {
-	if r.Header.Get(ContentTypeKey) != ContentTypeJSON {
-		return nil, fmt.Errorf("contentType=%s, expected %s", r.Header.Get(ContentTypeKey), ContentTypeJSON)
+// codecs decodes admission reviews and the objects they carry, and encodes the responses.
+// https://godoc.org/k8s.io/apimachinery/pkg/runtime/serializer#CodecFactory
+var codecs = serializer.NewCodecFactory(newScheme())
+
+// newScheme returns the scheme of the types the webhook decodes, protobuf needs them to be registered.
+// https://godoc.org/k8s.io/apimachinery/pkg/runtime#Scheme
+func newScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(admissionv1.AddToScheme(scheme))
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	utilruntime.Must(appsv1.AddToScheme(scheme))
+	return scheme
+}
+
+// maxPooledBufferSize keeps unusually large request buffers from being held by the pool.
+const maxPooledBufferSize = 1 << 20
+
+// bodyBufferPool holds the buffers request bodies are read into. The decoded review copies what it keeps,
+// so a buffer can be reused as soon as decoding returns.
+var bodyBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func putBodyBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
 	}
+	bodyBufferPool.Put(buffer)
+}
+
+// admissionReviewFromRequest decodes the review in the request body, which is either JSON or protobuf.
+// It also returns the media type of the body, so the response can be encoded the same way.
+func admissionReviewFromRequest(r *http.Request, deserializer runtime.Decoder) (*admissionv1.AdmissionReview, string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get(ContentTypeKey))
+	if err != nil || (mediaType != ContentTypeJSON && mediaType != ContentTypeProtobuf) {
+		return nil, "", fmt.Errorf("contentType=%s, expected %s or %s", r.Header.Get(ContentTypeKey), ContentTypeJSON, ContentTypeProtobuf)
+	}
+
+	buffer := bodyBufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer putBodyBuffer(buffer)
 
 	var body []byte
 	if r.Body != nil {
-		requestData, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil, err
+		if _, err := buffer.ReadFrom(r.Body); err != nil {
+			return nil, "", err
+		}
+		body = buffer.Bytes()
+	}
+	if len(body) == 0 {
+		return nil, "", errors.New("empty request body")
+	}
+
+	// Check the version first, a review of another version would otherwise fail with a generic decode error
+	if mediaType == ContentTypeJSON {
+		typeMeta := metav1.TypeMeta{}
+		if err := json.Unmarshal(body, &typeMeta); err != nil {
+			return nil, "", err
+		}
+		if _, err := responseGVK(typeMeta.APIVersion); err != nil {
+			return nil, "", err
 		}
-		body = requestData
 	}
 
 	// Decode the request body into
 	admissionReviewRequest := &admissionv1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, admissionReviewRequest); err != nil {
-		return nil, err
+	_, gvk, err := deserializer.Decode(body, nil, admissionReviewRequest)
+	if err != nil {
+		return nil, "", err
 	}
+	if gvk.GroupVersion() != admissionv1.SchemeGroupVersion {
+		return nil, "", fmt.Errorf("unsupported admission version %q, expected %s", gvk.GroupVersion(), admissionv1.SchemeGroupVersion)
+	}
+
+	return admissionReviewRequest, mediaType, nil
+}
+
+// maxAdmissionVersions bounds the apiVersions cached by responseGVK, they come from the requests. A full cache
+// is cleared, so requests with made-up versions can't keep the real ones out.
+const maxAdmissionVersions = 16
 
-	return admissionReviewRequest, nil
+// admissionVersion is an apiVersion of admission reviews resolved to the GVK of the response, or to the error
+// returned for reviews of an unsupported version.
+type admissionVersion struct {
+	gvk schema.GroupVersionKind
+	err error
 }
 
-func writeErrorResponse(w http.ResponseWriter, err error) {
-	logger.Printf(err.Error())
+// admissionVersions caches the resolved apiVersions, the requests only ever carry a few.
+var admissionVersions = struct {
+	sync.RWMutex
+	resolved map[string]admissionVersion
+}{resolved: map[string]admissionVersion{}}
+
+// responseGVK returns the GVK of the review answering a review of apiVersion, or an error if the webhook
+// doesn't support the version.
+func responseGVK(apiVersion string) (schema.GroupVersionKind, error) {
+	admissionVersions.RLock()
+	version, ok := admissionVersions.resolved[apiVersion]
+	admissionVersions.RUnlock()
+	if ok {
+		return version.gvk, version.err
+	}
+	version = resolveAdmissionVersion(apiVersion)
+	admissionVersions.Lock()
+	if len(admissionVersions.resolved) >= maxAdmissionVersions {
+		admissionVersions.resolved = map[string]admissionVersion{}
+	}
+	admissionVersions.resolved[apiVersion] = version
+	admissionVersions.Unlock()
+	return version.gvk, version.err
+}
+
+func resolveAdmissionVersion(apiVersion string) admissionVersion {
+	groupVersion, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil || groupVersion != admissionv1.SchemeGroupVersion {
+		return admissionVersion{err: fmt.Errorf("unsupported admission version %q, expected %s", apiVersion, admissionv1.SchemeGroupVersion)}
+	}
+	return admissionVersion{gvk: groupVersion.WithKind("AdmissionReview")}
+}
+
+// writeErrorResponse logs the error to l and answers with it as a bad request.
+func writeErrorResponse(w http.ResponseWriter, l *log.Logger, err error) {
+	l.Print(err.Error())
 	w.WriteHeader(http.StatusBadRequest)
 	w.Write([]byte(err.Error()))
 }
 
-func mutate(w http.ResponseWriter, r *http.Request) {
-	log.Printf("mutate request")
+type mutatingWebhook struct {
+	// name identifies this webhook in warnings, audit annotations and logs.
+	name string
+	// configFile is the config file, reloaded on SIGHUP. config is the config in use, see currentConfig.
+	configFile string
+	configMu   sync.RWMutex
+	config     *Config
+	// configReloadAttempts is how often a config file that can't be read is read on reload.
+	configReloadAttempts int
+	// disabledLogged is set once the kill switch of the config in use was logged.
+	disabledLogged int32
+	// debug enables the /debug endpoints.
+	debug bool
+	// tracing starts a span for every admission request.
+	tracing bool
+	// namespaces tracks the namespaces pods were mutated in.
+	namespaces namespaceSet
+	// namespaceLister looks up namespaces for namespace selectors, nil if no rule needs it.
+	namespaceLister corev1listers.NamespaceLister
+	// limitRangeLister looks up the LimitRanges of namespaces, nil if no rule needs it.
+	limitRangeLister corev1listers.LimitRangeLister
+	// maxInFlight is the number of requests processed at once before shedding load, 0 is unlimited.
+	maxInFlight int64
+	inFlight    int64
+	// namespaceLimiter caps the in-flight requests per namespace, nil if unlimited.
+	namespaceLimiter *namespaceLimiter
+	// responseCache reuses the mutation results of identical objects, nil if disabled.
+	responseCache *responseCache
+	// largeObjectBytes is the object size warned about, 0 disables the warning.
+	largeObjectBytes int
+	// decisions records every admission decision, nil if disabled.
+	decisions *decisionLog
+	// requestLogSampleRate logs 1 in N requests, requests counts them.
+	requestLogSampleRate int64
+	requests             int64
+}
 
-	// https://godoc.org/k8s.io/apimachinery/pkg/runtime#Scheme
-	scheme := runtime.NewScheme()
+// warning prefixes the message with the webhook name, so users can tell which webhook it came from.
+func (wh *mutatingWebhook) warning(message string) string {
+	return fmt.Sprintf("%s: %s", wh.name, message)
+}
 
-	// https://godoc.org/k8s.io/apimachinery/pkg/runtime/serializer#CodecFactory
-	codecFactory := serializer.NewCodecFactory(scheme)
-	deserializer := codecFactory.UniversalDeserializer()
+func (wh *mutatingWebhook) mutate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if wh.tracing {
+		var span trace.Span
+		ctx, span = startSpan(r, "mutate")
+		defer span.End()
+	}
+	requestLog, requestErrorLog := requestLogger(ctx, logger), requestLogger(ctx, errorLogger)
+	admissionRequests.Inc()
+	n := atomic.AddInt64(&wh.requests, 1)
+	// The per-request lines are sampled together, a sampled request is logged completely.
+	sampled := wh.requestLogSampleRate <= 1 || n%wh.requestLogSampleRate == 1
+	if sampled {
+		requestLog.Printf("mutate request")
+	}
+	inFlight := atomic.AddInt64(&wh.inFlight, 1)
+	inFlightRequests.Inc()
+	defer func() {
+		atomic.AddInt64(&wh.inFlight, -1)
+		inFlightRequests.Dec()
+	}()
 
-	admissionReviewRequest, err := admissionReviewFromRequest(r, deserializer)
+	deserializer := codecs.UniversalDeserializer()
+
+	admissionReviewRequest, mediaType, err := admissionReviewFromRequest(r, deserializer)
 	if err != nil {
-		writeErrorResponse(w, errors.New(fmt.Sprintf("can't retrieve admission review from request: %v", err)))
+		writeErrorResponse(w, requestErrorLog, errors.New(fmt.Sprintf("can't retrieve admission review from request: %v", err)))
+		return
+	}
+
+	config := wh.currentConfig()
+	if config.disabled() {
+		if atomic.CompareAndSwapInt32(&wh.disabledLogged, 0, 1) {
+			requestErrorLog.Print("WARNING: the webhook is disabled by the config, admitting everything unchanged")
+		}
+		wh.writeAdmissionResponse(w, requestErrorLog, mediaType, admissionReviewRequest, &admissionv1.AdmissionResponse{Allowed: true})
 		return
 	}
 
+	// Fail open when overloaded, queueing would hold up the API server until its webhook timeout
+	if wh.maxInFlight > 0 && inFlight > wh.maxInFlight {
+		shedRequests.Inc()
+		requestErrorLog.Printf("%d requests in flight, admitting without mutation", inFlight)
+		wh.writeAdmissionResponse(w, requestErrorLog, mediaType, admissionReviewRequest, &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{wh.warning("webhook overloaded, admitted without mutation")},
+		})
+		return
+	}
+	if wh.namespaceLimiter != nil {
+		namespace := admissionReviewRequest.Request.Namespace
+		if !wh.namespaceLimiter.acquire(namespace) {
+			shedRequests.Inc()
+			requestErrorLog.Printf("too many requests of namespace %s in flight, admitting without mutation", namespace)
+			wh.writeAdmissionResponse(w, requestErrorLog, mediaType, admissionReviewRequest, &admissionv1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: []string{wh.warning(fmt.Sprintf("too many requests of namespace %s in flight, admitted without mutation", namespace))},
+			})
+			return
+		}
+		defer wh.namespaceLimiter.release(namespace)
+	}
+
 	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if admissionReviewRequest.Request.Resource != podResource {
-		writeErrorResponse(w, errors.New(fmt.Sprintf("review request is not from kind pod, got %s", admissionReviewRequest.Request.Resource.Resource)))
+	deploymentResource := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	resource := admissionReviewRequest.Request.Resource
+	if resource != podResource && resource != deploymentResource {
+		writeErrorResponse(w, requestErrorLog, errors.New(fmt.Sprintf("review request is not from kind pod or deployment, got %s", resource.Resource)))
+		return
+	}
+
+	// Subresources like pods/status or deployments/scale don't carry a pod spec to act on.
+	if subResource := admissionReviewRequest.Request.SubResource; len(subResource) > 0 {
+		if sampled {
+			requestLog.Printf("skipping request for subresource %s/%s", resource.Resource, subResource)
+		}
+		wh.writeAdmissionResponse(w, requestErrorLog, mediaType, admissionReviewRequest, &admissionv1.AdmissionResponse{Allowed: true})
 		return
 	}
 
 	rawRequest := admissionReviewRequest.Request.Object.Raw
 	pod := corev1.Pod{}
-	if _, _, err := deserializer.Decode(rawRequest, nil, &pod); err != nil {
-		writeErrorResponse(w, errors.New(fmt.Sprintf("can't decode raw pod definition: %v", err)))
+	opts := patchOptions{
+		namespaceLabels:    wh.namespaceLabels(admissionReviewRequest.Request.Namespace),
+		limitRangeDefaults: wh.limitRangeDefaults(admissionReviewRequest.Request.Namespace),
+		traceID:            traceID(ctx),
+		logger:             requestLog,
+		errorLogger:        requestErrorLog,
+	}
+	deployment := appsv1.Deployment{}
+	var object runtime.Object = &pod
+	kind := "Pod"
+	if resource == deploymentResource {
+		object = &deployment
+		kind = "Deployment"
+	}
+	_, gvk, err := deserializer.Decode(rawRequest, nil, object)
+	if err != nil {
+		writeErrorResponse(w, requestErrorLog, errors.New(fmt.Sprintf("can't decode raw %s definition: %v", strings.ToLower(kind), err)))
+		return
+	}
+	// A List would silently decode into an empty object. The API server admits the items of a List one by one,
+	// so a List here comes from tooling calling the webhook directly.
+	if len(gvk.Kind) > 0 && gvk.Kind != kind {
+		if strings.HasSuffix(gvk.Kind, "List") {
+			requestErrorLog.Printf("rejecting %s object, expected a single %s", gvk.Kind, kind)
+			wh.writeAdmissionResponse(w, requestErrorLog, mediaType, admissionReviewRequest, &admissionv1.AdmissionResponse{
+				Allowed: false,
+				Result: &metav1.Status{
+					Code:    http.StatusBadRequest,
+					Reason:  metav1.StatusReasonBadRequest,
+					Message: fmt.Sprintf("%s objects are not supported, a JSONPatch can't mutate their items, submit every %s on its own", gvk.Kind, kind),
+				},
+			})
+			return
+		}
+		writeErrorResponse(w, requestErrorLog, errors.New(fmt.Sprintf("unexpected object kind %s, expected %s", gvk.Kind, kind)))
 		return
 	}
+	if resource == deploymentResource {
+		// The rules are evaluated against the pod template, an unset replica count defaults to 1.
+		pod.ObjectMeta = deployment.Spec.Template.ObjectMeta
+		pod.Spec = deployment.Spec.Template.Spec
+		replicas := int32(1)
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+		opts.replicas = &replicas
+	}
+	// Objects created without a namespace only get it defaulted after admission, the request always has it.
+	if namespace := admissionReviewRequest.Request.Namespace; len(namespace) > 0 {
+		pod.Namespace = namespace
+	}
 
 	admissionResponse := &admissionv1.AdmissionResponse{}
-	var patch string
 	patchType := admissionv1.PatchTypeJSONPatch
+	if wh.largeObjectBytes > 0 && len(rawRequest) > wh.largeObjectBytes {
+		largeObjects.Inc()
+		admissionResponse.Warnings = append(admissionResponse.Warnings, wh.warning(fmt.Sprintf("the %s is %d bytes, more than %d, etcd rejects objects over about 1.5MB by default", strings.ToLower(kind), len(rawRequest), wh.largeObjectBytes)))
+	}
 
-	for i := 0; i < len(pod.Spec.Containers); i++ {
-		if pod.Spec.Containers[i].Resources.Limits == nil {
-			patch = fmt.Sprintf(`{"op": "add", "path": "/spec/containers/%d/resources/limits", "value": {"cpu": "100m", "memory": "100Mi"}}, %s`, i, patch)
-			patch = strings.TrimSpace(patch)
+	admissionResponse.Allowed = true
+	var result *mutationResult
+	var cacheKey string
+	if wh.responseCache != nil {
+		cacheKey = responseCacheKey(resource, admissionReviewRequest.Request.Namespace, config.generation, opts, rawRequest)
+		result = wh.responseCache.get(cacheKey)
+		if result != nil {
+			responseCacheHits.Inc()
 		}
 	}
-
-	if len(patch) > 0 {
-		patch = strings.TrimRight(patch, ",")
-		patch = fmt.Sprintf(`[%s]`, patch)
+	if result == nil {
+		result, err = computePatch(&pod, config, opts)
+		if err != nil {
+			writeErrorResponse(w, requestErrorLog, errors.New(fmt.Sprintf("can't compute patch: %v", err)))
+			return
+		}
+		if wh.responseCache != nil {
+			wh.responseCache.add(cacheKey, result)
+		}
 	}
-
-	admissionResponse.Allowed = true
-	if patch != "" {
+	for _, warning := range result.warnings {
+		admissionResponse.Warnings = append(admissionResponse.Warnings, wh.warning(warning))
+	}
+	if len(result.denials) > 0 {
+		admissionResponse.Allowed = false
+		admissionResponse.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: wh.warning(strings.Join(result.denials, "; ")),
+		}
+		wh.writeDecision(w, requestErrorLog, mediaType, admissionReviewRequest, admissionResponse, result.applied)
+		return
+	}
+	if len(result.patch) > 0 {
+		patch := result.patch
+		if resource == deploymentResource {
+			patch = rebasePatch(patch, "/spec/template")
+		}
+		if config.ManagedFields.Enabled {
+			existing, apiVersion := pod.ManagedFields, "v1"
+			if resource == deploymentResource {
+				existing, apiVersion = deployment.ManagedFields, "apps/v1"
+			}
+			op, err := managedFieldsPatch(patch, &pod, existing, config.ManagedFields.Manager, apiVersion)
+			if err != nil {
+				writeErrorResponse(w, requestErrorLog, errors.New(fmt.Sprintf("can't compute managed fields: %v", err)))
+				return
+			}
+			if op != nil {
+				patch = append(patch[:len(patch):len(patch)], *op)
+			}
+		}
+		patchBytes, err := json.Marshal(patch)
+		if err != nil {
+			writeErrorResponse(w, requestErrorLog, errors.New(fmt.Sprintf("not possible marshall patch: %v", err)))
+			return
+		}
 		admissionResponse.PatchType = &patchType
-		admissionResponse.Patch = []byte(patch)
+		admissionResponse.Patch = patchBytes
+		wh.namespaces.add(admissionReviewRequest.Request.Namespace)
+	}
+
+	wh.writeDecision(w, requestErrorLog, mediaType, admissionReviewRequest, admissionResponse, result.applied)
+}
+
+// writeAdmissionResponse writes the response of a request no rule changed the object of, see writeDecision.
+func (wh *mutatingWebhook) writeAdmissionResponse(w http.ResponseWriter, errorLog *log.Logger, mediaType string, admissionReviewRequest *admissionv1.AdmissionReview, admissionResponse *admissionv1.AdmissionResponse) {
+	wh.writeDecision(w, errorLog, mediaType, admissionReviewRequest, admissionResponse, nil)
+}
+
+// writeDecision wraps the response into an AdmissionReview matching the request and writes it, encoded as
+// mediaType. The decision is recorded with the rules that changed the object. An encoding error is logged to
+// errorLog.
+func (wh *mutatingWebhook) writeDecision(w http.ResponseWriter, errorLog *log.Logger, mediaType string, admissionReviewRequest *admissionv1.AdmissionReview, admissionResponse *admissionv1.AdmissionResponse, rules []string) {
+	wh.decisions.record(wh.name, admissionReviewRequest.Request, admissionResponse, rules)
+	if admissionResponse.AuditAnnotations == nil {
+		admissionResponse.AuditAnnotations = map[string]string{}
 	}
+	admissionResponse.AuditAnnotations["webhook-name"] = wh.name
 
+	gvk, err := responseGVK(admissionReviewRequest.APIVersion)
+	if err != nil {
+		writeErrorResponse(w, errorLog, err)
+		return
+	}
 	var admissionReviewResponse admissionv1.AdmissionReview
 	admissionReviewResponse.Response = admissionResponse
-	admissionReviewResponse.SetGroupVersionKind(admissionReviewRequest.GroupVersionKind())
+	admissionReviewResponse.SetGroupVersionKind(gvk)
 	admissionReviewResponse.Response.UID = admissionReviewRequest.Request.UID
 
-	resp, err := json.Marshal(admissionReviewResponse)
+	info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), mediaType)
+	if !ok {
+		info, _ = runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), ContentTypeJSON)
+	}
+	resp, err := runtime.Encode(info.Serializer, &admissionReviewResponse)
 	if err != nil {
-		writeErrorResponse(w, errors.New(fmt.Sprintf("not possible marshall response: %v", err)))
+		writeErrorResponse(w, errorLog, errors.New(fmt.Sprintf("not possible marshall response: %v", err)))
 		return
 	}
 
-	w.Header().Set(ContentTypeKey, ContentTypeJSON)
+	w.Header().Set(ContentTypeKey, info.MediaType)
 	w.Write(resp)
 }
 
-func runMutatingWebhookServer(tlsCert, tlsKey string, port int) error {
+// serverOptions holds the listener settings of the webhook server.
+type serverOptions struct {
+	port        int
+	metricsPort int
+	// sessionTickets enables TLS session resumption via session tickets.
+	sessionTickets bool
+	// certExpiryWarning is how long before the serving certificate expires to start warning.
+	certExpiryWarning time.Duration
+	// clientCAs verify the client certificates, nil doesn't ask for one. allowedClientCNs restricts the common
+	// names of the verified certificates, empty allows all.
+	clientCAs        *x509.CertPool
+	allowedClientCNs []string
+	disableHTTP2     bool
+	maxHeaderBytes   int
+	keepAlives       bool
+	// tcpKeepAlive is the period of the TCP keep-alive probes, see net.ListenConfig.
+	tcpKeepAlive time.Duration
+	chaos        chaosOptions
+}
+
+func newTLSConfig(cert tls.Certificate, opts serverOptions) *tls.Config {
+	config := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		SessionTicketsDisabled: !opts.sessionTickets,
+	}
+	if opts.clientCAs != nil {
+		config.ClientCAs = opts.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(opts.allowedClientCNs) > 0 {
+		config.VerifyPeerCertificate = verifyClientCN(opts.allowedClientCNs)
+	}
+	return config
+}
+
+// verifyClientCN rejects handshakes whose verified client certificate has a common name outside allowed.
+// It runs after the chain verification, so only the leaf of a verified chain is checked. The server logs the
+// rejected handshakes.
+func verifyClientCN(allowed []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			if len(chain) == 0 {
+				continue
+			}
+			for _, cn := range allowed {
+				if chain[0].Subject.CommonName == cn {
+					return nil
+				}
+			}
+		}
+		if len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+			return fmt.Errorf("client certificate CN %q is not allowed", verifiedChains[0][0].Subject.CommonName)
+		}
+		return errors.New("no verified client certificate")
+	}
+}
+
+// newServer returns the webhook server, serving the admission endpoint on a mux of its own.
+func newServer(cert tls.Certificate, opts serverOptions, wh *mutatingWebhook) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", chaosHandler(http.HandlerFunc(wh.mutate), opts.chaos))
+	server := &http.Server{
+		Addr:           fmt.Sprintf(":%d", opts.port),
+		Handler:        mux,
+		TLSConfig:      newTLSConfig(cert, opts),
+		MaxHeaderBytes: opts.maxHeaderBytes,
+		ErrorLog:       errorLogger,
+	}
+	server.SetKeepAlivesEnabled(opts.keepAlives)
+	if opts.disableHTTP2 {
+		// A non-nil empty map keeps net/http from enabling HTTP/2
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return server
+}
+
+func runMutatingWebhookServer(tlsCert, tlsKey string, opts serverOptions, wh *mutatingWebhook) error {
 	logger.Print("Starting DIY mutating webhook server")
 	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
 	if err != nil {
-		logger.Fatal(err)
+		return fmt.Errorf("can't load TLS key pair: %v", err)
+	}
+	if err := watchCertExpiry(cert, opts.certExpiryWarning); err != nil {
+		return err
 	}
 
-	http.HandleFunc("/mutate", mutate)
-	server := http.Server{
-		Addr: fmt.Sprintf(":%d", port),
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		},
-		ErrorLog: logger,
+	if opts.metricsPort > 0 {
+		go runMetricsServer(opts.metricsPort, wh)
 	}
 
-	if err := server.ListenAndServeTLS("", ""); err != nil {
-		logger.Panic(err)
+	server := newServer(cert, opts, wh)
+	listenConfig := net.ListenConfig{KeepAlive: opts.tcpKeepAlive}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", server.Addr)
+	if err != nil {
+		return err
 	}
-	return nil
+	return server.ServeTLS(listener, "", "")
 }
@@ -0,0 +1,661 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMutateSamplesRequestLog(t *testing.T) {
+	resetMetrics(t)
+	logs := captureLogs(t)
+	wh := testWebhook(t, "rules: []\n")
+	wh.requestLogSampleRate = 3
+	review := podReview(t, testPod(t, cachedPod))
+	review.Request.SubResource = "status"
+	for i := 0; i < 6; i++ {
+		if response := admissionResponse(t, wh.mutate, review); !response.Allowed {
+			t.Fatalf("subresource request denied: %v", response.Result)
+		}
+	}
+
+	if requests := testutil.ToFloat64(admissionRequests); requests != 6 {
+		t.Errorf("counted %v requests, want 6", requests)
+	}
+	for _, line := range []string{"mutate request", "skipping request for subresource pods/status"} {
+		if n := strings.Count(logs.String(), line); n != 2 {
+			t.Errorf("logged %q %d times, want 2", line, n)
+		}
+	}
+
+	// Errors are logged for every request.
+	for i := 0; i < 6; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+		r.Header.Set(ContentTypeKey, ContentTypeJSON)
+		wh.mutate(httptest.NewRecorder(), r)
+	}
+	if n := strings.Count(logs.String(), "empty request body"); n != 6 {
+		t.Errorf("logged the error %d times, want 6", n)
+	}
+}
+
+func TestServerRejectsOversizedHeaders(t *testing.T) {
+	captureLogs(t)
+	// HTTP/1.1 servers answer oversized headers with 431, HTTP/2 clients refuse to send headers beyond the
+	// limit the server advertises.
+	for _, disableHTTP2 := range []bool{true, false} {
+		addr, ca := serveTestServer(t, serverOptions{maxHeaderBytes: 1024, disableHTTP2: disableHTTP2, keepAlives: true}, testWebhook(t, "rules: []\n"))
+		client := testClient(ca)
+		for _, test := range []struct {
+			size      int
+			oversized bool
+		}{
+			{size: 100},
+			{size: 10 << 10, oversized: true},
+		} {
+			r, err := http.NewRequest(http.MethodPost, "https://"+addr+"/mutate", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("X-Padding", strings.Repeat("x", test.size))
+			resp, err := client.Do(r)
+			rejected := err != nil
+			if err == nil {
+				resp.Body.Close()
+				rejected = resp.StatusCode == http.StatusRequestHeaderFieldsTooLarge
+			}
+			if rejected != test.oversized {
+				t.Errorf("disableHTTP2 %v, header of %d bytes: got rejected %v, want %v (%v)", disableHTTP2, test.size, rejected, test.oversized, err)
+			}
+		}
+	}
+}
+
+func TestRunRejectsInvalidFlags(t *testing.T) {
+	for _, test := range []struct {
+		flags []string
+		err   string
+	}{
+		{flags: []string{"--max-header-bytes", "0"}, err: "positive maximum header size"},
+		{flags: []string{"--chaos-error-rate", "1.5"}, err: "chaos rates between 0 and 1"},
+		{flags: []string{"--chaos-delay-rate", "-0.1"}, err: "chaos rates between 0 and 1"},
+		{flags: []string{"--chaos-delay", "-1s"}, err: "non-negative chaos delay"},
+		{flags: []string{"--request-log-sample-rate", "0"}, err: "sample rate of at least 1"},
+		{flags: []string{"--large-object-warning-bytes", "-1"}, err: "non-negative large object warning size"},
+		{flags: []string{"--cert-expiry-warning", "-1h"}, err: "cert expiry warning of at least 0"},
+	} {
+		t.Run(strings.Join(test.flags, " "), func(t *testing.T) {
+			if err := runWithFlags(t, test.flags...); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestServerDisableHTTP2(t *testing.T) {
+	captureLogs(t)
+	for _, test := range []struct {
+		disableHTTP2 bool
+		proto        string
+		// alpn is the protocol negotiated in the TLS handshake, the server doesn't offer h2 when disabled.
+		alpn string
+	}{
+		{disableHTTP2: false, proto: "HTTP/2.0", alpn: "h2"},
+		{disableHTTP2: true, proto: "HTTP/1.1", alpn: "http/1.1"},
+	} {
+		addr, ca := serveTestServer(t, serverOptions{disableHTTP2: test.disableHTTP2, keepAlives: true}, testWebhook(t, "rules: []\n"))
+		resp, err := testClient(ca).Get("https://" + addr + "/mutate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Proto != test.proto {
+			t.Errorf("disableHTTP2 %v: got %s, want %s", test.disableHTTP2, resp.Proto, test.proto)
+		}
+		if alpn := resp.TLS.NegotiatedProtocol; alpn != test.alpn {
+			t.Errorf("disableHTTP2 %v: negotiated ALPN protocol %q, want %q", test.disableHTTP2, alpn, test.alpn)
+		}
+	}
+}
+
+func TestServerSessionTickets(t *testing.T) {
+	for _, sessionTickets := range []bool{true, false} {
+		opts := serverOptions{sessionTickets: sessionTickets, keepAlives: true}
+		if disabled := newServer(tls.Certificate{}, opts, testWebhook(t, "rules: []\n")).TLSConfig.SessionTicketsDisabled; disabled == sessionTickets {
+			t.Errorf("sessionTickets %v: got SessionTicketsDisabled %v", sessionTickets, disabled)
+		}
+
+		addr, ca := serveTestServer(t, opts, testWebhook(t, "rules: []\n"))
+		// Every request on a new connection, which resumes the session of the previous one if it can.
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.pool, ClientSessionCache: tls.NewLRUClientSessionCache(1)},
+			DisableKeepAlives: true,
+		}}
+		var resumed bool
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get("https://" + addr + "/mutate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			resumed = resp.TLS.DidResume
+		}
+		if resumed != sessionTickets {
+			t.Errorf("sessionTickets %v: got resumed %v", sessionTickets, resumed)
+		}
+	}
+}
+
+func TestServerKeepAlives(t *testing.T) {
+	for _, keepAlives := range []bool{true, false} {
+		addr, ca := serveTestServer(t, serverOptions{disableHTTP2: true, keepAlives: keepAlives}, testWebhook(t, "rules: []\n"))
+		client := testClient(ca)
+		var reused bool
+		for i := 0; i < 2; i++ {
+			r, err := http.NewRequest(http.MethodGet, "https://"+addr+"/mutate", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+			}))
+			resp, err := client.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.Close == keepAlives {
+				t.Errorf("keepAlives %v: got Connection: close %v", keepAlives, resp.Close)
+			}
+		}
+		if reused != keepAlives {
+			t.Errorf("keepAlives %v: got connection reused %v", keepAlives, reused)
+		}
+	}
+}
+
+func TestServerVerifiesClientCN(t *testing.T) {
+	captureLogs(t)
+	clientCA := newTestCA(t)
+	opts := serverOptions{clientCAs: clientCA.pool, allowedClientCNs: []string{"kube-apiserver"}, keepAlives: true}
+	addr, ca := serveTestServer(t, opts, testWebhook(t, "rules: []\n"))
+	for _, test := range []struct {
+		cn      string
+		allowed bool
+	}{
+		{cn: "kube-apiserver", allowed: true},
+		{cn: "intruder"},
+	} {
+		client := testClient(ca, clientCA.issue(t, test.cn, x509.ExtKeyUsageClientAuth, time.Now().Add(time.Hour)))
+		resp, err := client.Get("https://" + addr + "/mutate")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("client CN %s: got error %v, want allowed %v", test.cn, err, test.allowed)
+		}
+	}
+	if _, err := testClient(ca).Get("https://" + addr + "/mutate"); err == nil {
+		t.Errorf("request without client certificate allowed")
+	}
+	// The CN is only trusted on a certificate of the client CA.
+	foreign := newTestCA(t).issue(t, "kube-apiserver", x509.ExtKeyUsageClientAuth, time.Now().Add(time.Hour))
+	if _, err := testClient(ca, foreign).Get("https://" + addr + "/mutate"); err == nil {
+		t.Errorf("request with an allowed CN from another CA allowed")
+	}
+
+	for _, test := range []struct {
+		name  string
+		flags []string
+		err   string
+	}{
+		{name: "CNs without CA", flags: []string{"--allowed-client-cns", "kube-apiserver"}, err: "client CA to verify the allowed client CNs"},
+		{name: "CA without certificates", flags: []string{"--client-ca", writeConfig(t, "ca.crt", "not a certificate")}, err: "at least one PEM certificate"},
+		{name: "missing CA", flags: []string{"--client-ca", "missing.crt"}, err: "can't read client CA"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := runWithFlags(t, test.flags...); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestMutateNamesWebhook(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: service-account, defaultServiceAccountWarning: {}}]\n")
+	response := admissionResponse(t, wh.mutate, podReview(t, testPod(t, cachedPod)))
+	if len(response.Warnings) != 1 || !strings.HasPrefix(response.Warnings[0], "test-webhook: ") {
+		t.Errorf("got warnings %q, want one prefixed with the webhook name", response.Warnings)
+	}
+	if name := response.AuditAnnotations["webhook-name"]; name != "test-webhook" {
+		t.Errorf("got webhook-name audit annotation %q", name)
+	}
+}
+
+func TestEmptyRequestBody(t *testing.T) {
+	logs := captureLogs(t)
+	r := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+	r.Header.Set(ContentTypeKey, ContentTypeJSON)
+	w := httptest.NewRecorder()
+	testWebhook(t, "rules: []\n").mutate(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "empty request body") {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(logs.String(), "empty request body") {
+		t.Errorf("got logs %q, want the empty body logged", logs)
+	}
+}
+
+func TestAdmissionReviewFromRequestDoesNotKeepTheBuffer(t *testing.T) {
+	request := func(review *admissionv1.AdmissionReview) *http.Request {
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+		r.Header.Set(ContentTypeKey, ContentTypeJSON)
+		return r
+	}
+	first := podReview(t, testPod(t, cachedPod))
+	decoded, _, err := admissionReviewFromRequest(request(first), codecs.UniversalDeserializer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := string(decoded.Request.Object.Raw)
+
+	// The next request reuses the pooled buffer, the first review must not change with it.
+	second := podReview(t, testPod(t, "metadata:\n  name: other\nspec:\n  containers:\n  - name: worker\n"))
+	if _, _, err := admissionReviewFromRequest(request(second), codecs.UniversalDeserializer()); err != nil {
+		t.Fatal(err)
+	}
+	malformed := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader("{"))
+	malformed.Header.Set(ContentTypeKey, ContentTypeJSON)
+	if _, _, err := admissionReviewFromRequest(malformed, codecs.UniversalDeserializer()); err == nil {
+		t.Fatal("malformed request decoded")
+	}
+	if got := string(decoded.Request.Object.Raw); got != raw {
+		t.Errorf("decoded object changed to %s", got)
+	}
+}
+
+// BenchmarkAdmissionReviewFromRequest compares reading the body into a pooled buffer with the ioutil.ReadAll
+// the webhook used before, for a pod with many containers like the ones the API server sends under load.
+func BenchmarkAdmissionReviewFromRequest(b *testing.B) {
+	pod := &corev1.Pod{}
+	for i := 0; i < 20; i++ {
+		container := corev1.Container{Name: fmt.Sprintf("container-%d", i), Image: "registry.example.com/app:1.0"}
+		for j := 0; j < 20; j++ {
+			container.Env = append(container.Env, corev1.EnvVar{Name: fmt.Sprintf("VARIABLE_%d", j), Value: strings.Repeat("x", 32)})
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request:  &admissionv1.AdmissionRequest{UID: "test-uid", Object: runtime.RawExtension{Raw: raw}},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	deserializer := codecs.UniversalDeserializer()
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+		r.Header.Set(ContentTypeKey, ContentTypeJSON)
+		return r
+	}
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := admissionReviewFromRequest(request(), deserializer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("readAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r := request()
+			if _, _, err := mime.ParseMediaType(r.Header.Get(ContentTypeKey)); err != nil {
+				b.Fatal(err)
+			}
+			requestData, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				b.Fatal(err)
+			}
+			typeMeta := metav1.TypeMeta{}
+			if err := json.Unmarshal(requestData, &typeMeta); err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := deserializer.Decode(requestData, nil, &admissionv1.AdmissionReview{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestMutateSkipsSubresources(t *testing.T) {
+	logs := captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	for _, test := range []struct {
+		subResource string
+		object      string
+	}{
+		{subResource: "status", object: `{"apiVersion":"v1","kind":"Pod","spec":{"containers":[{"name":"app"}]}}`},
+		{subResource: "exec", object: `{"apiVersion":"v1","kind":"PodExecOptions","command":["sh"]}`},
+	} {
+		review := podReview(t, testPod(t, cachedPod))
+		review.Request.SubResource = test.subResource
+		review.Request.Object.Raw = []byte(test.object)
+		response := admissionResponse(t, wh.mutate, review)
+		if !response.Allowed || len(response.Patch) > 0 {
+			t.Errorf("pods/%s request: got allowed %v and patch %s, want allowed without patch", test.subResource, response.Allowed, response.Patch)
+		}
+		if line := "skipping request for subresource pods/" + test.subResource; !strings.Contains(logs.String(), line) {
+			t.Errorf("got logs %q, want %q", logs, line)
+		}
+	}
+}
+
+func TestUnsupportedAdmissionVersion(t *testing.T) {
+	logs := captureLogs(t)
+	review := podReview(t, testPod(t, cachedPod))
+	review.APIVersion = "admission.k8s.io/v2"
+	w := postReview(t, testWebhook(t, "rules: []\n").mutate, review)
+	want := `unsupported admission version "admission.k8s.io/v2", expected admission.k8s.io/v1`
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got status %d: %s, want %q", w.Code, w.Body, want)
+	}
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("got logs %q, want the unsupported version logged", logs)
+	}
+}
+
+func TestResponseGVKCachesFewVersions(t *testing.T) {
+	for i := 0; i < 2*maxAdmissionVersions; i++ {
+		if _, err := responseGVK(fmt.Sprintf("admission.k8s.io/v%d", i+2)); err == nil {
+			t.Fatalf("version v%d supported, want it rejected", i+2)
+		}
+	}
+	gvk, err := responseGVK(admissionv1.SchemeGroupVersion.String())
+	if err != nil || gvk != admissionv1.SchemeGroupVersion.WithKind("AdmissionReview") {
+		t.Errorf("got %v, %v, want the v1 AdmissionReview", gvk, err)
+	}
+	admissionVersions.RLock()
+	_, cached := admissionVersions.resolved[admissionv1.SchemeGroupVersion.String()]
+	versions := len(admissionVersions.resolved)
+	admissionVersions.RUnlock()
+	if !cached || versions > maxAdmissionVersions {
+		t.Errorf("got %d cached versions with v1 cached %v, want at most %d including v1", versions, cached, maxAdmissionVersions)
+	}
+}
+
+// BenchmarkResponseGVK compares the cached version resolution with resolving the version of every request,
+// for traffic mixing v1 reviews with v1beta1 reviews of older API servers.
+func BenchmarkResponseGVK(b *testing.B) {
+	versions := []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1", "admission.k8s.io/v1", "admission.k8s.io/v1"}
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			responseGVK(versions[i%len(versions)])
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			resolveAdmissionVersion(versions[i%len(versions)])
+		}
+	})
+}
+
+func TestMutateAnswersProtobufWithProtobuf(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	for _, mediaType := range []string{ContentTypeProtobuf, ContentTypeJSON} {
+		info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), mediaType)
+		if !ok {
+			t.Fatalf("no serializer for %s", mediaType)
+		}
+		body, err := runtime.Encode(info.Serializer, podReview(t, testPod(t, cachedPod)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+		r.Header.Set(ContentTypeKey, mediaType)
+		w := httptest.NewRecorder()
+		wh.mutate(w, r)
+
+		if contentType := w.Header().Get(ContentTypeKey); w.Code != http.StatusOK || contentType != mediaType {
+			t.Fatalf("%s request: got status %d and content type %s: %s", mediaType, w.Code, contentType, w.Body)
+		}
+		response := &admissionv1.AdmissionReview{}
+		if _, _, err := codecs.UniversalDeserializer().Decode(w.Body.Bytes(), nil, response); err != nil {
+			t.Fatalf("%s request: can't decode response: %v", mediaType, err)
+		}
+		if response.Response == nil || response.Response.UID != "test-uid" || !strings.Contains(string(response.Response.Patch), "/resources/limits") {
+			t.Errorf("%s request: got response %+v, want the limits patch", mediaType, response.Response)
+		}
+	}
+}
+
+func TestMutateTakesNamespaceFromRequest(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "namespaceRules: {restricted: []}\nrules: [{name: limits, limits: {cpu: 100m}}]\n")
+	for _, test := range []struct {
+		namespace string
+		patched   bool
+	}{
+		{namespace: "restricted", patched: false},
+		{namespace: "default", patched: true},
+	} {
+		// The pod object has no namespace yet, only the request carries it.
+		pod := testPod(t, cachedPod)
+		pod.Namespace = ""
+		review := podReview(t, pod)
+		review.Request.Namespace = test.namespace
+		response := admissionResponse(t, wh.mutate, review)
+		if patched := len(response.Patch) > 0; patched != test.patched {
+			t.Errorf("request in namespace %s: got patch %s, want patched %v", test.namespace, response.Patch, test.patched)
+		}
+	}
+}
+
+func TestMutatePinnedPodUpdate(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "pin: {setAfterMutation: true}\nrules: [{name: limits, limits: {cpu: 100m}}]\n")
+	pod := testPod(t, cachedPod)
+	response := admissionResponse(t, wh.mutate, podReview(t, pod))
+	var patch []patchOperation
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	mutated, err := patchedPod(pod, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutated.Annotations["diy-webhook/pinned"] != "true" {
+		t.Fatalf("got annotations %v, want the pod pinned", mutated.Annotations)
+	}
+
+	// An update of the mutated pod that the limits rule would change again.
+	update := func(pod *corev1.Pod) *admissionv1.AdmissionResponse {
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+		review := podReview(t, pod)
+		review.Request.Operation = admissionv1.Update
+		review.Request.OldObject = runtime.RawExtension{Raw: podReview(t, mutated).Request.Object.Raw}
+		return admissionResponse(t, wh.mutate, review)
+	}
+	if response := update(mutated.DeepCopy()); !response.Allowed || len(response.Patch) > 0 {
+		t.Errorf("got allowed %v and patch %s for the pinned pod, want it admitted unchanged", response.Allowed, response.Patch)
+	}
+	unpinned := mutated.DeepCopy()
+	delete(unpinned.Annotations, "diy-webhook/pinned")
+	if response := update(unpinned); len(response.Patch) == 0 {
+		t.Error("got no patch for the update of the unpinned pod, want the limits added again")
+	}
+}
+
+func TestMutateShedsLoad(t *testing.T) {
+	resetMetrics(t)
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	wh.maxInFlight = 2
+	body, err := json.Marshal(podReview(t, testPod(t, cachedPod)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests whose bodies haven't arrived yet stay in flight until the bodies are written.
+	var writers []*io.PipeWriter
+	held := make(chan *httptest.ResponseRecorder, wh.maxInFlight)
+	for i := int64(0); i < wh.maxInFlight; i++ {
+		reader, writer := io.Pipe()
+		writers = append(writers, writer)
+		r := httptest.NewRequest(http.MethodPost, "/mutate", reader)
+		r.Header.Set(ContentTypeKey, ContentTypeJSON)
+		go func() {
+			w := httptest.NewRecorder()
+			wh.mutate(w, r)
+			held <- w
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&wh.inFlight) < wh.maxInFlight; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d requests in flight, want %d", atomic.LoadInt64(&wh.inFlight), wh.maxInFlight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if gauge := testutil.ToFloat64(inFlightRequests); gauge != 2 {
+		t.Errorf("got in-flight gauge %v, want 2", gauge)
+	}
+
+	response := admissionResponse(t, wh.mutate, podReview(t, testPod(t, cachedPod)))
+	if !response.Allowed || len(response.Patch) > 0 || len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "webhook overloaded") {
+		t.Errorf("got allowed %v, patch %s and warnings %q, want the request admitted unchanged with a warning", response.Allowed, response.Patch, response.Warnings)
+	}
+	if shed := testutil.ToFloat64(shedRequests); shed != 1 {
+		t.Errorf("counted %v shed requests, want 1", shed)
+	}
+
+	for _, writer := range writers {
+		go func(writer *io.PipeWriter) {
+			writer.Write(body)
+			writer.Close()
+		}(writer)
+	}
+	for range writers {
+		w := <-held
+		response := &admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil || response.Response == nil || len(response.Response.Patch) == 0 {
+			t.Errorf("got status %d and body %s, want the held request mutated", w.Code, w.Body)
+		}
+	}
+	if gauge := testutil.ToFloat64(inFlightRequests); gauge != 0 {
+		t.Errorf("got in-flight gauge %v after the requests, want 0", gauge)
+	}
+}
+
+func TestMutateRejectsLists(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	for _, kind := range []string{"List", "PodList"} {
+		review := podReview(t, testPod(t, cachedPod))
+		review.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"` + kind + `","items":[{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web"},"spec":{"containers":[{"name":"app"}]}}]}`)
+		response := admissionResponse(t, wh.mutate, review)
+		want := kind + " objects are not supported"
+		if response.Allowed || len(response.Patch) > 0 || response.Result == nil || !strings.Contains(response.Result.Message, want) {
+			t.Errorf("%s object: got allowed %v, patch %s and result %v, want denied with %q", kind, response.Allowed, response.Patch, response.Result, want)
+		}
+	}
+
+	review := podReview(t, testPod(t, cachedPod))
+	review.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"Service","metadata":{"name":"web"}}`)
+	if w := postReview(t, wh.mutate, review); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unexpected object kind Service, expected Pod") {
+		t.Errorf("Service object: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLogsRoutedByLevel(t *testing.T) {
+	captureLogs(t)
+	var out, errOut bytes.Buffer
+	logger.SetOutput(&out)
+	errorLogger.SetOutput(&errOut)
+	wh := testWebhook(t, "rules: []\n")
+	admissionResponse(t, wh.mutate, podReview(t, testPod(t, cachedPod)))
+	r := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+	r.Header.Set(ContentTypeKey, ContentTypeJSON)
+	wh.mutate(httptest.NewRecorder(), r)
+
+	if !strings.Contains(out.String(), "mutate request") || strings.Contains(out.String(), "empty request body") {
+		t.Errorf("got informational lines %q, want the requests without the error", out.String())
+	}
+	if !strings.Contains(errOut.String(), "empty request body") || strings.Contains(errOut.String(), "mutate request") {
+		t.Errorf("got error lines %q, want only the error", errOut.String())
+	}
+
+	// The flag is read before the rejected one, so it has taken effect when the run fails.
+	if err := runWithFlags(t, "--log-errors-to-stderr", "--max-in-flight", "-1"); err == nil {
+		t.Fatal("got no error for --max-in-flight -1")
+	}
+	if errorLogger.Writer() != os.Stderr || logger.Writer() == os.Stderr {
+		t.Error("--log-errors-to-stderr: want only the error logger writing to stderr")
+	}
+}
+
+func TestMutateWarnsAboutLargeObjects(t *testing.T) {
+	resetMetrics(t)
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	wh.largeObjectBytes = 64 << 10
+	large := testPod(t, cachedPod)
+	large.Annotations = map[string]string{"last-applied": strings.Repeat("x", 100<<10)}
+	for _, test := range []struct {
+		name string
+		pod  *corev1.Pod
+		warn bool
+	}{
+		{name: "small pod", pod: testPod(t, cachedPod), warn: false},
+		{name: "large pod", pod: large, warn: true},
+	} {
+		response := admissionResponse(t, wh.mutate, podReview(t, test.pod))
+		if !response.Allowed || len(response.Patch) == 0 {
+			t.Errorf("%s: got allowed %v with patch %s, want the pod admitted and patched", test.name, response.Allowed, response.Patch)
+		}
+		warned := len(response.Warnings) == 1 && strings.HasPrefix(response.Warnings[0], "test-webhook: the pod is ") && strings.Contains(response.Warnings[0], "more than 65536")
+		if warned != test.warn || len(response.Warnings) > 1 {
+			t.Errorf("%s: got warnings %q, want size warning %v", test.name, response.Warnings, test.warn)
+		}
+	}
+	if got := testutil.ToFloat64(largeObjects); got != 1 {
+		t.Errorf("got %v large objects, want 1", got)
+	}
+
+	wh.largeObjectBytes = 0
+	if response := admissionResponse(t, wh.mutate, podReview(t, large)); len(response.Warnings) != 0 {
+		t.Errorf("warning disabled: got warnings %q", response.Warnings)
+	}
+}
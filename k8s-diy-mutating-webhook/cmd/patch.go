@@ -0,0 +1,748 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// patchOperation is a single JSONPatch operation, see https://jsonpatch.com
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// MarshalJSON writes the value of add, replace and test operations even if it is null, and leaves it out of
+// the other operations.
+func (op patchOperation) MarshalJSON() ([]byte, error) {
+	switch op.Op {
+	case "add", "replace", "test":
+		return json.Marshal(struct {
+			Op    string      `json:"op"`
+			Path  string      `json:"path"`
+			Value interface{} `json:"value"`
+		}{Op: op.Op, Path: op.Path, Value: op.Value})
+	}
+	type operation patchOperation
+	return json.Marshal(operation(op))
+}
+
+// now is the clock of the timestamp annotation, replaceable to get a fixed time.
+var now = time.Now
+
+// formatTimestamp formats t for the timestamp annotation.
+func formatTimestamp(t time.Time, format string) string {
+	if format == TimestampUnix {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// pinMarkerPrefix prefixes the webhook version in versioned pin annotations.
+const pinMarkerPrefix = "mutated-by-"
+
+// pinMarker returns the value of the versioned pin annotation set by this version of the webhook. Builds
+// without a version set at build time, like the ones of ko, are told apart by their commit instead.
+func pinMarker() string {
+	if version == "dev" {
+		if commit := buildCommit(); commit != "unknown" {
+			return pinMarkerPrefix + commit
+		}
+	}
+	return pinMarkerPrefix + version
+}
+
+// isPinned reports whether the pod carries the pin annotation and must not be mutated. With versioned pins,
+// a pin set after mutation by another webhook version doesn't count.
+func isPinned(pod *corev1.Pod, config *Config) bool {
+	value, ok := pod.Annotations[config.Pin.Annotation]
+	if ok && config.Pin.Versioned && strings.HasPrefix(value, pinMarkerPrefix) {
+		return value == pinMarker()
+	}
+	return ok
+}
+
+// isProtected reports whether the pod is owned by one of the protected owners and must not be mutated.
+func isProtected(pod *corev1.Pod, config *Config) bool {
+	for _, ref := range pod.OwnerReferences {
+		for _, owner := range config.ProtectedOwners {
+			if ref.Kind == owner.Kind && (len(owner.Name) == 0 || ref.Name == owner.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mutationResult is the outcome of evaluating the rules against a pod.
+type mutationResult struct {
+	patch    []patchOperation
+	warnings []string
+	// applied are the names of the rules that changed the pod, in config order.
+	applied []string
+	// denials are the reasons rules rejected the pod for. A denied pod must not be admitted.
+	denials []string
+	// trace records why each rule did or didn't change the pod, if requested.
+	trace []ruleTrace
+	// events are the metric increments and log lines of the rules, see report.
+	events []ruleEvent
+	// namespace is the namespace of the pod, the namespace label of the rule metrics.
+	namespace string
+}
+
+// ruleEvent is a metric increment of a rule, with the line logged for it.
+type ruleEvent struct {
+	rule *Rule
+	kind ruleEventKind
+	// value is the increment, the number of operations for ruleDryRun.
+	value float64
+	// message is logged, except if it is empty.
+	message string
+}
+
+type ruleEventKind int
+
+const (
+	ruleWarned ruleEventKind = iota
+	ruleDenied
+	// ruleDryRun counts the operations a dry-run rule didn't apply.
+	ruleDryRun
+	ruleInvalidOperation
+	// ruleSkipped logs why the rule was skipped, it has no metric.
+	ruleSkipped
+)
+
+// event records a metric increment of the rule.
+func (r *mutationResult) event(rule *Rule, kind ruleEventKind, value float64, format string, args ...interface{}) {
+	event := ruleEvent{rule: rule, kind: kind, value: value}
+	if len(format) > 0 {
+		event.message = fmt.Sprintf(format, args...)
+	}
+	r.events = append(r.events, event)
+}
+
+// report counts and logs the rule events of the result once computePatch returns. A cached result isn't
+// reported again, the requests it answers only count as cache hits.
+func (r *mutationResult) report(opts patchOptions) {
+	infoLogger, errLogger := opts.loggers()
+	for _, event := range r.events {
+		rule := event.rule
+		if !opts.skipMetrics {
+			switch event.kind {
+			case ruleWarned:
+				ruleWarnings.WithLabelValues(rule.Name, rule.metricNamespace(r.namespace)).Inc()
+			case ruleDenied:
+				ruleDenials.WithLabelValues(rule.Name, rule.metricNamespace(r.namespace)).Inc()
+			case ruleDryRun:
+				dryRunOperations.WithLabelValues(rule.Name).Add(event.value)
+			case ruleInvalidOperation:
+				invalidPatchOperations.WithLabelValues(rule.Name).Inc()
+			}
+		}
+		if len(event.message) == 0 {
+			continue
+		}
+		switch event.kind {
+		case ruleDenied, ruleDryRun:
+			rule.logf(infoLogger, "%s", event.message)
+		default:
+			rule.logf(errLogger, "%s", event.message)
+		}
+	}
+}
+
+// ruleTrace is the evaluation outcome of a single rule.
+type ruleTrace struct {
+	Rule    string `json:"rule"`
+	Applied bool   `json:"applied"`
+	Reason  string `json:"reason"`
+}
+
+// patchOptions holds the per-request settings of computePatch.
+type patchOptions struct {
+	// replicas is the replica count of the controller whose pod template is patched, nil for pods.
+	replicas *int32
+	// namespaceLabels are the labels of the pod namespace, nil if the namespace is unknown.
+	namespaceLabels map[string]string
+	// limitRangeDefaults is set if a LimitRange of the pod namespace defaults container limits.
+	limitRangeDefaults bool
+	// trace records the evaluation outcome of every rule in the result.
+	trace bool
+	// skipMetrics keeps the rules out of the metrics, for the debug endpoint and simulations that don't
+	// admit anything.
+	skipMetrics bool
+	// traceID is the ID of the request span, added as exemplar to the rule duration observations. Empty
+	// without tracing.
+	traceID string
+	// logger and errorLogger log the lines of the rules, the package loggers if nil. Admission requests pass
+	// loggers adding their trace ID.
+	logger, errorLogger *log.Logger
+}
+
+// loggers returns the loggers of the rule lines.
+func (o patchOptions) loggers() (*log.Logger, *log.Logger) {
+	infoLogger, errLogger := o.logger, o.errorLogger
+	if infoLogger == nil {
+		infoLogger = logger
+	}
+	if errLogger == nil {
+		errLogger = errorLogger
+	}
+	return infoLogger, errLogger
+}
+
+// computePatch evaluates the configured rules against the pod and returns the combined JSONPatch.
+// Every rule sees the pod as patched by the rules before it, so a rule can rely on objects created earlier.
+// When several rules set the same field, the rule with the more specific container selector wins, so a rule
+// targeting the sidecar by name overrides a rule for all containers on the sidecar only, whatever their order.
+// Between rules as specific, the last one in config order wins. The winning operation replaces the earlier
+// ones, so the patch never carries more than one write to a path. Fields of the submitted pod are never
+// overwritten this way.
+// Applying each rule's operations to the working pod also verifies them. It fails if a rule produces an invalid
+// operation, more operations than its maxOperations or a patch that doesn't apply, unless the rule's onError
+// policy allows skipping it.
+func computePatch(pod *corev1.Pod, config *Config, opts patchOptions) (*mutationResult, error) {
+	result := &mutationResult{namespace: pod.Namespace}
+	// Reported once the rules ran, or one of them failed.
+	defer result.report(opts)
+	record := func(rule *Rule, applied bool, reason string) {
+		if opts.trace {
+			result.trace = append(result.trace, ruleTrace{Rule: rule.Name, Applied: applied, Reason: reason})
+		}
+	}
+
+	skipReason := ""
+	switch {
+	case isPinned(pod, config):
+		skipReason = fmt.Sprintf("pod has the pin annotation %s", config.Pin.Annotation)
+	case isProtected(pod, config):
+		skipReason = "pod is owned by a protected owner"
+	}
+	if len(skipReason) > 0 {
+		for i := range config.Rules {
+			record(&config.Rules[i], false, skipReason)
+		}
+		return result, nil
+	}
+
+	var patch []patchOperation
+	var applied []string
+	working := pod
+	written := map[string]int{}
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if !config.ruleEnabled(pod.Namespace, rule.Name) {
+			record(rule, false, fmt.Sprintf("rule is not enabled in namespace %s", pod.Namespace))
+			continue
+		}
+		if !rule.Selector.matchesNamespace(opts.namespaceLabels) {
+			record(rule, false, "namespace selector doesn't match")
+			continue
+		}
+		if !rule.Selector.matchesPod(working) {
+			record(rule, false, "pod selector doesn't match")
+			continue
+		}
+		ctx := &ruleContext{
+			pod:                working,
+			containers:         rule.Selector.selectContainers(working),
+			namespaceLabels:    opts.namespaceLabels,
+			limitRangeDefaults: opts.limitRangeDefaults,
+			replicas:           opts.replicas,
+			written:            written,
+			specificity:        rule.Selector.specificity(),
+		}
+		start := time.Now()
+		operations := rule.mutation().patch(ctx)
+		if !opts.skipMetrics {
+			observeWithTraceID(ruleDuration.WithLabelValues(rule.Name), time.Since(start).Seconds(), opts.traceID)
+		}
+		rulePatch, skipped, err := rule.validatePatch(operations)
+		for _, err := range skipped {
+			result.event(rule, ruleInvalidOperation, 1, "skipping invalid patch operation: %v", err)
+		}
+		if err != nil {
+			result.event(rule, ruleInvalidOperation, 1, "")
+			return nil, err
+		}
+		rulePatch = config.dropProtectedLabelOps(rule, ctx, rulePatch)
+		rulePatch = dropOutrankedOps(ctx, rulePatch)
+		if rule.MaxOperations > 0 && len(rulePatch) > rule.MaxOperations {
+			if rule.OnError != OnErrorSkip {
+				return nil, fmt.Errorf("rule %q produced %d patch operations, more than its maxOperations %d", rule.Name, len(rulePatch), rule.MaxOperations)
+			}
+			result.event(rule, ruleSkipped, 0, "skipping %d patch operations, more than maxOperations %d", len(rulePatch), rule.MaxOperations)
+			record(rule, false, fmt.Sprintf("%d patch operations exceed maxOperations %d", len(rulePatch), rule.MaxOperations))
+			continue
+		}
+		if len(rulePatch) > 0 {
+			patched, err := patchedPod(working, rulePatch)
+			if err != nil {
+				if rule.OnError != OnErrorSkip {
+					return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+				}
+				result.event(rule, ruleSkipped, 0, "skipping patch that doesn't apply: %v", err)
+				record(rule, false, fmt.Sprintf("patch doesn't apply: %v", err))
+				continue
+			}
+			if containers := len(patched.Spec.Containers); config.MaxContainers > 0 && containers > len(working.Spec.Containers) && containers > config.MaxContainers {
+				warning := fmt.Sprintf("rule %s skipped, it would grow the pod to %d containers, more than maxContainers %d", rule.Name, containers, config.MaxContainers)
+				result.event(rule, ruleWarned, 1, "warning: %s", warning)
+				record(rule, false, fmt.Sprintf("%d containers exceed maxContainers %d", containers, config.MaxContainers))
+				if !rule.DryRun {
+					result.warnings = append(result.warnings, warning)
+				}
+				continue
+			}
+			if rule.DryRun {
+				if data, err := config.envRedactor(patched).redactPatch(rulePatch); err == nil {
+					result.event(rule, ruleDryRun, float64(len(rulePatch)), "dry run, not applying patch %s", data)
+				} else {
+					result.event(rule, ruleDryRun, float64(len(rulePatch)), "")
+				}
+				record(rule, false, fmt.Sprintf("dry run, %d patch operations not applied", len(rulePatch)))
+				rulePatch = nil
+			} else {
+				working = patched
+				applied = append(applied, rule.Name)
+				record(rule, true, fmt.Sprintf("%d patch operations", len(rulePatch)))
+			}
+		} else {
+			record(rule, false, fmt.Sprintf("nothing to change in %d matched containers", len(ctx.containers)))
+		}
+		patch = overwritePatch(patch, rulePatch, written, ctx.specificity)
+		for _, warning := range ctx.warnings {
+			result.event(rule, ruleWarned, 1, "warning: %s", warning)
+		}
+		for _, denial := range ctx.denials {
+			if rule.DryRun {
+				result.event(rule, ruleDenied, 1, "dry run, not denying: %s", denial)
+			} else {
+				result.event(rule, ruleDenied, 1, "denying: %s", denial)
+			}
+		}
+		if !rule.DryRun {
+			result.warnings = append(result.warnings, ctx.warnings...)
+			result.denials = append(result.denials, ctx.denials...)
+		}
+	}
+
+	labels := map[string]string{}
+	annotations := map[string]string{}
+	if len(patch) > 0 {
+		if _, ok := working.Labels[config.ManagedBy.Key]; config.ManagedBy.Enabled && !ok {
+			labels[config.ManagedBy.Key] = config.ManagedBy.Value
+		}
+		if config.Pin.SetAfterMutation {
+			annotations[config.Pin.Annotation] = "true"
+			if config.Pin.Versioned {
+				annotations[config.Pin.Annotation] = pinMarker()
+			}
+		}
+		if config.Timestamp.Enabled {
+			annotations[config.Timestamp.Annotation] = formatTimestamp(now(), config.Timestamp.Format)
+		}
+		if config.AppliedRules.Enabled && len(applied) > 0 {
+			annotations[config.AppliedRules.Annotation] = strings.Join(applied, ",")
+		}
+	}
+	patch = append(patch, metadataMapPatch("/metadata/labels", working.Labels, labels)...)
+	patch = append(patch, metadataMapPatch("/metadata/annotations", working.Annotations, annotations)...)
+
+	for _, normalizer := range patchNormalizers {
+		patch = normalizer.normalize(patch)
+	}
+	result.patch = patch
+	result.applied = applied
+	return result, nil
+}
+
+// patchNormalizer post-processes the combined patch of all rules, before it is sent. A normalizer must not
+// change the result of applying the patch.
+type patchNormalizer interface {
+	normalize(patch []patchOperation) []patchOperation
+}
+
+// patchNormalizers run in order on every patch computePatch returns.
+var patchNormalizers = []patchNormalizer{dedupeOperations{}}
+
+// dedupeOperations drops operations identical to an earlier one, unless an operation in between touched the
+// same path, a path above or below it, or the array it is in. Operations on array positions are kept, as
+// repeating them inserts or removes another element.
+type dedupeOperations struct{}
+
+func (dedupeOperations) normalize(patch []patchOperation) []patchOperation {
+	seen := map[string]int{}
+	deduped := patch[:0]
+	for _, op := range patch {
+		if last := op.Path[strings.LastIndex(op.Path, "/")+1:]; last != "-" && !isArrayIndex(last) {
+			key, err := json.Marshal(op)
+			if i, ok := seen[string(key)]; err == nil && ok && !touchedSince(deduped[i+1:], op.Path) {
+				continue
+			}
+			seen[string(key)] = len(deduped)
+		}
+		deduped = append(deduped, op)
+	}
+	return deduped
+}
+
+// touchedSince reports whether one of the operations changes or reads the value at path, directly or through a
+// path above or below it. An operation on an array position touches the whole array, as it shifts the
+// positions after it.
+func touchedSince(patch []patchOperation, path string) bool {
+	for _, op := range patch {
+		for _, touched := range []string{op.Path, op.From} {
+			if len(touched) == 0 {
+				continue
+			}
+			if i := strings.LastIndex(touched, "/"); touched[i+1:] == "-" || isArrayIndex(touched[i+1:]) {
+				touched = touched[:i]
+			}
+			if touched == path || strings.HasPrefix(path, touched+"/") || strings.HasPrefix(touched, path+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isArrayIndex(token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+	_, err := strconv.Atoi(token)
+	return err == nil
+}
+
+// overwritePatch appends the operations of a rule to the patch of the rules before it. An add or replace of
+// a path written earlier supersedes the earlier operations on that path and below, and takes over an earlier
+// add, as the field is still missing in the submitted pod. written records the paths set so far, with the
+// specificity of the rule that set them.
+func overwritePatch(patch, rulePatch []patchOperation, written map[string]int, specificity int) []patchOperation {
+	for _, op := range rulePatch {
+		if (op.Op != "add" && op.Op != "replace") || strings.HasSuffix(op.Path, "/-") {
+			patch = append(patch, op)
+			continue
+		}
+		if _, ok := written[op.Path]; ok {
+			kept := patch[:0]
+			for _, earlier := range patch {
+				if earlier.Path == op.Path || strings.HasPrefix(earlier.Path, op.Path+"/") {
+					if earlier.Path == op.Path && earlier.Op == "add" {
+						op.Op = "add"
+					}
+					continue
+				}
+				kept = append(kept, earlier)
+			}
+			patch = kept
+		}
+		written[op.Path] = specificity
+		patch = append(patch, op)
+	}
+	return patch
+}
+
+// dropOutrankedOps removes the operations on fields set by an earlier rule with a more specific selector.
+// Appends to arrays are kept, they don't overwrite anything.
+func dropOutrankedOps(ctx *ruleContext, patch []patchOperation) []patchOperation {
+	var kept []patchOperation
+	for _, op := range patch {
+		if op.Op != "test" && !strings.HasSuffix(op.Path, "/-") && ctx.outranked(op.Path) {
+			continue
+		}
+		kept = append(kept, op)
+	}
+	return kept
+}
+
+// validatePatch checks the operations produced by the rule before they reach a response.
+// Depending on the rule's onError policy, an invalid operation fails the rule or is dropped, with its error
+// returned in skipped.
+func (r *Rule) validatePatch(patch []patchOperation) (valid []patchOperation, skipped []error, err error) {
+	for _, op := range patch {
+		if err := validatePatchOperation(op); err != nil {
+			if r.OnError != OnErrorSkip {
+				return nil, skipped, fmt.Errorf("rule %q produced an invalid patch operation: %v", r.Name, err)
+			}
+			skipped = append(skipped, err)
+			continue
+		}
+		valid = append(valid, op)
+	}
+	return valid, skipped, nil
+}
+
+// validatePatchOperation checks that the operation parses as a valid JSONPatch operation.
+func validatePatchOperation(op patchOperation) error {
+	data, err := json.Marshal([]patchOperation{op})
+	if err != nil {
+		return fmt.Errorf("can't encode %s operation on %q: %v", op.Op, op.Path, err)
+	}
+	patch, err := jsonpatch.DecodePatch(data)
+	if err != nil {
+		return fmt.Errorf("can't decode %s operation on %q: %v", op.Op, op.Path, err)
+	}
+	return validateOperation(patch[0])
+}
+
+// validateOperation checks the kind, the paths and the value of a decoded JSONPatch operation. A null value
+// is a value, only add, replace and test operations without one are invalid.
+func validateOperation(operation jsonpatch.Operation) error {
+	kind := operation.Kind()
+	path, err := operation.Path()
+	if err != nil {
+		return fmt.Errorf("%s operation needs a path", kind)
+	}
+	switch kind {
+	case "add", "replace", "test":
+		if _, ok := operation["value"]; !ok {
+			return fmt.Errorf("%s operation on %q needs a value", kind, path)
+		}
+	case "remove":
+	case "move", "copy":
+		from, err := operation.From()
+		if err != nil {
+			return fmt.Errorf("%s operation on %q needs a from", kind, path)
+		}
+		if err := validateJSONPointer(from); err != nil {
+			return fmt.Errorf("invalid from of %s operation: %v", kind, err)
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", kind)
+	}
+	return validateJSONPointer(path)
+}
+
+// validateJSONPointer checks that pointer is a valid, non-root JSON pointer (RFC 6901).
+func validateJSONPointer(pointer string) error {
+	if !strings.HasPrefix(pointer, "/") {
+		return fmt.Errorf("path %q must start with /", pointer)
+	}
+	for i := 0; i < len(pointer); i++ {
+		if pointer[i] != '~' {
+			continue
+		}
+		if i+1 == len(pointer) || (pointer[i+1] != '0' && pointer[i+1] != '1') {
+			return fmt.Errorf("path %q contains an invalid ~ escape", pointer)
+		}
+	}
+	return nil
+}
+
+// dropProtectedLabelOps removes the operations of the rule that would change a protected label of the pod,
+// and warns about each of them. Operations replacing all labels are dropped unless they keep the protected ones.
+func (c *Config) dropProtectedLabelOps(rule *Rule, ctx *ruleContext, patch []patchOperation) []patchOperation {
+	if len(c.ProtectedLabels) == 0 {
+		return patch
+	}
+	var kept []patchOperation
+	for _, op := range patch {
+		if key, ok := c.protectedLabel(ctx.pod, op); ok {
+			ctx.warnings = append(ctx.warnings, fmt.Sprintf("rule %s tried to change the protected label %s, the change was dropped", rule.Name, key))
+			continue
+		}
+		kept = append(kept, op)
+	}
+	return kept
+}
+
+// protectedLabel returns the protected label the operation would change, if any.
+func (c *Config) protectedLabel(pod *corev1.Pod, op patchOperation) (string, bool) {
+	paths := []string{op.Path}
+	if op.Op == "move" {
+		paths = append(paths, op.From)
+	}
+	for _, path := range paths {
+		if op.Op == "test" {
+			break
+		}
+		if strings.HasPrefix(path, "/metadata/labels/") {
+			key := unescapeJSONPointer(strings.SplitN(strings.TrimPrefix(path, "/metadata/labels/"), "/", 2)[0])
+			for _, protected := range c.ProtectedLabels {
+				if key == protected {
+					return key, true
+				}
+			}
+			continue
+		}
+		if path != "/metadata/labels" && path != "/metadata" {
+			continue
+		}
+		// The operation replaces all labels, the protected ones must keep their values.
+		labels := map[string]string{}
+		if op.Op != "remove" && path == op.Path {
+			if value, ok := labelsFromValue(op.Value, path); ok {
+				labels = value
+			}
+		}
+		for _, protected := range c.ProtectedLabels {
+			existing, exists := pod.Labels[protected]
+			value, set := labels[protected]
+			if exists != set || existing != value {
+				return protected, true
+			}
+		}
+	}
+	return "", false
+}
+
+// labelsFromValue extracts the labels from the value of an operation on path, which is either the labels
+// or the metadata.
+func labelsFromValue(value interface{}, path string) (map[string]string, bool) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	var labels map[string]string
+	if path == "/metadata/labels" {
+		err = json.Unmarshal(data, &labels)
+	} else {
+		metadata := struct {
+			Labels map[string]string `json:"labels"`
+		}{}
+		err = json.Unmarshal(data, &metadata)
+		labels = metadata.Labels
+	}
+	return labels, err == nil
+}
+
+// metadataMapPatch returns the operations adding entries to a label or annotation map, creating it if absent.
+func metadataMapPatch(path string, existing, entries map[string]string) []patchOperation {
+	if len(entries) == 0 {
+		return nil
+	}
+	if existing == nil {
+		return []patchOperation{{Op: "add", Path: path, Value: entries}}
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	patch := make([]patchOperation, 0, len(keys))
+	for _, key := range keys {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("%s/%s", path, escapeJSONPointer(key)),
+			Value: entries[key],
+		})
+	}
+	return patch
+}
+
+// rebasePatch moves the operations of a pod patch below prefix, to patch a pod template embedded in another object.
+func rebasePatch(patch []patchOperation, prefix string) []patchOperation {
+	rebased := make([]patchOperation, 0, len(patch))
+	for _, op := range patch {
+		op.Path = prefix + op.Path
+		if len(op.From) > 0 {
+			op.From = prefix + op.From
+		}
+		rebased = append(rebased, op)
+	}
+	return rebased
+}
+
+// escapeJSONPointer escapes a map key for use as a JSONPatch path segment (RFC 6901).
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// unescapeJSONPointer reverses escapeJSONPointer.
+func unescapeJSONPointer(segment string) string {
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+}
+
+// applyPatch applies the JSONPatch to the pod and returns the patched pod as JSON.
+func applyPatch(pod *corev1.Pod, patch []patchOperation) ([]byte, error) {
+	original, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) == 0 {
+		return original, nil
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode patch: %v", err)
+	}
+	patched, err := decoded.Apply(original)
+	if err != nil {
+		return nil, fmt.Errorf("can't apply patch: %v", err)
+	}
+	return patched, nil
+}
+
+// patchedPod returns a copy of the pod with the JSONPatch applied.
+func patchedPod(pod *corev1.Pod, patch []patchOperation) (*corev1.Pod, error) {
+	patched, err := applyPatch(pod, patch)
+	if err != nil {
+		return nil, err
+	}
+	result := &corev1.Pod{}
+	if err := json.Unmarshal(patched, result); err != nil {
+		return nil, fmt.Errorf("can't decode patched pod: %v", err)
+	}
+	return result, nil
+}
+
+// metricNamespace returns the namespace label of the rule's metrics, other once the rule's metricNamespaces
+// cap is reached.
+func (r *Rule) metricNamespace(namespace string) string {
+	if r.namespaces == nil {
+		return namespace
+	}
+	return r.namespaces.value(namespace)
+}
+
+// logSampler rate limits the log lines of a rule.
+type logSampler struct {
+	cooldown time.Duration
+
+	mu         sync.Mutex
+	lastLogged time.Time
+	suppressed int
+}
+
+// logf logs the message to l unless the rule logged within its cooldown. The first line after a cooldown reports
+// how many lines were suppressed.
+func (r *Rule) logf(l *log.Logger, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if r.logs == nil || r.logs.cooldown == 0 {
+		l.Printf("rule %q: %s", r.Name, message)
+		return
+	}
+
+	r.logs.mu.Lock()
+	defer r.logs.mu.Unlock()
+	t := now()
+	if !r.logs.lastLogged.IsZero() && t.Sub(r.logs.lastLogged) < r.logs.cooldown {
+		r.logs.suppressed++
+		return
+	}
+	if r.logs.suppressed > 0 {
+		message = fmt.Sprintf("%s (%d similar lines suppressed)", message, r.logs.suppressed)
+	}
+	l.Printf("rule %q: %s", r.Name, message)
+	r.logs.lastLogged = t
+	r.logs.suppressed = 0
+}
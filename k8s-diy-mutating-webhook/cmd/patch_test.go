@@ -0,0 +1,978 @@
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const precedencePod = `
+metadata:
+  name: web
+  namespace: default
+spec:
+  containers:
+  - name: app
+    image: nginx
+  - name: sidecar-proxy
+    image: envoy
+`
+
+func TestComputePatchPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		check  func(t *testing.T, result *mutationResult, app, sidecar *corev1.Container)
+	}{
+		{
+			name: "specific rule first wins",
+			config: `
+rules:
+- name: sidecar-dir
+  selector:
+    containerNamePrefix: sidecar
+  workingDir:
+    path: /sidecar
+- name: all-dir
+  workingDir:
+    path: /app
+`,
+			check: func(t *testing.T, _ *mutationResult, app, sidecar *corev1.Container) {
+				if app.WorkingDir != "/app" || sidecar.WorkingDir != "/sidecar" {
+					t.Errorf("got workingDir %q for app and %q for sidecar, want /app and /sidecar", app.WorkingDir, sidecar.WorkingDir)
+				}
+			},
+		},
+		{
+			name: "specific rule last wins",
+			config: `
+rules:
+- name: all-dir
+  workingDir:
+    path: /app
+- name: sidecar-dir
+  selector:
+    containerNamePrefix: sidecar
+  workingDir:
+    path: /sidecar
+`,
+			check: func(t *testing.T, _ *mutationResult, app, sidecar *corev1.Container) {
+				if app.WorkingDir != "/app" || sidecar.WorkingDir != "/sidecar" {
+					t.Errorf("got workingDir %q for app and %q for sidecar, want /app and /sidecar", app.WorkingDir, sidecar.WorkingDir)
+				}
+			},
+		},
+		{
+			// Both rules target the sidecar, the one with more container criteria wins even though it comes first.
+			name: "rule with more criteria wins",
+			config: `
+rules:
+- name: envoy-dir
+  selector:
+    containerNamePrefix: sidecar
+    images: [envoy]
+  workingDir:
+    path: /envoy
+- name: sidecar-dir
+  selector:
+    containerNamePrefix: sidecar
+  workingDir:
+    path: /sidecar
+`,
+			check: func(t *testing.T, _ *mutationResult, app, sidecar *corev1.Container) {
+				if app.WorkingDir != "" || sidecar.WorkingDir != "/envoy" {
+					t.Errorf("got workingDir %q for app and %q for sidecar, want none and /envoy", app.WorkingDir, sidecar.WorkingDir)
+				}
+			},
+		},
+		{
+			// The seccomp rule creates the security context of the sidecar, the broader rules set other fields in it.
+			name: "broad rules set other fields of an object a specific rule added",
+			config: `
+rules:
+- name: sidecar-seccomp
+  selector:
+    containerNamePrefix: sidecar
+  seccompProfile:
+    level: container
+- name: no-escalation
+  privilegeEscalation: {}
+- name: drop-all
+  dropCapabilities: {}
+`,
+			check: func(t *testing.T, result *mutationResult, app, sidecar *corev1.Container) {
+				for _, c := range []*corev1.Container{app, sidecar} {
+					sc := c.SecurityContext
+					if sc == nil || sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+						t.Errorf("container %s: allowPrivilegeEscalation not set to false", c.Name)
+					}
+					if sc == nil || sc.Capabilities == nil || len(sc.Capabilities.Drop) != 1 || sc.Capabilities.Drop[0] != "ALL" {
+						t.Errorf("container %s: capabilities not dropped", c.Name)
+					}
+				}
+				if sidecar.SecurityContext == nil || sidecar.SecurityContext.SeccompProfile == nil {
+					t.Errorf("sidecar has no seccomp profile")
+				}
+				for _, trace := range result.trace {
+					if !trace.Applied {
+						t.Errorf("rule %s not applied: %s", trace.Rule, trace.Reason)
+					}
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, patched := mutatePod(t, testPod(t, precedencePod), testConfig(t, test.config), patchOptions{trace: true})
+			test.check(t, result, &patched.Spec.Containers[0], &patched.Spec.Containers[1])
+		})
+	}
+}
+
+func TestComputePatchPin(t *testing.T) {
+	runPatchTests(t, []patchTest{
+		{
+			name:   "pinned pod untouched",
+			config: "rules: [{name: limits, limits: {cpu: 100m}}]\n",
+			pod: `
+metadata:
+  annotations:
+    diy-webhook/pinned: "true"
+spec:
+  containers:
+  - name: app
+`,
+		},
+		{
+			name: "custom pin annotation",
+			config: `
+pin:
+  annotation: example.com/finalized
+rules: [{name: limits, limits: {cpu: 100m}}]
+`,
+			pod: `
+metadata:
+  annotations:
+    example.com/finalized: ""
+spec:
+  containers:
+  - name: app
+`,
+		},
+		{
+			name: "pin set after mutation",
+			config: `
+pin:
+  setAfterMutation: true
+rules: [{name: limits, limits: {cpu: 100m}}]
+`,
+			pod: `
+spec:
+  containers:
+  - name: app
+`,
+			want: `
+metadata:
+  annotations:
+    diy-webhook/pinned: "true"
+spec:
+  containers:
+  - name: app
+    resources:
+      limits:
+        cpu: 100m
+`,
+		},
+		{
+			name: "no pin without mutation",
+			config: `
+pin:
+  setAfterMutation: true
+rules: [{name: limits, limits: {cpu: 100m}}]
+`,
+			pod: `
+spec:
+  containers:
+  - name: app
+    resources:
+      limits:
+        cpu: "1"
+`,
+		},
+	})
+}
+
+func TestComputePatchVersionedPin(t *testing.T) {
+	webhookVersion := version
+	version = "v2.0.0"
+	t.Cleanup(func() { version = webhookVersion })
+	config := `
+pin:
+  setAfterMutation: true
+  versioned: true
+rules: [{name: limits, limits: {cpu: 100m}}]
+`
+	pinned := func(value string) string {
+		return "metadata:\n  annotations:\n    diy-webhook/pinned: " + value + "\nspec:\n  containers:\n  - name: app\n"
+	}
+	limits := "    resources:\n      limits: {cpu: 100m}\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "pin of this version set",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   pinned("mutated-by-v2.0.0") + limits,
+		},
+		{name: "pinned by this version", config: config, pod: pinned("mutated-by-v2.0.0")},
+		{
+			name:   "pinned by an older version mutated again",
+			config: config,
+			pod:    pinned("mutated-by-v1.4.0"),
+			want:   pinned("mutated-by-v2.0.0") + limits,
+		},
+		{name: "pinned by hand", config: config, pod: pinned(`"true"`)},
+		{
+			name:   "unversioned pin of an older version",
+			config: "pin: {setAfterMutation: true}\nrules: [{name: limits, limits: {cpu: 100m}}]\n",
+			pod:    pinned("mutated-by-v1.4.0"),
+		},
+	})
+}
+
+func TestComputePatchVersionedPinWithoutVersion(t *testing.T) {
+	webhookVersion, webhookCommit := version, commit
+	// Like a ko build, which sets no version.
+	version, commit = "dev", "4f2c9e1"
+	t.Cleanup(func() { version, commit = webhookVersion, webhookCommit })
+	if marker := pinMarker(); marker != "mutated-by-4f2c9e1" {
+		t.Errorf("got pin %q, want the commit", marker)
+	}
+	config := "pin: {setAfterMutation: true, versioned: true}\nrules: [{name: limits, limits: {cpu: 100m}}]\n"
+	pinned := func(value string) string {
+		return "metadata:\n  annotations:\n    diy-webhook/pinned: " + value + "\nspec:\n  containers:\n  - name: app\n"
+	}
+	runPatchTests(t, []patchTest{
+		{name: "pinned by this build", config: config, pod: pinned("mutated-by-4f2c9e1")},
+		{
+			name:   "pinned by another build mutated again",
+			config: config,
+			pod:    pinned("mutated-by-dev"),
+			want:   pinned("mutated-by-4f2c9e1") + "    resources:\n      limits: {cpu: 100m}\n",
+		},
+	})
+}
+
+func TestComputePatchInvalidOperations(t *testing.T) {
+	for _, onError := range []string{OnErrorFail, OnErrorSkip} {
+		t.Run(onError, func(t *testing.T) {
+			resetMetrics(t)
+			captureLogs(t)
+			config := testConfig(t, `
+rules:
+- name: raw
+  onError: `+onError+`
+  rawPatch:
+    operations:
+    - {op: add, path: /metadata/labels, value: {team: web}}
+`)
+			// Config loading rejects malformed operations, so break one behind its back.
+			rule := config.Rules[0].RawPatch
+			rule.Operations = append(rule.Operations, patchOperation{Op: "add", Path: "metadata/annotations"})
+
+			pod := testPod(t, cachedPod)
+			result, err := computePatch(pod, config, patchOptions{})
+			if count := testutil.ToFloat64(invalidPatchOperations.WithLabelValues("raw")); count != 1 {
+				t.Errorf("counted %v invalid operations, want 1", count)
+			}
+			if onError == OnErrorFail {
+				if err == nil || !strings.Contains(err.Error(), "invalid patch operation") {
+					t.Errorf("got error %v, want an invalid patch operation", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := patchedPod(pod, result.patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patched.Labels["team"] != "web" || len(patched.Annotations) > 0 {
+				t.Errorf("got labels %v and annotations %v, want only the valid operation applied", patched.Labels, patched.Annotations)
+			}
+		})
+	}
+	runConfigErrorTests(t, []configErrorTest{
+		{
+			name:   "operation without value",
+			config: "rules: [{name: raw, rawPatch: {operations: [{op: add, path: /metadata/labels}]}}]\n",
+			err:    `operation 0: add operation on "/metadata/labels" needs a value`,
+		},
+		{
+			name:   "unknown operation",
+			config: "rules: [{name: raw, rawPatch: {operations: [{op: merge, path: /metadata/labels, value: {}}]}}]\n",
+			err:    `unknown operation "merge"`,
+		},
+		{
+			name:   "misspelled value",
+			config: "rules: [{name: raw, rawPatch: {operations: [{op: add, path: /metadata/labels, valeu: {}}]}}]\n",
+			err:    `unknown field "valeu"`,
+		},
+		{
+			name:   "relative path",
+			config: "rules: [{name: raw, rawPatch: {operations: [{op: remove, path: metadata/labels}]}}]\n",
+			err:    "must start with /",
+		},
+		{
+			name:   "invalid escape",
+			config: "rules: [{name: raw, rawPatch: {operations: [{op: remove, path: /metadata/labels/a~2b}]}}]\n",
+			err:    "invalid ~ escape",
+		},
+	})
+}
+
+func TestComputePatchNullValue(t *testing.T) {
+	config := testConfig(t, "rules: [{name: raw, rawPatch: {operations: [{op: add, path: /spec/nodeSelector, value: null}]}}]\n")
+	result, err := computePatch(testPod(t, cachedPod), config, patchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(result.patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"op":"add","path":"/spec/nodeSelector","value":null}]`; string(data) != want {
+		t.Errorf("got patch %s, want %s", data, want)
+	}
+	if _, err := jsonpatch.DecodePatch(data); err != nil {
+		t.Errorf("got error %v, want a valid JSONPatch", err)
+	}
+}
+
+func TestComputePatchManagedBy(t *testing.T) {
+	config := `
+managedBy:
+  enabled: true
+rules: [{name: limits, limits: {cpu: 100m}}]
+`
+	limits := `
+spec:
+  containers:
+  - name: app
+    resources:
+      limits:
+        cpu: 100m
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "label map created",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  labels:\n    app.kubernetes.io/managed-by: diy-webhook\n" + limits,
+		},
+		{
+			name:   "label added to the map",
+			config: config,
+			pod:    "metadata:\n  labels:\n    app: web\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  labels:\n    app: web\n    app.kubernetes.io/managed-by: diy-webhook\n" + limits,
+		},
+		{
+			name:   "existing label kept",
+			config: config,
+			pod:    "metadata:\n  labels:\n    app.kubernetes.io/managed-by: helm\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  labels:\n    app.kubernetes.io/managed-by: helm\n" + limits,
+		},
+		{
+			name: "custom key and value",
+			config: `
+managedBy:
+  enabled: true
+  key: example.com/owner
+  value: platform
+rules: [{name: limits, limits: {cpu: 100m}}]
+`,
+			pod:  "spec:\n  containers:\n  - name: app\n",
+			want: "metadata:\n  labels:\n    example.com/owner: platform\n" + limits,
+		},
+		{
+			name:   "unmutated pod not labeled",
+			config: config,
+			pod:    strings.TrimPrefix(limits, "\n"),
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid key", config: "managedBy: {enabled: true, key: 'a b'}\n", err: `invalid managedBy key "a b"`},
+		{name: "invalid value", config: "managedBy: {enabled: true, value: 'a b'}\n", err: `invalid managedBy value "a b"`},
+	})
+}
+
+func TestComputePatchNamespaceRules(t *testing.T) {
+	config := `
+namespaceRules:
+  restricted: [pull-policy]
+rules:
+- name: pull-policy
+  imagePullPolicy: {default: IfNotPresent}
+- name: limits
+  limits: {cpu: 100m}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "restricted namespace",
+			config: config,
+			pod:    "metadata:\n  namespace: restricted\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  namespace: restricted\nspec:\n  containers:\n  - name: app\n    imagePullPolicy: IfNotPresent\n",
+		},
+		{
+			name:   "unlisted namespace gets all rules",
+			config: config,
+			pod:    "metadata:\n  namespace: default\nspec:\n  containers:\n  - name: app\n",
+			want: `
+metadata:
+  namespace: default
+spec:
+  containers:
+  - name: app
+    imagePullPolicy: IfNotPresent
+    resources:
+      limits:
+        cpu: 100m
+`,
+		},
+		{
+			name:   "namespace without rules",
+			config: "namespaceRules: {kube-system: []}\nrules: [{name: limits, limits: {cpu: 100m}}]\n",
+			pod:    "metadata:\n  namespace: kube-system\nspec:\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{
+			name:   "unknown rule",
+			config: "namespaceRules: {restricted: [limts]}\nrules: [{name: limits, limits: {cpu: 100m}}]\n",
+			err:    `namespaceRules of "restricted": unknown rule "limts"`,
+		},
+	})
+}
+
+func TestComputePatchVerifiesPatch(t *testing.T) {
+	// The operations are well-formed, but the second one removes a label the pod doesn't have.
+	config := func(onError string) string {
+		return `
+rules:
+- name: raw
+  onError: ` + onError + `
+  rawPatch:
+    operations:
+    - {op: add, path: /metadata/labels, value: {team: web}}
+    - {op: remove, path: /metadata/labels/tier}
+- name: pull-policy
+  imagePullPolicy: {default: IfNotPresent}
+`
+	}
+	pod := "spec:\n  containers:\n  - name: app\n"
+
+	if _, err := computePatch(testPod(t, pod), testConfig(t, config(OnErrorFail)), patchOptions{}); err == nil || !strings.Contains(err.Error(), `rule "raw"`) {
+		t.Errorf("got error %v, want the raw rule failing", err)
+	}
+
+	logs := captureLogs(t)
+	runPatchTests(t, []patchTest{
+		{
+			name:   "rule skipped as a whole",
+			config: config(OnErrorSkip),
+			pod:    pod,
+			want:   "spec:\n  containers:\n  - name: app\n    imagePullPolicy: IfNotPresent\n",
+		},
+	})
+	if !strings.Contains(logs.String(), "skipping patch that doesn't apply") {
+		t.Errorf("got logs %q, want the skipped patch logged", logs)
+	}
+}
+
+func TestComputePatchProtectedOwners(t *testing.T) {
+	config := `
+protectedOwners:
+- kind: Prometheus
+- kind: ReplicaSet
+  name: operator-7d9f
+rules: [{name: limits, limits: {cpu: 100m}}]
+`
+	owned := func(kind, name string) string {
+		return `
+metadata:
+  ownerReferences:
+  - {apiVersion: v1, kind: ` + kind + `, name: ` + name + `, uid: "1"}
+spec:
+  containers:
+  - name: app
+`
+	}
+	limited := func(pod string) string {
+		return pod + "    resources:\n      limits:\n        cpu: 100m\n"
+	}
+	runPatchTests(t, []patchTest{
+		{name: "any owner of the kind", config: config, pod: owned("Prometheus", "k8s")},
+		{name: "owner with the name", config: config, pod: owned("ReplicaSet", "operator-7d9f")},
+		{name: "owner with another name", config: config, pod: owned("ReplicaSet", "web-5c8b"), want: limited(owned("ReplicaSet", "web-5c8b"))},
+		{name: "owner of another kind", config: config, pod: owned("Job", "operator-7d9f"), want: limited(owned("Job", "operator-7d9f"))},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "owner without kind", config: "protectedOwners: [{name: operator}]\n", err: "protected owner 0 has no kind"},
+	})
+}
+
+func TestComputePatchTimestamp(t *testing.T) {
+	clock := now
+	now = func() time.Time { return time.Date(2023, 4, 5, 8, 30, 0, 0, time.FixedZone("CEST", 2*60*60)) }
+	t.Cleanup(func() { now = clock })
+
+	limits := "spec:\n  containers:\n  - name: app\n    resources:\n      limits:\n        cpu: 100m\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "rfc3339 in UTC",
+			config: "timestamp: {enabled: true}\nrules: [{name: limits, limits: {cpu: 100m}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  annotations:\n    diy-webhook/mutated-at: \"2023-04-05T06:30:00Z\"\n" + limits,
+		},
+		{
+			name:   "unix",
+			config: "timestamp: {enabled: true, format: unix, annotation: example.com/mutated}\nrules: [{name: limits, limits: {cpu: 100m}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  annotations:\n    example.com/mutated: \"1680676200\"\n" + limits,
+		},
+		{
+			name:   "unmutated pod",
+			config: "timestamp: {enabled: true}\nrules: [{name: limits, limits: {cpu: 100m}}]\n",
+			pod:    limits,
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid format", config: "timestamp: {enabled: true, format: iso}\n", err: `invalid timestamp format "iso"`},
+	})
+}
+
+func TestComputePatchLogCooldown(t *testing.T) {
+	resetMetrics(t)
+	logs := captureLogs(t)
+	clock, current := now, time.Date(2023, 4, 5, 8, 30, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = clock })
+
+	config := testConfig(t, "rules: [{name: service-account, logCooldown: 1m, defaultServiceAccountWarning: {}}]\n")
+	for i := 0; i < 5; i++ {
+		mutatePod(t, testPod(t, cachedPod), config, patchOptions{})
+		current = current.Add(time.Second)
+	}
+	if n := strings.Count(logs.String(), "default service account"); n != 1 {
+		t.Errorf("logged the warning %d times within the cooldown, want once", n)
+	}
+
+	current = current.Add(time.Minute)
+	mutatePod(t, testPod(t, cachedPod), config, patchOptions{})
+	if !strings.Contains(logs.String(), "(4 similar lines suppressed)") {
+		t.Errorf("got logs %q, want the suppressed lines reported after the cooldown", logs)
+	}
+	if count := testutil.ToFloat64(ruleWarnings.WithLabelValues("service-account", "default")); count != 6 {
+		t.Errorf("counted %v warnings, want every one of 6", count)
+	}
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "negative cooldown", config: "rules: [{name: service-account, logCooldown: -1m, defaultServiceAccountWarning: {}}]\n", err: "invalid logCooldown -1m0s"},
+	})
+}
+
+func TestComputePatchMaxOperations(t *testing.T) {
+	captureLogs(t)
+	config := func(onError string) string {
+		return `
+rules:
+- name: env
+  maxOperations: 2
+  onError: ` + onError + `
+  env:
+    variables: [{name: A, value: "1"}]
+- name: pull-policy
+  imagePullPolicy: {default: IfNotPresent}
+`
+	}
+	pod := "spec:\n  containers:\n  - name: a\n  - name: b\n  - name: c\n"
+
+	_, err := computePatch(testPod(t, pod), testConfig(t, config(OnErrorFail)), patchOptions{})
+	if want := `rule "env" produced 3 patch operations, more than its maxOperations 2`; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+	runPatchTests(t, []patchTest{
+		{
+			name:   "rule skipped",
+			config: config(OnErrorSkip),
+			pod:    pod,
+			want:   "spec:\n  containers:\n  - name: a\n    imagePullPolicy: IfNotPresent\n  - name: b\n    imagePullPolicy: IfNotPresent\n  - name: c\n    imagePullPolicy: IfNotPresent\n",
+		},
+		{
+			name:   "rule within its cap",
+			config: config(OnErrorFail),
+			pod:    "spec:\n  containers:\n  - name: a\n",
+			want:   "spec:\n  containers:\n  - name: a\n    imagePullPolicy: IfNotPresent\n    env:\n    - {name: A, value: \"1\"}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "negative cap", config: "rules: [{name: env, maxOperations: -1, env: {variables: [{name: A}]}}]\n", err: "invalid maxOperations -1"},
+	})
+}
+
+func TestComputePatchProtectedLabels(t *testing.T) {
+	config := func(operations string) string {
+		return "rules: [{name: raw, rawPatch: {operations: [" + operations + "]}}]\n"
+	}
+	pod := "metadata:\n  labels: {app: web, pod-template-hash: abc}\nspec:\n  containers:\n  - name: app\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:     "protected label dropped",
+			config:   config("{op: replace, path: /metadata/labels/pod-template-hash, value: def}, {op: add, path: /metadata/labels/team, value: web}"),
+			pod:      pod,
+			want:     "metadata:\n  labels: {app: web, pod-template-hash: abc, team: web}\nspec:\n  containers:\n  - name: app\n",
+			warnings: []string{"rule raw tried to change the protected label pod-template-hash"},
+		},
+		{
+			name:     "protected label removed",
+			config:   config("{op: remove, path: /metadata/labels/controller-revision-hash}"),
+			pod:      "metadata:\n  labels: {controller-revision-hash: abc}\nspec:\n  containers:\n  - name: app\n",
+			warnings: []string{"protected label controller-revision-hash"},
+		},
+		{
+			name:     "labels replaced without the protected one",
+			config:   config("{op: replace, path: /metadata/labels, value: {app: api}}"),
+			pod:      pod,
+			warnings: []string{"protected label pod-template-hash"},
+		},
+		{
+			name:   "labels replaced keeping the protected one",
+			config: config("{op: replace, path: /metadata/labels, value: {app: api, pod-template-hash: abc}}"),
+			pod:    pod,
+			want:   "metadata:\n  labels: {app: api, pod-template-hash: abc}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:     "configured protected labels",
+			config:   "protectedLabels: [app]\n" + config("{op: replace, path: /metadata/labels/pod-template-hash, value: def}, {op: replace, path: /metadata/labels/app, value: api}"),
+			pod:      pod,
+			want:     "metadata:\n  labels: {app: web, pod-template-hash: def}\nspec:\n  containers:\n  - name: app\n",
+			warnings: []string{"protected label app"},
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid key", config: "protectedLabels: [-hash]\n", err: `invalid protected label "-hash"`},
+	})
+}
+
+func TestComputePatchDryRunRule(t *testing.T) {
+	resetMetrics(t)
+	logs := captureLogs(t)
+	runPatchTests(t, []patchTest{
+		{
+			name: "dry-run rule left out",
+			config: `
+rules:
+- name: pull-policy
+  dryRun: true
+  imagePullPolicy: {default: IfNotPresent}
+- name: service-account
+  dryRun: true
+  defaultServiceAccountWarning: {}
+- name: limits
+  limits: {cpu: 100m}
+`,
+			pod:  "spec:\n  containers:\n  - name: a\n  - name: b\n",
+			want: "spec:\n  containers:\n  - name: a\n    resources:\n      limits: {cpu: 100m}\n  - name: b\n    resources:\n      limits: {cpu: 100m}\n",
+		},
+	})
+	if operations := testutil.ToFloat64(dryRunOperations.WithLabelValues("pull-policy")); operations != 2 {
+		t.Errorf("counted %v dry-run operations, want 2", operations)
+	}
+	if !strings.Contains(logs.String(), `dry run, not applying patch [{"op":"add","path":"/spec/containers/0/imagePullPolicy","value":"IfNotPresent"}`) {
+		t.Errorf("got logs %q, want the dry-run patch logged", logs)
+	}
+	if !strings.Contains(logs.String(), "warning: pod uses the default service account") {
+		t.Errorf("got logs %q, want the dry-run warning logged", logs)
+	}
+}
+
+func TestComputePatchLastRuleWins(t *testing.T) {
+	config := `
+rules:
+- name: default-limits
+  limits: {cpu: 100m}
+- name: sidecar-limits
+  selector:
+    containerNamePrefix: sidecar
+  limits: {cpu: 50m}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "later rule overwrites an earlier one",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  - name: sidecar-proxy\n",
+			want: `
+spec:
+  containers:
+  - name: app
+    resources:
+      limits: {cpu: 100m}
+  - name: sidecar-proxy
+    resources:
+      limits: {cpu: 50m}
+`,
+		},
+		{
+			name:   "submitted limits kept",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: sidecar-proxy\n    resources:\n      limits: {cpu: 1}\n",
+		},
+	})
+
+	result, _ := mutatePod(t, testPod(t, "spec:\n  containers:\n  - name: app\n  - name: sidecar-proxy\n"), testConfig(t, config), patchOptions{})
+	paths := map[string]int{}
+	for _, op := range result.patch {
+		paths[op.Path]++
+	}
+	if len(result.patch) != 2 || paths["/spec/containers/1/resources/limits"] != 1 {
+		t.Errorf("got patch %v, want a single write per path", result.patch)
+	}
+}
+
+func TestComputePatchWindowsPods(t *testing.T) {
+	config := `
+rules:
+- name: no-escalation
+  privilegeEscalation: {}
+- name: windows-pull-policy
+  selector: {os: windows}
+  imagePullPolicy: {default: IfNotPresent}
+- name: limits
+  limits: {cpu: 100m}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "windows pod by spec.os",
+			config: config,
+			pod:    "spec:\n  os: {name: windows}\n  containers:\n  - name: app\n",
+			want:   "spec:\n  os: {name: windows}\n  containers:\n  - name: app\n    imagePullPolicy: IfNotPresent\n    resources:\n      limits: {cpu: 100m}\n",
+		},
+		{
+			name:   "windows pod by node selector",
+			config: config,
+			pod:    "spec:\n  nodeSelector: {kubernetes.io/os: windows}\n  containers:\n  - name: app\n",
+			want:   "spec:\n  nodeSelector: {kubernetes.io/os: windows}\n  containers:\n  - name: app\n    imagePullPolicy: IfNotPresent\n    resources:\n      limits: {cpu: 100m}\n",
+		},
+		{
+			name:   "linux pod",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    securityContext: {allowPrivilegeEscalation: false}\n    resources:\n      limits: {cpu: 100m}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "linux-only rule for windows", config: "rules: [{name: seccomp, selector: {os: windows}, seccompProfile: {}}]\n", err: "sets Linux-only fields"},
+		{name: "unknown os", config: "rules: [{name: limits, selector: {os: darwin}, limits: {cpu: 100m}}]\n", err: `invalid os "darwin"`},
+	})
+}
+
+func TestDedupeOperations(t *testing.T) {
+	label := patchOperation{Op: "add", Path: "/metadata/labels/team", Value: "web"}
+	test := patchOperation{Op: "test", Path: "/metadata/name", Value: "web"}
+	for _, tc := range []struct {
+		name  string
+		patch []patchOperation
+		want  []patchOperation
+	}{
+		{
+			name:  "identical operations",
+			patch: []patchOperation{label, test, label, test},
+			want:  []patchOperation{label, test},
+		},
+		{
+			name: "same path with other values",
+			patch: []patchOperation{
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{"a": "1"}},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{"a": "2"}},
+			},
+			want: []patchOperation{
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{"a": "1"}},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{"a": "2"}},
+			},
+		},
+		{
+			name: "same path changed in between",
+			patch: []patchOperation{
+				{Op: "add", Path: "/metadata/labels/team", Value: "web"},
+				{Op: "remove", Path: "/metadata/labels/team"},
+				{Op: "add", Path: "/metadata/labels/team", Value: "web"},
+				{Op: "add", Path: "/spec/containers/0/workingDir", Value: "/app"},
+				{Op: "add", Path: "/spec/containers/0", Value: map[string]string{"name": "init"}},
+				{Op: "add", Path: "/spec/containers/0/workingDir", Value: "/app"},
+				{Op: "add", Path: "/metadata/annotations/a", Value: "1"},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}},
+				{Op: "add", Path: "/metadata/annotations/a", Value: "1"},
+			},
+			want: []patchOperation{
+				{Op: "add", Path: "/metadata/labels/team", Value: "web"},
+				{Op: "remove", Path: "/metadata/labels/team"},
+				{Op: "add", Path: "/metadata/labels/team", Value: "web"},
+				{Op: "add", Path: "/spec/containers/0/workingDir", Value: "/app"},
+				{Op: "add", Path: "/spec/containers/0", Value: map[string]string{"name": "init"}},
+				{Op: "add", Path: "/spec/containers/0/workingDir", Value: "/app"},
+				{Op: "add", Path: "/metadata/annotations/a", Value: "1"},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}},
+				{Op: "add", Path: "/metadata/annotations/a", Value: "1"},
+			},
+		},
+		{
+			name: "other paths changed in between",
+			patch: []patchOperation{
+				{Op: "add", Path: "/metadata/labels/team", Value: "web"},
+				{Op: "remove", Path: "/metadata/labels/tier"},
+				{Op: "add", Path: "/metadata/labels/team", Value: "web"},
+			},
+			want: []patchOperation{
+				{Op: "add", Path: "/metadata/labels/team", Value: "web"},
+				{Op: "remove", Path: "/metadata/labels/tier"},
+			},
+		},
+		{
+			name: "array positions kept",
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/tolerations/-", Value: "a"},
+				{Op: "add", Path: "/spec/tolerations/-", Value: "a"},
+				{Op: "remove", Path: "/spec/volumes/0"},
+				{Op: "remove", Path: "/spec/volumes/0"},
+			},
+			want: []patchOperation{
+				{Op: "add", Path: "/spec/tolerations/-", Value: "a"},
+				{Op: "add", Path: "/spec/tolerations/-", Value: "a"},
+				{Op: "remove", Path: "/spec/volumes/0"},
+				{Op: "remove", Path: "/spec/volumes/0"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := (dedupeOperations{}).normalize(tc.patch); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// dropLabels is a normalizer removing every label operation, to tell that computePatch runs the normalizers.
+type dropLabels struct{}
+
+func (dropLabels) normalize(patch []patchOperation) []patchOperation {
+	var kept []patchOperation
+	for _, op := range patch {
+		if !strings.HasPrefix(op.Path, "/metadata/labels") {
+			kept = append(kept, op)
+		}
+	}
+	return kept
+}
+
+func TestComputePatchRunsNormalizers(t *testing.T) {
+	normalizers := patchNormalizers
+	patchNormalizers = append([]patchNormalizer{dropLabels{}}, normalizers...)
+	t.Cleanup(func() { patchNormalizers = normalizers })
+	runPatchTests(t, []patchTest{
+		{
+			name:   "label operations dropped",
+			config: "rules: [{name: raw, rawPatch: {operations: [{op: add, path: /metadata/labels, value: {team: web}}]}}, {name: limits, limits: {cpu: 100m}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {cpu: 100m}\n",
+		},
+	})
+}
+
+func TestComputePatchMaxContainers(t *testing.T) {
+	captureLogs(t)
+	config := `
+maxContainers: 2
+rules:
+- name: sidecar
+  rawPatch:
+    operations:
+    - {op: add, path: /spec/containers/-, value: {name: proxy, image: envoy}}
+- name: working-dir
+  workingDir: {path: /app}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:     "injection exceeds the max",
+			config:   config,
+			pod:      "spec:\n  containers:\n  - name: app\n  - name: logs\n",
+			want:     "spec:\n  containers:\n  - name: app\n    workingDir: /app\n  - name: logs\n    workingDir: /app\n",
+			warnings: []string{"rule sidecar skipped, it would grow the pod to 3 containers, more than maxContainers 2"},
+		},
+		{
+			name:   "injection within the max",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    workingDir: /app\n  - {name: proxy, image: envoy, workingDir: /app}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "negative max", config: "maxContainers: -1\nrules: []\n", err: "invalid maxContainers -1"},
+	})
+}
+
+func TestComputePatchAppliedRules(t *testing.T) {
+	config := `
+appliedRules:
+  enabled: true
+rules:
+- name: limits
+  limits: {cpu: 100m}
+- name: working-dir
+  workingDir: {path: /app}
+- name: dry-run
+  dryRun: true
+  emptyDirSizeLimit: {}
+- name: pull-policy
+  imagePullPolicy: {default: Always}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "fired rules listed",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  volumes:\n  - name: scratch\n    emptyDir: {}\n",
+			want:   "metadata:\n  annotations:\n    diy-webhook/applied-rules: limits,working-dir,pull-policy\nspec:\n  containers:\n  - name: app\n    workingDir: /app\n    imagePullPolicy: Always\n    resources:\n      limits: {cpu: 100m}\n  volumes:\n  - name: scratch\n    emptyDir: {}\n",
+		},
+		{
+			name:   "rules without changes left out",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n    workingDir: /src\n    resources:\n      limits: {cpu: 1}\n",
+			want:   "metadata:\n  annotations:\n    diy-webhook/applied-rules: pull-policy\nspec:\n  containers:\n  - name: app\n    workingDir: /src\n    imagePullPolicy: Always\n    resources:\n      limits: {cpu: 1}\n",
+		},
+		{
+			name:   "no rule fired",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n    workingDir: /src\n    imagePullPolicy: IfNotPresent\n    resources:\n      limits: {cpu: 1}\n",
+		},
+		{
+			name:   "custom annotation",
+			config: "appliedRules: {enabled: true, annotation: example.com/rules}\nrules: [{name: limits, limits: {cpu: 100m}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  annotations:\n    example.com/rules: limits\nspec:\n  containers:\n  - name: app\n    resources:\n      limits: {cpu: 100m}\n",
+		},
+		{
+			name:   "disabled by default",
+			config: "rules: [{name: limits, limits: {cpu: 100m}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {cpu: 100m}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid annotation", config: "appliedRules: {enabled: true, annotation: 'a b'}\n", err: `invalid appliedRules annotation "a b"`},
+	})
+}
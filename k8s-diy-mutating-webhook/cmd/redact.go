@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// redactedValue replaces the values of sensitive env vars in logs and debug output.
+const redactedValue = "********"
+
+// envRedactor masks the values of sensitive env vars in the JSON written to logs and debug responses. A
+// variable is sensitive if its name matches one of the sensitiveEnv patterns of the config, or if the pod
+// takes a variable of the same name from a secret, so a literal copy of the secret in another container is
+// masked too.
+type envRedactor struct {
+	patterns    []*regexp.Regexp
+	secretNames map[string]bool
+	// pod names the variables of operations on a single value, like /spec/containers/0/env/1/value.
+	pod *corev1.Pod
+}
+
+// envRedactor returns the redactor for the env vars of the pod.
+func (c *Config) envRedactor(pod *corev1.Pod) *envRedactor {
+	r := &envRedactor{patterns: c.sensitiveEnv, secretNames: map[string]bool{}, pod: pod}
+	addSecretNames := func(env []corev1.EnvVar) {
+		for _, variable := range env {
+			if variable.ValueFrom != nil && variable.ValueFrom.SecretKeyRef != nil {
+				r.secretNames[variable.Name] = true
+			}
+		}
+	}
+	for _, container := range pod.Spec.InitContainers {
+		addSecretNames(container.Env)
+	}
+	for _, container := range pod.Spec.Containers {
+		addSecretNames(container.Env)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		addSecretNames(container.Env)
+	}
+	return r
+}
+
+func (r *envRedactor) sensitive(name string) bool {
+	if r.secretNames[name] {
+		return true
+	}
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact masks the sensitive values in the env lists found in the decoded JSON value v, in place.
+func (r *envRedactor) redact(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if list, ok := value.([]interface{}); ok && key == "env" {
+				for _, item := range list {
+					r.redactVariable(item)
+				}
+				continue
+			}
+			r.redact(value)
+		}
+	case []interface{}:
+		for _, item := range v {
+			r.redact(item)
+		}
+	}
+}
+
+func (r *envRedactor) redactVariable(v interface{}) {
+	variable, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	name, _ := variable["name"].(string)
+	if _, ok := variable["value"]; ok && r.sensitive(name) {
+		variable["value"] = redactedValue
+	}
+}
+
+// variableName returns the name of the variable at the index of the env list of the container at the index of
+// the pod's containers field, empty if there is none.
+func (r *envRedactor) variableName(field, container, variable string) string {
+	var containers []corev1.Container
+	switch field {
+	case "initContainers":
+		containers = r.pod.Spec.InitContainers
+	case "containers":
+		containers = r.pod.Spec.Containers
+	case "ephemeralContainers":
+		for _, ephemeral := range r.pod.Spec.EphemeralContainers {
+			containers = append(containers, corev1.Container{Env: ephemeral.Env})
+		}
+	}
+	i, err := strconv.Atoi(container)
+	if err != nil || i < 0 || i >= len(containers) {
+		return ""
+	}
+	j, err := strconv.Atoi(variable)
+	if err != nil || j < 0 || j >= len(containers[i].Env) {
+		return ""
+	}
+	return containers[i].Env[j].Name
+}
+
+// redactJSON returns the JSON document with the sensitive env values masked.
+func (r *envRedactor) redactJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	r.redact(v)
+	return json.Marshal(v)
+}
+
+// redactPatch returns the patch as JSON with the sensitive env values masked. An operation on an env list
+// carries either the whole list, a single variable or the value of a variable, told apart by the path. The
+// name of a variable whose value alone is set is taken from the pod.
+func (r *envRedactor) redactPatch(patch []patchOperation) ([]byte, error) {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(data, &operations); err != nil {
+		return nil, err
+	}
+	for _, operation := range operations {
+		path, _ := operation["path"].(string)
+		segments := strings.Split(path, "/")
+		switch {
+		case segments[len(segments)-1] == "env":
+			r.redact(map[string]interface{}{"env": operation["value"]})
+		case len(segments) > 1 && segments[len(segments)-2] == "env":
+			r.redactVariable(operation["value"])
+		case len(segments) > 4 && segments[len(segments)-1] == "value" && segments[len(segments)-3] == "env":
+			name := r.variableName(segments[len(segments)-5], segments[len(segments)-4], segments[len(segments)-2])
+			if _, ok := operation["value"]; ok && r.sensitive(name) {
+				operation["value"] = redactedValue
+			}
+		default:
+			r.redact(operation["value"])
+		}
+	}
+	return json.Marshal(operations)
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedactPatch(t *testing.T) {
+	pod := testPod(t, `
+spec:
+  containers:
+  - name: app
+    env:
+    - name: DATABASE_URL
+      valueFrom:
+        secretKeyRef: {name: db, key: url}
+    - {name: LOG_LEVEL, value: info}
+`)
+	for _, test := range []struct {
+		name   string
+		config string
+		patch  []patchOperation
+		want   string
+	}{
+		{
+			name:   "env list",
+			config: "rules: []\n",
+			patch: []patchOperation{{Op: "add", Path: "/spec/containers/0/env", Value: []map[string]string{
+				{"name": "DB_PASSWORD", "value": "hunter2"},
+				{"name": "API_TOKEN", "value": "abc"},
+				{"name": "LOG_LEVEL", "value": "debug"},
+			}}},
+			want: `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"DB_PASSWORD","value":"********"},{"name":"API_TOKEN","value":"********"},{"name":"LOG_LEVEL","value":"debug"}]}]`,
+		},
+		{
+			name:   "single variable",
+			config: "rules: []\n",
+			patch:  []patchOperation{{Op: "add", Path: "/spec/containers/0/env/-", Value: map[string]string{"name": "SIGNING_KEY", "value": "abc"}}},
+			want:   `[{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"SIGNING_KEY","value":"********"}}]`,
+		},
+		{
+			name:   "nested env",
+			config: "rules: []\n",
+			patch: []patchOperation{{Op: "add", Path: "/spec/containers/-", Value: map[string]interface{}{
+				"name": "sidecar",
+				"env":  []map[string]string{{"name": "CLIENT_SECRET", "value": "abc"}, {"name": "PORT", "value": "80"}},
+			}}},
+			want: `[{"op":"add","path":"/spec/containers/-","value":{"env":[{"name":"CLIENT_SECRET","value":"********"},{"name":"PORT","value":"80"}],"name":"sidecar"}}]`,
+		},
+		{
+			name:   "copy of a secret",
+			config: "rules: []\n",
+			patch:  []patchOperation{{Op: "add", Path: "/spec/containers/1/env/-", Value: map[string]string{"name": "DATABASE_URL", "value": "postgres://"}}},
+			want:   `[{"op":"add","path":"/spec/containers/1/env/-","value":{"name":"DATABASE_URL","value":"********"}}]`,
+		},
+		{
+			name:   "single value",
+			config: "rules: []\n",
+			patch: []patchOperation{
+				{Op: "replace", Path: "/spec/containers/0/env/0/value", Value: "postgres://"},
+				{Op: "replace", Path: "/spec/containers/0/env/1/value", Value: "debug"},
+			},
+			want: `[{"op":"replace","path":"/spec/containers/0/env/0/value","value":"********"},{"op":"replace","path":"/spec/containers/0/env/1/value","value":"debug"}]`,
+		},
+		{
+			name:   "custom patterns",
+			config: "sensitiveEnv: ['MY_*']\nrules: []\n",
+			patch: []patchOperation{{Op: "add", Path: "/spec/containers/0/env", Value: []map[string]string{
+				{"name": "MY_VALUE", "value": "abc"},
+				{"name": "DB_PASSWORD", "value": "hunter2"},
+			}}},
+			want: `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"MY_VALUE","value":"********"},{"name":"DB_PASSWORD","value":"hunter2"}]}]`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := testConfig(t, test.config).envRedactor(pod).redactPatch(test.patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactConfigErrors(t *testing.T) {
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "empty pattern", config: "sensitiveEnv: ['']\nrules: []\n", err: "empty sensitiveEnv pattern"},
+	})
+}
+
+func TestComputePatchDryRunRedactsEnv(t *testing.T) {
+	resetMetrics(t)
+	logs := captureLogs(t)
+	config := testConfig(t, `
+rules:
+- name: env
+  dryRun: true
+  env:
+    variables:
+    - {name: DB_PASSWORD, value: hunter2}
+    - {name: LOG_LEVEL, value: debug}
+`)
+	mutatePod(t, testPod(t, cachedPod), config, patchOptions{})
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("got logs %q, want the password masked", logs)
+	}
+	if !strings.Contains(logs.String(), `{"name":"DB_PASSWORD","value":"********"}`) {
+		t.Errorf("got logs %q, want the masked variable logged", logs)
+	}
+	if !strings.Contains(logs.String(), `{"name":"LOG_LEVEL","value":"debug"}`) {
+		t.Errorf("got logs %q, want the other variables logged as they are", logs)
+	}
+}
+
+func TestDebugPatchRedactsEnv(t *testing.T) {
+	wh := testWebhook(t, "rules: [{name: env, env: {variables: [{name: API_TOKEN, value: abc123}]}}]\n")
+	response := debugPatch(t, wh, cachedPod+"    env:\n    - {name: DB_PASSWORD, value: hunter2}\n")
+	for name, data := range map[string]json.RawMessage{"patch": response.Patch, "pod": response.Pod} {
+		if strings.Contains(string(data), "abc123") || strings.Contains(string(data), "hunter2") {
+			t.Errorf("got %s %s, want the sensitive values masked", name, data)
+		}
+	}
+	if !strings.Contains(string(response.Pod), `{"name":"API_TOKEN","value":"********"}`) {
+		t.Errorf("got pod %s, want the masked variable", response.Pod)
+	}
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// currentConfig returns the config in use, which changes when the config is reloaded.
+func (wh *mutatingWebhook) currentConfig() *Config {
+	wh.configMu.RLock()
+	defer wh.configMu.RUnlock()
+	return wh.config
+}
+
+// configReloadBackoff is the wait before the first retry of a config file that can't be read, doubled for
+// every further retry.
+const configReloadBackoff = 250 * time.Millisecond
+
+// reloadConfig loads the config file again and swaps it in. The current config stays in use if the new one
+// is invalid or needs settings only made at the start, the namespace or LimitRange cache or a response cache
+// without the timestamp annotation. A file that can't be read is retried with backoff, up to
+// configReloadAttempts reads.
+func (wh *mutatingWebhook) reloadConfig() error {
+	config, err := loadConfig(wh.configFile)
+	backoff := configReloadBackoff
+	for attempt := 1; err != nil; attempt++ {
+		var readErr *configReadError
+		if !errors.As(err, &readErr) || attempt >= wh.configReloadAttempts {
+			return err
+		}
+		errorLogger.Printf("config reload attempt %d of %d failed, retrying in %s: %v", attempt, wh.configReloadAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		config, err = loadConfig(wh.configFile)
+	}
+	if config.needsNamespaces() && wh.namespaceLister == nil {
+		return errors.New("the config selects namespaces by label, restart the webhook to start the namespace cache")
+	}
+	if config.needsLimitRanges() && wh.limitRangeLister == nil {
+		return errors.New("the config skips limits in namespaces with a LimitRange, restart the webhook to start the LimitRange cache")
+	}
+	if config.Timestamp.Enabled && wh.responseCache != nil {
+		return errors.New("the config enables the timestamp annotation, restart the webhook to disable the response cache")
+	}
+	wh.configMu.Lock()
+	config.generation = wh.config.generation + 1
+	wh.config = config
+	wh.configMu.Unlock()
+	if wh.responseCache != nil {
+		wh.responseCache.purge()
+	}
+	atomic.StoreInt32(&wh.disabledLogged, 0)
+	hash, err := configHash(config)
+	if err != nil {
+		return err
+	}
+	logger.Printf("reloaded config, hash %s", hash)
+	return nil
+}
+
+// reloadOnSignal reloads the config on every SIGHUP, like kill -HUP or a config watcher sidecar sends.
+func (wh *mutatingWebhook) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := wh.reloadConfig(); err != nil {
+			errorLogger.Printf("can't reload config, keeping the current one: %v", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMutateKillSwitch(t *testing.T) {
+	logs := captureLogs(t)
+	rules := "rules: [{name: limits, limits: {cpu: 100m}}]\n"
+	wh := testWebhook(t, "enabled: false\n"+rules)
+	wh.configFile = writeConfig(t, "config.yaml", rules)
+
+	for i := 0; i < 2; i++ {
+		response := admissionResponse(t, wh.mutate, podReview(t, testPod(t, cachedPod)))
+		if !response.Allowed || len(response.Patch) > 0 {
+			t.Errorf("disabled webhook: got allowed %v with patch %s, want the pod admitted unchanged", response.Allowed, response.Patch)
+		}
+	}
+	if count := strings.Count(logs.String(), "the webhook is disabled by the config"); count != 1 {
+		t.Errorf("got logs %q, want the kill switch logged once", logs)
+	}
+
+	// Reloading a config without the kill switch turns the mutations back on.
+	if err := wh.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if response := admissionResponse(t, wh.mutate, podReview(t, testPod(t, cachedPod))); len(response.Patch) == 0 {
+		t.Error("enabled webhook: got no patch")
+	}
+
+	// The environment variable overrides the config file on reload.
+	t.Setenv(enabledEnvVar, "false")
+	if err := wh.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if response := admissionResponse(t, wh.mutate, podReview(t, testPod(t, cachedPod))); len(response.Patch) > 0 {
+		t.Errorf("disabled by %s: got patch %s", enabledEnvVar, response.Patch)
+	}
+	if count := strings.Count(logs.String(), "the webhook is disabled by the config"); count != 2 {
+		t.Errorf("got logs %q, want the kill switch logged again after the reload", logs)
+	}
+
+	// An invalid config keeps the current one.
+	t.Setenv(enabledEnvVar, "true")
+	if err := ioutil.WriteFile(wh.configFile, []byte("rules: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := wh.reloadConfig(); err == nil {
+		t.Error("got no error reloading an invalid config")
+	}
+	if !wh.currentConfig().disabled() {
+		t.Error("invalid config replaced the config in use")
+	}
+}
+
+func TestLoadConfigEnabledEnvVar(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "rules: []\n")
+	for _, test := range []struct {
+		value    string
+		disabled bool
+	}{
+		{value: "false", disabled: true},
+		{value: "0", disabled: true},
+		{value: "true", disabled: false},
+	} {
+		t.Setenv(enabledEnvVar, test.value)
+		config, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.disabled() != test.disabled {
+			t.Errorf("%s=%s: got disabled %v, want %v", enabledEnvVar, test.value, config.disabled(), test.disabled)
+		}
+	}
+
+	t.Setenv(enabledEnvVar, "maybe")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), `invalid DIY_WEBHOOK_ENABLED "maybe"`) {
+		t.Errorf("got error %v, want the value rejected", err)
+	}
+}
+
+func TestReloadConfigRetriesReadErrors(t *testing.T) {
+	logs := captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+	wh.configReloadAttempts = 3
+	wh.configFile = filepath.Join(t.TempDir(), "config.yaml")
+
+	// The file appears while the first retry waits, like a ConfigMap volume being updated.
+	written := make(chan error, 1)
+	go func() {
+		time.Sleep(configReloadBackoff / 5)
+		written <- ioutil.WriteFile(wh.configFile, []byte("rules: [{name: working-dir, workingDir: {path: /app}}]\n"), 0o600)
+	}()
+	if err := wh.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if rules := wh.currentConfig().Rules; len(rules) != 1 || rules[0].Name != "working-dir" {
+		t.Errorf("got rules %+v, want the reloaded config", rules)
+	}
+	if !strings.Contains(logs.String(), "config reload attempt 1 of 3 failed, retrying in 250ms") || strings.Contains(logs.String(), "attempt 2") {
+		t.Errorf("got logs %q, want a single retry logged", logs)
+	}
+
+	// Invalid configs aren't retried, unreadable ones only up to the attempts.
+	logs.Reset()
+	if err := ioutil.WriteFile(wh.configFile, []byte("rules: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := wh.reloadConfig(); err == nil || strings.Contains(logs.String(), "retrying") {
+		t.Errorf("invalid config: got error %v and logs %q, want an error without retries", err, logs)
+	}
+	wh.configReloadAttempts = 2
+	wh.configFile = filepath.Join(t.TempDir(), "missing.yaml")
+	err := wh.reloadConfig()
+	if err == nil || !strings.Contains(err.Error(), "can't read config file") || strings.Count(logs.String(), "retrying") != 1 {
+		t.Errorf("missing config: got error %v and logs %q, want the read error after 2 attempts", err, logs)
+	}
+	if rules := wh.currentConfig().Rules; len(rules) != 1 || rules[0].Name != "working-dir" {
+		t.Errorf("got rules %+v, want the config in use kept", rules)
+	}
+
+	if err := runWithFlags(t, "--config-reload-attempts", "0"); err == nil || !strings.Contains(err.Error(), "config reload attempts count of at least 1") {
+		t.Errorf("got error %v, want --config-reload-attempts 0 rejected", err)
+	}
+}
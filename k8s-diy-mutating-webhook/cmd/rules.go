@@ -0,0 +1,977 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// mutation is implemented by every rule type.
+type mutation interface {
+	// compile validates the rule settings when the config is loaded.
+	compile() error
+	// patch returns the operations the rule applies to the pod.
+	patch(ctx *ruleContext) []patchOperation
+}
+
+// linuxOnly is implemented by the rule types setting Linux-only security fields. Their rules skip windows pods.
+type linuxOnly interface {
+	linuxOnly()
+}
+
+func (*SeccompProfileRule) linuxOnly()      {}
+func (*RunAsRule) linuxOnly()               {}
+func (*FSGroupChangePolicyRule) linuxOnly() {}
+func (*PrivilegeEscalationRule) linuxOnly() {}
+func (*DropCapabilitiesRule) linuxOnly()    {}
+func (*SysctlsRule) linuxOnly()             {}
+
+// ruleContext is the state a rule sees while it is evaluated against a pod.
+type ruleContext struct {
+	pod *corev1.Pod
+	// containers holds the indices of the containers matched by the rule selector.
+	containers []int
+	// namespaceLabels are the labels of the pod namespace, nil if the namespace is unknown.
+	namespaceLabels map[string]string
+	// limitRangeDefaults is set if a LimitRange of the pod namespace defaults container limits.
+	limitRangeDefaults bool
+	// replicas is the replica count of the controller the pod belongs to, nil for pods created directly.
+	replicas *int32
+	// warnings are returned to the user in the admission response.
+	warnings []string
+	// denials reject the pod, with the messages returned to the user.
+	denials []string
+	// written maps the paths set by the rules evaluated before to the specificity of the rule that set them.
+	// A later rule may overwrite them unless it is less specific.
+	written map[string]int
+	// specificity is the specificity of the rule selector.
+	specificity int
+}
+
+// setField returns the operation setting the field at path, if it is unset or was set by an earlier rule
+// that is not more specific. Fields set in the submitted pod are left alone.
+func (ctx *ruleContext) setField(path string, set bool, value interface{}) []patchOperation {
+	if !set {
+		return []patchOperation{{Op: "add", Path: path, Value: value}}
+	}
+	if _, ok := ctx.written[path]; ok && !ctx.outranked(path) {
+		return []patchOperation{{Op: "replace", Path: path, Value: value}}
+	}
+	return nil
+}
+
+// outranked reports whether the field at path or a field below it was set by an earlier rule with a more
+// specific selector, which takes precedence. Other fields of an object such a rule added are free to set.
+func (ctx *ruleContext) outranked(path string) bool {
+	for written, specificity := range ctx.written {
+		if specificity > ctx.specificity && (written == path || strings.HasPrefix(written, path+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Selector) matchesPod(pod *corev1.Pod) bool {
+	if len(s.OS) > 0 && podOS(pod) != s.OS {
+		return false
+	}
+	return s.podSelector.Matches(labels.Set(pod.Labels))
+}
+
+// podOS returns the operating system of the pod, from spec.os or else the kubernetes.io/os node selector.
+// Pods without either are linux pods.
+func podOS(pod *corev1.Pod) corev1.OSName {
+	if pod.Spec.OS != nil && len(pod.Spec.OS.Name) > 0 {
+		return pod.Spec.OS.Name
+	}
+	if os := pod.Spec.NodeSelector[corev1.LabelOSStable]; len(os) > 0 {
+		return corev1.OSName(os)
+	}
+	return corev1.Linux
+}
+
+// matchesNamespace reports whether the namespace labels match the namespace selector. Without a namespace
+// selector every namespace matches, with one a nil label set (unknown namespace) never does.
+func (s *Selector) matchesNamespace(namespaceLabels map[string]string) bool {
+	if s.namespaceSelector == nil {
+		return true
+	}
+	return namespaceLabels != nil && s.namespaceSelector.Matches(labels.Set(namespaceLabels))
+}
+
+func (s *Selector) matchesContainer(container *corev1.Container) bool {
+	if !strings.HasPrefix(container.Name, s.ContainerNamePrefix) {
+		return false
+	}
+	if s.containerNamePattern != nil && !s.containerNamePattern.MatchString(container.Name) {
+		return false
+	}
+	if len(s.images) > 0 && !matchesAny(s.images, container.Image) {
+		return false
+	}
+	return !matchesAny(s.excludeImages, container.Image)
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectContainers returns the indices of the pod containers matched by the selector.
+func (s *Selector) selectContainers(pod *corev1.Pod) []int {
+	var containers []int
+	for i := range pod.Spec.Containers {
+		if s.matchesContainer(&pod.Spec.Containers[i]) {
+			containers = append(containers, i)
+		}
+	}
+	return containers
+}
+
+// specificity ranks how narrowly the selector targets containers, by the number of container criteria it
+// sets: containerNamePrefix, containerNamePattern and images. A rule without any applies to all containers.
+// excludeImages only carves exceptions out of the containers selected otherwise and doesn't count.
+func (s *Selector) specificity() int {
+	specificity := 0
+	if len(s.ContainerNamePrefix) > 0 {
+		specificity++
+	}
+	if len(s.ContainerNamePattern) > 0 {
+		specificity++
+	}
+	if len(s.Images) > 0 {
+		specificity++
+	}
+	return specificity
+}
+
+func containerPath(i int, field string) string {
+	return fmt.Sprintf("/spec/containers/%d/%s", i, field)
+}
+
+// appendPatch returns the operation appending value to the array at path, creating the array if it is empty.
+func appendPatch(path string, empty bool, value interface{}) patchOperation {
+	if empty {
+		return patchOperation{Op: "add", Path: path, Value: []interface{}{value}}
+	}
+	return patchOperation{Op: "add", Path: path + "/-", Value: value}
+}
+
+// objectFieldsPatch returns the operations setting fields of the object at path, creating the object with all
+// fields in a single operation if it is absent.
+func objectFieldsPatch(path string, exists bool, fields map[string]interface{}) []patchOperation {
+	if len(fields) == 0 {
+		return nil
+	}
+	if !exists {
+		return []patchOperation{{Op: "add", Path: path, Value: fields}}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	patch := make([]patchOperation, 0, len(names))
+	for _, name := range names {
+		patch = append(patch, patchOperation{Op: "add", Path: path + "/" + name, Value: fields[name]})
+	}
+	return patch
+}
+
+// missingAnnotationsPatch returns the operations adding the annotations the pod doesn't have yet.
+func missingAnnotationsPatch(pod *corev1.Pod, annotations map[string]string) []patchOperation {
+	missing := map[string]string{}
+	for key, value := range annotations {
+		if _, ok := pod.Annotations[key]; !ok {
+			missing[key] = value
+		}
+	}
+	return metadataMapPatch("/metadata/annotations", pod.Annotations, missing)
+}
+
+// annotationPatch returns the operations adding the annotation, unless the pod already has it.
+func annotationPatch(pod *corev1.Pod, key, value string) []patchOperation {
+	if _, ok := pod.Annotations[key]; ok {
+		return nil
+	}
+	return metadataMapPatch("/metadata/annotations", pod.Annotations, map[string]string{key: value})
+}
+
+// podSecurityContextPatch returns the operations setting fields of the pod security context, creating the
+// security context if it is absent.
+func podSecurityContextPatch(pod *corev1.Pod, fields map[string]interface{}) []patchOperation {
+	return objectFieldsPatch("/spec/securityContext", pod.Spec.SecurityContext != nil, fields)
+}
+
+// containerSecurityContextPatch is the container counterpart of podSecurityContextPatch.
+func containerSecurityContextPatch(pod *corev1.Pod, i int, fields map[string]interface{}) []patchOperation {
+	return objectFieldsPatch(containerPath(i, "securityContext"), pod.Spec.Containers[i].SecurityContext != nil, fields)
+}
+
+func (l *LimitsRule) patch(ctx *ruleContext) []patchOperation {
+	if l.SkipWithLimitRange && ctx.limitRangeDefaults {
+		return nil
+	}
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		patch = append(patch, ctx.setField(containerPath(i, "resources/limits"), ctx.pod.Spec.Containers[i].Resources.Limits != nil, l.limits)...)
+	}
+	return patch
+}
+
+func (p *ImagePullPolicyRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		container := &ctx.pod.Spec.Containers[i]
+		if entry := p.registryPolicy(container.Image); entry != nil {
+			if container.ImagePullPolicy == entry.Policy {
+				continue
+			}
+			if entry.Override && len(container.ImagePullPolicy) > 0 {
+				patch = append(patch, patchOperation{Op: "replace", Path: containerPath(i, "imagePullPolicy"), Value: entry.Policy})
+				continue
+			}
+			patch = append(patch, ctx.setField(containerPath(i, "imagePullPolicy"), len(container.ImagePullPolicy) > 0, entry.Policy)...)
+			continue
+		}
+		if len(p.Default) > 0 {
+			patch = append(patch, ctx.setField(containerPath(i, "imagePullPolicy"), len(container.ImagePullPolicy) > 0, p.Default)...)
+		}
+	}
+	return patch
+}
+
+// registryPolicy returns the first registry entry matching the registry of the image, nil if none does.
+func (p *ImagePullPolicyRule) registryPolicy(image string) *RegistryPullPolicy {
+	if len(p.Registries) == 0 {
+		return nil
+	}
+	registry := imageRegistry(image)
+	host := registry
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	for i := range p.Registries {
+		entry := &p.Registries[i]
+		if entry.registry.MatchString(registry) || entry.registry.MatchString(host) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// imageRegistry returns the registry host of the image reference. Like Docker, the first path component is
+// only a host if it has a dot or a port, or is localhost; otherwise the image is on docker.io.
+func imageRegistry(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return "docker.io"
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "docker.io"
+	}
+	return host
+}
+
+func (p *RawPatchRule) patch(_ *ruleContext) []patchOperation {
+	return append([]patchOperation(nil), p.Operations...)
+}
+
+func (p *ReadinessProbeRule) patch(ctx *ruleContext) []patchOperation {
+	if ctx.pod.Annotations[p.Annotation] != "true" {
+		return nil
+	}
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		container := &ctx.pod.Spec.Containers[i]
+		if container.ReadinessProbe != nil || len(container.Ports) == 0 {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:   "add",
+			Path: containerPath(i, "readinessProbe"),
+			Value: &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(int(container.Ports[0].ContainerPort))},
+				},
+				InitialDelaySeconds: p.InitialDelaySeconds,
+				PeriodSeconds:       p.PeriodSeconds,
+			},
+		})
+	}
+	return patch
+}
+
+func (p *SeccompProfileRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	runtimeDefault := &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+
+	var podProfile *corev1.SeccompProfile
+	if pod.Spec.SecurityContext != nil {
+		podProfile = pod.Spec.SecurityContext.SeccompProfile
+	}
+	p.checkAllowed(ctx, "pod", podProfile)
+
+	var patch []patchOperation
+	if p.Level == LevelPod && podProfile == nil {
+		patch = append(patch, podSecurityContextPatch(pod, map[string]interface{}{"seccompProfile": runtimeDefault})...)
+	}
+	for _, i := range ctx.containers {
+		container := &pod.Spec.Containers[i]
+		var profile *corev1.SeccompProfile
+		if container.SecurityContext != nil {
+			profile = container.SecurityContext.SeccompProfile
+		}
+		p.checkAllowed(ctx, fmt.Sprintf("container %s", container.Name), profile)
+		if p.Level == LevelContainer && profile == nil && podProfile == nil {
+			patch = append(patch, containerSecurityContextPatch(pod, i, map[string]interface{}{"seccompProfile": runtimeDefault})...)
+		}
+	}
+	return patch
+}
+
+// checkAllowed warns about a Localhost profile that isn't in the allowlist.
+func (p *SeccompProfileRule) checkAllowed(ctx *ruleContext, subject string, profile *corev1.SeccompProfile) {
+	if len(p.AllowedProfiles) == 0 || profile == nil || profile.Type != corev1.SeccompProfileTypeLocalhost {
+		return
+	}
+	name := ""
+	if profile.LocalhostProfile != nil {
+		name = *profile.LocalhostProfile
+	}
+	for _, allowed := range p.AllowedProfiles {
+		if name == allowed {
+			return
+		}
+	}
+	ctx.warnings = append(ctx.warnings, fmt.Sprintf("%s uses seccomp profile %q, which is not in the allowed profiles", subject, name))
+}
+
+func (t *ProjectedTokenRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	var patch []patchOperation
+
+	if t.DisableAutomount {
+		automount := pod.Spec.AutomountServiceAccountToken
+		switch {
+		case automount == nil:
+			patch = append(patch, patchOperation{Op: "add", Path: "/spec/automountServiceAccountToken", Value: false})
+		case !*automount:
+			return nil
+		default:
+			ctx.warnings = append(ctx.warnings, "the pod sets automountServiceAccountToken to true, the legacy service account token stays mounted")
+		}
+	}
+
+	hasVolume := false
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == t.VolumeName {
+			hasVolume = true
+			break
+		}
+	}
+	if !hasVolume {
+		expiration := t.ExpirationSeconds
+		patch = append(patch, appendPatch("/spec/volumes", len(pod.Spec.Volumes) == 0, corev1.Volume{
+			Name: t.VolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          t.Audience,
+							ExpirationSeconds: &expiration,
+							Path:              t.Path,
+						},
+					}},
+				},
+			},
+		}))
+	}
+
+	for _, i := range ctx.containers {
+		container := &pod.Spec.Containers[i]
+		mounted := false
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == t.VolumeName {
+				mounted = true
+				break
+			}
+		}
+		if mounted {
+			continue
+		}
+		patch = append(patch, appendPatch(containerPath(i, "volumeMounts"), len(container.VolumeMounts) == 0, corev1.VolumeMount{
+			Name:      t.VolumeName,
+			MountPath: t.MountPath,
+			ReadOnly:  true,
+		}))
+	}
+	return patch
+}
+
+func (d *DefaultServiceAccountWarningRule) patch(ctx *ruleContext) []patchOperation {
+	if name := ctx.pod.Spec.ServiceAccountName; len(name) == 0 || name == "default" {
+		ctx.warnings = append(ctx.warnings, "pod uses the default service account, consider a dedicated one with least privilege")
+	}
+	return nil
+}
+
+func (d *DNSSearchRule) patch(ctx *ruleContext) []patchOperation {
+	dnsConfig := ctx.pod.Spec.DNSConfig
+	present := map[string]bool{}
+	if dnsConfig != nil {
+		for _, search := range dnsConfig.Searches {
+			present[search] = true
+		}
+	}
+	var missing []string
+	for _, domain := range d.Domains {
+		if !present[domain] {
+			missing = append(missing, domain)
+			present[domain] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	switch {
+	case dnsConfig == nil:
+		return []patchOperation{{Op: "add", Path: "/spec/dnsConfig", Value: &corev1.PodDNSConfig{Searches: missing}}}
+	case len(dnsConfig.Searches) == 0:
+		return []patchOperation{{Op: "add", Path: "/spec/dnsConfig/searches", Value: missing}}
+	}
+	var patch []patchOperation
+	for _, domain := range missing {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/dnsConfig/searches/-", Value: domain})
+	}
+	return patch
+}
+
+func (p *StartupProbeRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		container := &ctx.pod.Spec.Containers[i]
+		if container.LivenessProbe == nil || container.StartupProbe != nil {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:   "add",
+			Path: containerPath(i, "startupProbe"),
+			Value: &corev1.Probe{
+				ProbeHandler:     container.LivenessProbe.ProbeHandler,
+				FailureThreshold: p.FailureThreshold,
+				PeriodSeconds:    p.PeriodSeconds,
+			},
+		})
+	}
+	return patch
+}
+
+func (u *RunAsRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	if u.Level == LevelPod {
+		var user, group *int64
+		if pod.Spec.SecurityContext != nil {
+			user, group = pod.Spec.SecurityContext.RunAsUser, pod.Spec.SecurityContext.RunAsGroup
+		}
+		return podSecurityContextPatch(pod, u.fields(user, group))
+	}
+
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		var user, group *int64
+		if securityContext := pod.Spec.Containers[i].SecurityContext; securityContext != nil {
+			user, group = securityContext.RunAsUser, securityContext.RunAsGroup
+		}
+		patch = append(patch, containerSecurityContextPatch(pod, i, u.fields(user, group))...)
+	}
+	return patch
+}
+
+// fields returns the security context fields to default, given the current runAsUser and runAsGroup.
+func (u *RunAsRule) fields(user, group *int64) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if user == nil && u.User != nil {
+		fields["runAsUser"] = *u.User
+		if u.Group == nil && group == nil {
+			fields["runAsGroup"] = *u.User
+		}
+	}
+	if group == nil && u.Group != nil {
+		fields["runAsGroup"] = *u.Group
+	}
+	return fields
+}
+
+func (a *PodAntiAffinityRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	if ctx.replicas == nil || *ctx.replicas <= 1 || len(pod.Labels) == 0 {
+		return nil
+	}
+	affinity := pod.Spec.Affinity
+	if affinity != nil && affinity.PodAntiAffinity != nil {
+		return nil
+	}
+
+	term := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{MatchLabels: pod.Labels},
+		TopologyKey:   a.TopologyKey,
+	}
+	podAntiAffinity := &corev1.PodAntiAffinity{}
+	if a.Type == AntiAffinityRequired {
+		podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = []corev1.PodAffinityTerm{term}
+		ctx.warnings = append(ctx.warnings, fmt.Sprintf("injected required pod anti-affinity on %s, replicas beyond the number of topology domains stay pending", a.TopologyKey))
+	} else {
+		podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = []corev1.WeightedPodAffinityTerm{{Weight: a.Weight, PodAffinityTerm: term}}
+	}
+	if affinity == nil {
+		return []patchOperation{{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{PodAntiAffinity: podAntiAffinity}}}
+	}
+	return []patchOperation{{Op: "add", Path: "/spec/affinity/podAntiAffinity", Value: podAntiAffinity}}
+}
+
+func (t *TopologySpreadRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	if len(pod.Labels) == 0 {
+		return nil
+	}
+	for _, constraint := range pod.Spec.TopologySpreadConstraints {
+		if constraint.TopologyKey == t.TopologyKey {
+			return nil
+		}
+	}
+	return []patchOperation{appendPatch("/spec/topologySpreadConstraints", len(pod.Spec.TopologySpreadConstraints) == 0, corev1.TopologySpreadConstraint{
+		MaxSkew:           t.MaxSkew,
+		TopologyKey:       t.TopologyKey,
+		WhenUnsatisfiable: t.WhenUnsatisfiable,
+		LabelSelector:     &metav1.LabelSelector{MatchLabels: pod.Labels},
+	})}
+}
+
+func (e *EnvRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		container := &ctx.pod.Spec.Containers[i]
+		present := map[string]bool{}
+		for _, variable := range container.Env {
+			present[variable.Name] = true
+		}
+		empty := len(container.Env) == 0
+		for _, variable := range e.Variables {
+			if present[variable.Name] {
+				continue
+			}
+			patch = append(patch, appendPatch(containerPath(i, "env"), empty, variable))
+			empty = false
+		}
+	}
+	return patch
+}
+
+func (p *PodDisruptionBudgetRule) patch(ctx *ruleContext) []patchOperation {
+	name := p.Name
+	if len(p.NameFromLabel) > 0 {
+		name = ctx.pod.Labels[p.NameFromLabel]
+	}
+	if len(name) == 0 {
+		return nil
+	}
+	return annotationPatch(ctx.pod, p.Annotation, name)
+}
+
+func (q *GuaranteedQoSRule) patch(ctx *ruleContext) []patchOperation {
+	if ctx.pod.Annotations[q.Annotation] != "guaranteed" {
+		return nil
+	}
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		container := &ctx.pod.Spec.Containers[i]
+		limits := container.Resources.Limits
+		cpu, hasCPU := limits[corev1.ResourceCPU]
+		memory, hasMemory := limits[corev1.ResourceMemory]
+		if !hasCPU || !hasMemory {
+			ctx.warnings = append(ctx.warnings, fmt.Sprintf("container %s needs cpu and memory limits for Guaranteed QoS", container.Name))
+			continue
+		}
+
+		requests := container.Resources.Requests
+		fields := map[string]interface{}{}
+		for name, limit := range map[corev1.ResourceName]resource.Quantity{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory} {
+			if request, ok := requests[name]; !ok || request.Cmp(limit) != 0 {
+				fields[string(name)] = limit
+			}
+		}
+		patch = append(patch, objectFieldsPatch(containerPath(i, "resources/requests"), requests != nil, fields)...)
+	}
+	return patch
+}
+
+func (t *TopologyAwareHintsRule) patch(ctx *ruleContext) []patchOperation {
+	return annotationPatch(ctx.pod, t.Annotation, t.Value)
+}
+
+func (c *CostAllocationRule) patch(ctx *ruleContext) []patchOperation {
+	annotations := map[string]string{}
+	for _, annotation := range c.Annotations {
+		if _, ok := ctx.pod.Annotations[annotation.Annotation]; ok {
+			continue
+		}
+		value, ok := ctx.namespaceLabels[annotation.FromLabel]
+		if !ok {
+			value = annotation.Fallback
+		}
+		if len(value) > 0 {
+			annotations[annotation.Annotation] = value
+		}
+	}
+	return metadataMapPatch("/metadata/annotations", ctx.pod.Annotations, annotations)
+}
+
+func (t *TolerationsRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	var patch []patchOperation
+	empty := len(pod.Spec.Tolerations) == 0
+	for i := range t.tolerations {
+		toleration := &t.tolerations[i]
+		if tolerates(pod.Spec.Tolerations, toleration) {
+			continue
+		}
+		patch = append(patch, appendPatch("/spec/tolerations", empty, toleration))
+		empty = false
+	}
+	return patch
+}
+
+func tolerates(tolerations []corev1.Toleration, toleration *corev1.Toleration) bool {
+	for i := range tolerations {
+		if tolerations[i].MatchToleration(toleration) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *ReadinessGateRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == g.ConditionType {
+			return nil
+		}
+	}
+	return []patchOperation{appendPatch("/spec/readinessGates", len(pod.Spec.ReadinessGates) == 0, corev1.PodReadinessGate{ConditionType: g.ConditionType})}
+}
+
+func (e *EmptyDirSizeLimitRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	for i, volume := range ctx.pod.Spec.Volumes {
+		if volume.EmptyDir == nil || volume.EmptyDir.SizeLimit != nil {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/volumes/%d/emptyDir/sizeLimit", i),
+			Value: e.SizeLimit.String(),
+		})
+	}
+	return patch
+}
+
+func (f *FSGroupChangePolicyRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	var fsGroup *int64
+	var policy *corev1.PodFSGroupChangePolicy
+	if pod.Spec.SecurityContext != nil {
+		fsGroup, policy = pod.Spec.SecurityContext.FSGroup, pod.Spec.SecurityContext.FSGroupChangePolicy
+	}
+	fields := map[string]interface{}{}
+	if fsGroup == nil && f.FSGroup != nil {
+		fsGroup = f.FSGroup
+		fields["fsGroup"] = *f.FSGroup
+	}
+	if fsGroup != nil && policy == nil {
+		fields["fsGroupChangePolicy"] = f.Policy
+	}
+	return podSecurityContextPatch(pod, fields)
+}
+
+func (d *WorkingDirRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		patch = append(patch, ctx.setField(containerPath(i, "workingDir"), len(ctx.pod.Spec.Containers[i].WorkingDir) > 0, d.Path)...)
+	}
+	return patch
+}
+
+func (e *PrivilegeEscalationRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		container := &pod.Spec.Containers[i]
+		securityContext := container.SecurityContext
+		if securityContext != nil && securityContext.Privileged != nil && *securityContext.Privileged {
+			// Privileged containers always escalate, the API server rejects allowPrivilegeEscalation false for them.
+			continue
+		}
+		if securityContext == nil || securityContext.AllowPrivilegeEscalation == nil {
+			patch = append(patch, containerSecurityContextPatch(pod, i, map[string]interface{}{"allowPrivilegeEscalation": false})...)
+			continue
+		}
+		if *securityContext.AllowPrivilegeEscalation && e.Deny {
+			ctx.denials = append(ctx.denials, fmt.Sprintf("container %s sets allowPrivilegeEscalation to true", container.Name))
+		}
+	}
+	return patch
+}
+
+func (d *DropCapabilitiesRule) patch(ctx *ruleContext) []patchOperation {
+	pod := ctx.pod
+	capabilities := &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}, Add: d.Add}
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		if securityContext := pod.Spec.Containers[i].SecurityContext; securityContext != nil && securityContext.Capabilities != nil {
+			continue
+		}
+		patch = append(patch, containerSecurityContextPatch(pod, i, map[string]interface{}{"capabilities": capabilities})...)
+	}
+	return patch
+}
+
+func (l *LimitsFromRequestsRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		resources := &ctx.pod.Spec.Containers[i].Resources
+		fields := map[string]interface{}{}
+		for name, ratio := range l.ratios {
+			request, ok := resources.Requests[name]
+			if _, limited := resources.Limits[name]; !ok || limited {
+				continue
+			}
+			fields[string(name)] = scaleQuantity(request, ratio)
+		}
+		patch = append(patch, objectFieldsPatch(containerPath(i, "resources/limits"), resources.Limits != nil, fields)...)
+	}
+	return patch
+}
+
+// scaleQuantity multiplies the quantity by ratio, rounded up to a thousandth of its unit like a millicore.
+func scaleQuantity(q resource.Quantity, ratio float64) resource.Quantity {
+	milli := int64(math.Ceil(float64(q.MilliValue()) * ratio))
+	if milli%1000 == 0 {
+		return *resource.NewQuantity(milli/1000, q.Format)
+	}
+	return *resource.NewMilliQuantity(milli, q.Format)
+}
+
+func (m *MemoryEnvRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		container := &ctx.pod.Spec.Containers[i]
+		limit, ok := container.Resources.Limits[corev1.ResourceMemory]
+		if !ok {
+			continue
+		}
+		present := map[string]bool{}
+		for _, variable := range container.Env {
+			present[variable.Name] = true
+		}
+		empty := len(container.Env) == 0
+		for _, variable := range m.Variables {
+			if present[variable.Name] {
+				continue
+			}
+			amount := int64(float64(limit.Value()) * variable.Ratio / float64(memoryUnits[variable.Unit]))
+			var value strings.Builder
+			if err := variable.value.Execute(&value, amount); err != nil {
+				ctx.warnings = append(ctx.warnings, fmt.Sprintf("can't render %s for container %s: %v", variable.Name, container.Name, err))
+				continue
+			}
+			patch = append(patch, appendPatch(containerPath(i, "env"), empty, corev1.EnvVar{Name: variable.Name, Value: value.String()}))
+			empty = false
+		}
+	}
+	return patch
+}
+
+func (p *LimitProfilesRule) patch(ctx *ruleContext) []patchOperation {
+	name, ok := ctx.pod.Labels[p.Label]
+	profile := p.Profiles[name]
+	if ok && profile == nil {
+		ctx.warnings = append(ctx.warnings, fmt.Sprintf("unknown limit profile %q in label %s", name, p.Label))
+	}
+	if profile == nil {
+		profile = p.Profiles[p.Default]
+	}
+	if profile == nil {
+		return nil
+	}
+	return profile.patch(ctx)
+}
+
+func (t *StdinTTYRule) patch(ctx *ruleContext) []patchOperation {
+	if ctx.pod.Annotations[t.Annotation] == "true" {
+		return nil
+	}
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		container := &ctx.pod.Spec.Containers[i]
+		fields := []struct {
+			name string
+			set  bool
+		}{{"stdin", container.Stdin}, {"stdinOnce", container.StdinOnce}, {"tty", container.TTY}}
+		for _, field := range fields {
+			if field.set {
+				patch = append(patch, patchOperation{Op: "replace", Path: containerPath(i, field.name), Value: false})
+			}
+		}
+	}
+	return patch
+}
+
+func (a *PreferredNodeAffinityRule) patch(ctx *ruleContext) []patchOperation {
+	affinity := ctx.pod.Spec.Affinity
+	if affinity != nil && affinity.NodeAffinity != nil {
+		return nil
+	}
+	nodeAffinity := &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: a.Preferences}
+	if affinity == nil {
+		return []patchOperation{{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{NodeAffinity: nodeAffinity}}}
+	}
+	return []patchOperation{{Op: "add", Path: "/spec/affinity/nodeAffinity", Value: nodeAffinity}}
+}
+
+func (h *PostStartRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	for _, i := range ctx.containers {
+		lifecycle := ctx.pod.Spec.Containers[i].Lifecycle
+		if lifecycle != nil && lifecycle.PostStart != nil {
+			continue
+		}
+		patch = append(patch, objectFieldsPatch(containerPath(i, "lifecycle"), lifecycle != nil, map[string]interface{}{
+			"postStart": h.LifecycleHandler.DeepCopy(),
+		})...)
+	}
+	return patch
+}
+
+func (h *HostPortsRule) patch(ctx *ruleContext) []patchOperation {
+	var patch []patchOperation
+	var containers []string
+	for _, i := range ctx.containers {
+		container := &ctx.pod.Spec.Containers[i]
+		declared := false
+		for j, port := range container.Ports {
+			if port.HostPort == 0 {
+				continue
+			}
+			declared = true
+			patch = append(patch, patchOperation{Op: "remove", Path: containerPath(i, fmt.Sprintf("ports/%d/hostPort", j))})
+		}
+		if declared {
+			containers = append(containers, container.Name)
+		}
+	}
+	if len(containers) == 0 {
+		return nil
+	}
+	switch {
+	case h.Action == HostPortsDeny:
+		ctx.denials = append(ctx.denials, fmt.Sprintf("host ports are declared by containers %s", strings.Join(containers, ", ")))
+	case ctx.pod.Spec.HostNetwork:
+		ctx.warnings = append(ctx.warnings, fmt.Sprintf("host ports of containers %s not removed, the pod uses the host network", strings.Join(containers, ", ")))
+	default:
+		ctx.warnings = append(ctx.warnings, fmt.Sprintf("removed the host ports of containers %s", strings.Join(containers, ", ")))
+		return patch
+	}
+	return nil
+}
+
+func (s *SysctlsRule) patch(ctx *ruleContext) []patchOperation {
+	securityContext := ctx.pod.Spec.SecurityContext
+	set := map[string]bool{}
+	if securityContext != nil {
+		for _, sysctl := range securityContext.Sysctls {
+			set[sysctl.Name] = true
+		}
+	}
+	var missing []corev1.Sysctl
+	for _, sysctl := range s.Sysctls {
+		if !set[sysctl.Name] {
+			missing = append(missing, sysctl)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if securityContext == nil || len(securityContext.Sysctls) == 0 {
+		return podSecurityContextPatch(ctx.pod, map[string]interface{}{"sysctls": missing})
+	}
+	var patch []patchOperation
+	for _, sysctl := range missing {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/securityContext/sysctls/-", Value: sysctl})
+	}
+	return patch
+}
+
+func (m *MeshSidecarRule) patch(ctx *ruleContext) []patchOperation {
+	if !m.hasSidecar(ctx.pod) {
+		return nil
+	}
+	return missingAnnotationsPatch(ctx.pod, m.Annotations)
+}
+
+// hasSidecar reports whether the pod has a mesh sidecar or requests one.
+func (m *MeshSidecarRule) hasSidecar(pod *corev1.Pod) bool {
+	for _, key := range m.InjectAnnotations {
+		if value := strings.ToLower(pod.Annotations[key]); value == "true" || value == "enabled" {
+			return true
+		}
+	}
+	containers := append(append([]corev1.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, name := range m.Containers {
+			if container.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *SubdomainRule) patch(ctx *ruleContext) []patchOperation {
+	if len(ctx.pod.Spec.Subdomain) > 0 {
+		return nil
+	}
+	subdomain := d.Subdomain
+	if len(d.FromLabel) > 0 {
+		subdomain = ctx.pod.Labels[d.FromLabel]
+		if len(subdomain) == 0 {
+			return nil
+		}
+		if errs := validation.IsDNS1123Label(subdomain); len(errs) > 0 {
+			ctx.warnings = append(ctx.warnings, fmt.Sprintf("label %s=%s is not a valid subdomain, subdomain not set", d.FromLabel, subdomain))
+			return nil
+		}
+	}
+	return []patchOperation{{Op: "add", Path: "/spec/subdomain", Value: subdomain}}
+}
+
+func (a *AnnotationsRule) patch(ctx *ruleContext) []patchOperation {
+	return missingAnnotationsPatch(ctx.pod, a.Annotations)
+}
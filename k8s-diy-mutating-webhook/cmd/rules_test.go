@@ -0,0 +1,1814 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImagePullPolicyRule(t *testing.T) {
+	config := `
+rules:
+- name: pull-policy
+  imagePullPolicy:
+    default: IfNotPresent
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "empty policy defaulted",
+			config: config,
+			pod: `
+spec:
+  containers:
+  - name: app
+    image: nginx
+  - name: sidecar
+    image: envoy
+    imagePullPolicy: Always
+`,
+			want: `
+spec:
+  containers:
+  - name: app
+    image: nginx
+    imagePullPolicy: IfNotPresent
+  - name: sidecar
+    image: envoy
+    imagePullPolicy: Always
+`,
+		},
+		{
+			name:   "set policy kept",
+			config: config,
+			pod: `
+spec:
+  containers:
+  - name: app
+    image: nginx
+    imagePullPolicy: Never
+`,
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{
+			name:   "invalid default",
+			config: "rules: [{name: pull-policy, imagePullPolicy: {default: Sometimes}}]\n",
+			err:    `invalid imagePullPolicy "Sometimes"`,
+		},
+		{
+			name:   "no default",
+			config: "rules: [{name: pull-policy, imagePullPolicy: {}}]\n",
+			err:    "needs a default or registries",
+		},
+	})
+}
+
+func TestImagePullPolicyRuleRegistries(t *testing.T) {
+	config := `
+rules:
+- name: pull-policy
+  imagePullPolicy:
+    default: Always
+    registries:
+    - {registry: registry.internal.example.com, policy: IfNotPresent, override: true}
+    - {registry: "*.corp.example.com", policy: Never}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "internal and external registries",
+			config: config,
+			pod: `
+spec:
+  containers:
+  - name: internal
+    image: registry.internal.example.com:5000/team/app:1.0
+    imagePullPolicy: Always
+  - name: corp
+    image: mirror.corp.example.com/nginx:1.25
+  - name: external
+    image: nginx:1.25
+  - name: quay
+    image: quay.io/prometheus/node-exporter:v1.6.0
+`,
+			want: `
+spec:
+  containers:
+  - name: internal
+    image: registry.internal.example.com:5000/team/app:1.0
+    imagePullPolicy: IfNotPresent
+  - name: corp
+    image: mirror.corp.example.com/nginx:1.25
+    imagePullPolicy: Never
+  - name: external
+    image: nginx:1.25
+    imagePullPolicy: Always
+  - name: quay
+    image: quay.io/prometheus/node-exporter:v1.6.0
+    imagePullPolicy: Always
+`,
+		},
+		{
+			name:   "set policy kept without override",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: corp\n    image: mirror.corp.example.com/nginx:1.25\n    imagePullPolicy: Always\n",
+		},
+		{
+			name:   "registries only",
+			config: "rules: [{name: pull-policy, imagePullPolicy: {registries: [{registry: docker.io, policy: IfNotPresent}]}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    image: library/nginx:1.25\n  - name: quay\n    image: quay.io/app:1.0\n",
+			want:   "spec:\n  containers:\n  - name: app\n    image: library/nginx:1.25\n    imagePullPolicy: IfNotPresent\n  - name: quay\n    image: quay.io/app:1.0\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{
+			name:   "empty pattern",
+			config: "rules: [{name: pull-policy, imagePullPolicy: {registries: [{registry: '', policy: Always}]}}]\n",
+			err:    `invalid registry pattern ""`,
+		},
+		{
+			name:   "invalid registry policy",
+			config: "rules: [{name: pull-policy, imagePullPolicy: {registries: [{registry: quay.io, policy: Sometimes}]}}]\n",
+			err:    `registry quay.io: invalid imagePullPolicy "Sometimes"`,
+		},
+	})
+}
+
+func TestSelectContainers(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "app", Image: "nginx:1.23"},
+		{Name: "app-worker", Image: "registry.example.com/worker:2"},
+		{Name: "istio-proxy", Image: "docker.io/istio/proxyv2:1.16"},
+	}}}
+	tests := []struct {
+		name     string
+		selector Selector
+		want     []int
+	}{
+		{name: "empty selector", want: []int{0, 1, 2}},
+		{name: "name prefix", selector: Selector{ContainerNamePrefix: "app"}, want: []int{0, 1}},
+		{name: "name pattern", selector: Selector{ContainerNamePattern: "^app$|proxy"}, want: []int{0, 2}},
+		{name: "prefix and pattern", selector: Selector{ContainerNamePrefix: "app", ContainerNamePattern: "-worker$"}, want: []int{1}},
+		{name: "no match", selector: Selector{ContainerNamePattern: "^web"}},
+		{name: "excluded image", selector: Selector{ExcludeImages: []string{"docker.io/istio/*"}}, want: []int{0, 1}},
+		{name: "excluded image glob", selector: Selector{ExcludeImages: []string{"*:1.*"}}, want: []int{1}},
+		{name: "exclusion is anchored", selector: Selector{ExcludeImages: []string{"nginx"}}, want: []int{0, 1, 2}},
+		{name: "exclusion with name prefix", selector: Selector{ContainerNamePrefix: "app", ExcludeImages: []string{"registry.example.com/*"}}, want: []int{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.selector.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := test.selector.selectContainers(pod); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got containers %v, want %v", got, test.want)
+			}
+		})
+	}
+	runConfigErrorTests(t, []configErrorTest{
+		{
+			name:   "invalid name pattern",
+			config: "rules: [{name: limits, selector: {containerNamePattern: '(app'}, limits: {cpu: 100m}}]\n",
+			err:    "invalid containerNamePattern",
+		},
+	})
+}
+
+func TestReadinessProbeRule(t *testing.T) {
+	config := "rules: [{name: probe, readinessProbe: {periodSeconds: 5}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "probe on the first port",
+			config: config,
+			pod: `
+metadata:
+  annotations:
+    diy-webhook/default-readiness-probe: "true"
+spec:
+  containers:
+  - name: app
+    ports:
+    - containerPort: 8080
+    - containerPort: 9090
+  - name: worker
+`,
+			want: `
+metadata:
+  annotations:
+    diy-webhook/default-readiness-probe: "true"
+spec:
+  containers:
+  - name: app
+    ports:
+    - containerPort: 8080
+    - containerPort: 9090
+    readinessProbe:
+      tcpSocket:
+        port: 8080
+      periodSeconds: 5
+  - name: worker
+`,
+		},
+		{
+			name:   "existing probe kept",
+			config: config,
+			pod: `
+metadata:
+  annotations:
+    diy-webhook/default-readiness-probe: "true"
+spec:
+  containers:
+  - name: app
+    ports:
+    - containerPort: 8080
+    readinessProbe:
+      httpGet:
+        path: /ready
+        port: 8080
+`,
+		},
+		{
+			name:   "pod not opted in",
+			config: config,
+			pod: `
+spec:
+  containers:
+  - name: app
+    ports:
+    - containerPort: 8080
+`,
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{
+			name:   "negative period",
+			config: "rules: [{name: probe, readinessProbe: {periodSeconds: -1}}]\n",
+			err:    "non-negative initialDelaySeconds and periodSeconds",
+		},
+	})
+}
+
+func TestSeccompProfileRule(t *testing.T) {
+	runPatchTests(t, []patchTest{
+		{
+			name:   "pod profile defaulted",
+			config: "rules: [{name: seccomp, seccompProfile: {}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want: `
+spec:
+  securityContext:
+    seccompProfile:
+      type: RuntimeDefault
+  containers:
+  - name: app
+`,
+		},
+		{
+			name:   "pod profile added to the security context",
+			config: "rules: [{name: seccomp, seccompProfile: {}}]\n",
+			pod:    "spec:\n  securityContext:\n    runAsNonRoot: true\n  containers:\n  - name: app\n",
+			want: `
+spec:
+  securityContext:
+    runAsNonRoot: true
+    seccompProfile:
+      type: RuntimeDefault
+  containers:
+  - name: app
+`,
+		},
+		{
+			name:   "container profiles defaulted",
+			config: "rules: [{name: seccomp, seccompProfile: {level: container}}]\n",
+			pod: `
+spec:
+  containers:
+  - name: app
+  - name: sidecar
+    securityContext:
+      seccompProfile:
+        type: Unconfined
+`,
+			want: `
+spec:
+  containers:
+  - name: app
+    securityContext:
+      seccompProfile:
+        type: RuntimeDefault
+  - name: sidecar
+    securityContext:
+      seccompProfile:
+        type: Unconfined
+`,
+		},
+		{
+			name:   "container inherits the pod profile",
+			config: "rules: [{name: seccomp, seccompProfile: {level: container}}]\n",
+			pod: `
+spec:
+  securityContext:
+    seccompProfile:
+      type: RuntimeDefault
+  containers:
+  - name: app
+`,
+		},
+		{
+			name: "custom profiles checked against the allowlist",
+			config: `
+rules:
+- name: seccomp
+  seccompProfile:
+    allowedProfiles: [profiles/audit.json]
+`,
+			pod: `
+spec:
+  securityContext:
+    seccompProfile:
+      type: Localhost
+      localhostProfile: profiles/audit.json
+  containers:
+  - name: app
+    securityContext:
+      seccompProfile:
+        type: Localhost
+        localhostProfile: profiles/custom.json
+`,
+			warnings: []string{`container app uses seccomp profile "profiles/custom.json", which is not in the allowed profiles`},
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid level", config: "rules: [{name: seccomp, seccompProfile: {level: node}}]\n", err: `invalid level "node"`},
+	})
+}
+
+func TestProjectedTokenRule(t *testing.T) {
+	config := "rules: [{name: token, projectedToken: {mountPath: /var/run/secrets/tokens, audience: vault}}]\n"
+	injected := `
+spec:
+  containers:
+  - name: app
+    volumeMounts:
+    - name: diy-webhook-token
+      mountPath: /var/run/secrets/tokens
+      readOnly: true
+  volumes:
+  - name: diy-webhook-token
+    projected:
+      sources:
+      - serviceAccountToken:
+          audience: vault
+          expirationSeconds: 3600
+          path: token
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "volume and mount injected",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   injected,
+		},
+		{
+			name:   "injected pod untouched",
+			config: config,
+			pod:    injected,
+		},
+		{
+			name:   "automount disabled",
+			config: "rules: [{name: token, projectedToken: {mountPath: /var/run/secrets/tokens, audience: vault, disableAutomount: true}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   strings.Replace(injected, "spec:\n", "spec:\n  automountServiceAccountToken: false\n", 1),
+		},
+		{
+			name:   "pod without token untouched",
+			config: "rules: [{name: token, projectedToken: {mountPath: /var/run/secrets/tokens, disableAutomount: true}}]\n",
+			pod:    "spec:\n  automountServiceAccountToken: false\n  containers:\n  - name: app\n",
+		},
+	})
+
+	// Applying the rule to its own result adds nothing, so the volume and the mount appear once.
+	pod := testPod(t, "spec:\n  containers:\n  - name: app\n  - name: sidecar\n")
+	_, patched := mutatePod(t, pod, testConfig(t, config), patchOptions{})
+	result, _ := mutatePod(t, patched, testConfig(t, config), patchOptions{})
+	if len(result.patch) > 0 {
+		t.Errorf("got patch %v for an injected pod, want none", result.patch)
+	}
+	if len(patched.Spec.Volumes) != 1 || len(patched.Spec.Containers[0].VolumeMounts) != 1 || len(patched.Spec.Containers[1].VolumeMounts) != 1 {
+		t.Errorf("got volumes %v, want one volume mounted into both containers", patched.Spec.Volumes)
+	}
+
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "relative mount path", config: "rules: [{name: token, projectedToken: {mountPath: tokens}}]\n", err: "needs an absolute mountPath"},
+		{name: "short expiration", config: "rules: [{name: token, projectedToken: {mountPath: /tokens, expirationSeconds: 60}}]\n", err: "expirationSeconds must be at least 600"},
+		{name: "invalid volume name", config: "rules: [{name: token, projectedToken: {mountPath: /tokens, volumeName: Token}}]\n", err: `invalid volumeName "Token"`},
+	})
+}
+
+func TestProjectedTokenRuleDisableAutomount(t *testing.T) {
+	config := "rules: [{name: token, projectedToken: {mountPath: /var/run/secrets/tokens, audience: vault, disableAutomount: true}}]\n"
+	projected := `
+  containers:
+  - name: app
+    volumeMounts:
+    - name: diy-webhook-token
+      mountPath: /var/run/secrets/tokens
+      readOnly: true
+  volumes:
+  - name: diy-webhook-token
+    projected:
+      sources:
+      - serviceAccountToken:
+          audience: vault
+          expirationSeconds: 3600
+          path: token
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "legacy token replaced",
+			config: config,
+			pod:    "spec:\n  serviceAccountName: api\n  containers:\n  - name: app\n",
+			want:   "spec:\n  serviceAccountName: api\n  automountServiceAccountToken: false" + projected,
+		},
+		{
+			name:     "legacy token requested",
+			config:   config,
+			pod:      "spec:\n  automountServiceAccountToken: true\n  containers:\n  - name: app\n",
+			want:     "spec:\n  automountServiceAccountToken: true" + projected,
+			warnings: []string{"the pod sets automountServiceAccountToken to true, the legacy service account token stays mounted"},
+		},
+		{
+			name:   "automount kept without the option",
+			config: "rules: [{name: token, projectedToken: {mountPath: /var/run/secrets/tokens, audience: vault}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:" + projected,
+		},
+	})
+}
+
+func TestDefaultServiceAccountWarningRule(t *testing.T) {
+	config := "rules: [{name: service-account, defaultServiceAccountWarning: {}}]\n"
+	warning := "pod uses the default service account"
+	runPatchTests(t, []patchTest{
+		{name: "unset service account", config: config, pod: "spec:\n  containers:\n  - name: app\n", warnings: []string{warning}},
+		{name: "default service account", config: config, pod: "spec:\n  serviceAccountName: default\n  containers:\n  - name: app\n", warnings: []string{warning}},
+		{name: "dedicated service account", config: config, pod: "spec:\n  serviceAccountName: web\n  containers:\n  - name: app\n"},
+	})
+}
+
+func TestDNSSearchRule(t *testing.T) {
+	config := "rules: [{name: dns, dnsSearch: {domains: [svc.example.com, example.com]}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "absent dnsConfig",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  dnsConfig:\n    searches: [svc.example.com, example.com]\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "dnsConfig without searches",
+			config: config,
+			pod:    "spec:\n  dnsConfig:\n    nameservers: [10.0.0.10]\n  containers:\n  - name: app\n",
+			want:   "spec:\n  dnsConfig:\n    nameservers: [10.0.0.10]\n    searches: [svc.example.com, example.com]\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "present domain not duplicated",
+			config: config,
+			pod:    "spec:\n  dnsConfig:\n    searches: [example.com]\n  containers:\n  - name: app\n",
+			want:   "spec:\n  dnsConfig:\n    searches: [example.com, svc.example.com]\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "all domains present",
+			config: config,
+			pod:    "spec:\n  dnsConfig:\n    searches: [example.com, svc.example.com]\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no domains", config: "rules: [{name: dns, dnsSearch: {}}]\n", err: "needs at least one domain"},
+		{name: "invalid domain", config: "rules: [{name: dns, dnsSearch: {domains: [Example_COM]}}]\n", err: `invalid search domain "Example_COM"`},
+	})
+}
+
+func TestStartupProbeRule(t *testing.T) {
+	config := "rules: [{name: startup, startupProbe: {failureThreshold: 60, periodSeconds: 5}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "liveness probe without startup probe",
+			config: config,
+			pod: `
+spec:
+  containers:
+  - name: app
+    livenessProbe:
+      httpGet:
+        path: /healthz
+        port: 8080
+  - name: worker
+`,
+			want: `
+spec:
+  containers:
+  - name: app
+    livenessProbe:
+      httpGet:
+        path: /healthz
+        port: 8080
+    startupProbe:
+      httpGet:
+        path: /healthz
+        port: 8080
+      failureThreshold: 60
+      periodSeconds: 5
+  - name: worker
+`,
+		},
+		{
+			name:   "existing startup probe kept",
+			config: config,
+			pod: `
+spec:
+  containers:
+  - name: app
+    livenessProbe:
+      tcpSocket:
+        port: 8080
+    startupProbe:
+      tcpSocket:
+        port: 8080
+      failureThreshold: 5
+`,
+		},
+		{
+			name:   "defaults",
+			config: "rules: [{name: startup, startupProbe: {}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    livenessProbe:\n      exec:\n        command: [\"true\"]\n",
+			want: `
+spec:
+  containers:
+  - name: app
+    livenessProbe:
+      exec:
+        command: ["true"]
+    startupProbe:
+      exec:
+        command: ["true"]
+      failureThreshold: 30
+      periodSeconds: 10
+`,
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "negative period", config: "rules: [{name: startup, startupProbe: {periodSeconds: -10}}]\n", err: "needs positive failureThreshold and periodSeconds"},
+	})
+}
+
+func TestRunAsRule(t *testing.T) {
+	user := "rules: [{name: run-as, runAs: {user: 1000}}]\n"
+	userAndGroup := "rules: [{name: run-as, runAs: {user: 1000, group: 2000}}]\n"
+	pod := func(securityContext string) string {
+		if len(securityContext) == 0 {
+			return "spec:\n  containers:\n  - name: app\n"
+		}
+		return "spec:\n  securityContext: {" + securityContext + "}\n  containers:\n  - name: app\n"
+	}
+	runPatchTests(t, []patchTest{
+		{name: "group follows defaulted user", config: user, pod: pod(""), want: pod("runAsUser: 1000, runAsGroup: 1000")},
+		{name: "explicit user kept", config: user, pod: pod("runAsUser: 5")},
+		{name: "explicit group kept", config: user, pod: pod("runAsGroup: 5"), want: pod("runAsUser: 1000, runAsGroup: 5")},
+		{name: "user and group defaulted", config: userAndGroup, pod: pod(""), want: pod("runAsUser: 1000, runAsGroup: 2000")},
+		{name: "group defaulted beside explicit user", config: userAndGroup, pod: pod("runAsUser: 5"), want: pod("runAsUser: 5, runAsGroup: 2000")},
+		{name: "explicit user and group kept", config: userAndGroup, pod: pod("runAsUser: 5, runAsGroup: 6")},
+		{
+			name:   "group only",
+			config: "rules: [{name: run-as, runAs: {group: 2000}}]\n",
+			pod:    pod("runAsNonRoot: true"),
+			want:   pod("runAsNonRoot: true, runAsGroup: 2000"),
+		},
+		{
+			name:   "container level",
+			config: "rules: [{name: run-as, runAs: {level: container, user: 1000}}]\n",
+			pod: `
+spec:
+  containers:
+  - name: app
+  - name: sidecar
+    securityContext:
+      runAsUser: 5
+`,
+			want: `
+spec:
+  containers:
+  - name: app
+    securityContext:
+      runAsUser: 1000
+      runAsGroup: 1000
+  - name: sidecar
+    securityContext:
+      runAsUser: 5
+`,
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no ids", config: "rules: [{name: run-as, runAs: {}}]\n", err: "needs a user or a group"},
+		{name: "negative id", config: "rules: [{name: run-as, runAs: {user: -1}}]\n", err: "needs non-negative ids"},
+		{name: "invalid level", config: "rules: [{name: run-as, runAs: {level: node, user: 1000}}]\n", err: `invalid level "node"`},
+	})
+}
+
+func TestPodAntiAffinityRule(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: spread, podAntiAffinity: {}}]\n")
+	deployment := func(replicas *int32) *appsv1.Deployment {
+		deployment := &appsv1.Deployment{}
+		deployment.Name, deployment.Namespace = "web", "default"
+		deployment.Spec.Replicas = replicas
+		deployment.Spec.Template = corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+		}
+		return deployment
+	}
+	one, three := int32(1), int32(3)
+	for _, test := range []struct {
+		name     string
+		review   *admissionv1.AdmissionReview
+		injected bool
+	}{
+		{name: "one replica", review: deploymentReview(t, deployment(&one))},
+		{name: "default replicas", review: deploymentReview(t, deployment(nil))},
+		{name: "three replicas", review: deploymentReview(t, deployment(&three)), injected: true},
+		{name: "pod", review: podReview(t, testPod(t, "metadata:\n  labels: {app: web}\nspec:\n  containers:\n  - name: app\n"))},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			response := admissionResponse(t, wh.mutate, test.review)
+			var patch []patchOperation
+			if len(response.Patch) > 0 {
+				if err := json.Unmarshal(response.Patch, &patch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !test.injected {
+				if len(patch) > 0 {
+					t.Errorf("got patch %s, want none", response.Patch)
+				}
+				return
+			}
+			want := `[{"op":"add","path":"/spec/template/spec/affinity","value":{"podAntiAffinity":{"preferredDuringSchedulingIgnoredDuringExecution":[{"weight":100,"podAffinityTerm":{"labelSelector":{"matchLabels":{"app":"web"}},"topologyKey":"kubernetes.io/hostname"}}]}}}]`
+			if string(response.Patch) != want {
+				t.Errorf("got patch %s, want %s", response.Patch, want)
+			}
+		})
+	}
+
+	required := testWebhook(t, "rules: [{name: spread, podAntiAffinity: {type: required, topologyKey: topology.kubernetes.io/zone}}]\n")
+	response := admissionResponse(t, required.mutate, deploymentReview(t, deployment(&three)))
+	if !strings.Contains(string(response.Patch), `"requiredDuringSchedulingIgnoredDuringExecution"`) || len(response.Warnings) != 1 {
+		t.Errorf("got patch %s and warnings %q, want a required anti-affinity with a warning", response.Patch, response.Warnings)
+	}
+
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid weight", config: "rules: [{name: spread, podAntiAffinity: {weight: 101}}]\n", err: "invalid weight 101"},
+		{name: "invalid type", config: "rules: [{name: spread, podAntiAffinity: {type: strict}}]\n", err: `invalid anti-affinity type "strict"`},
+	})
+}
+
+func TestTopologySpreadRule(t *testing.T) {
+	pod := "metadata:\n  labels: {app: web}\nspec:\n  containers:\n  - name: app\n"
+	constraint := func(key string, maxSkew int, whenUnsatisfiable string) string {
+		return fmt.Sprintf(`
+  topologySpreadConstraints:
+  - maxSkew: %d
+    topologyKey: %s
+    whenUnsatisfiable: %s
+    labelSelector:
+      matchLabels: {app: web}
+`, maxSkew, key, whenUnsatisfiable)
+	}
+	runPatchTests(t, []patchTest{
+		{
+			name:   "zone by default",
+			config: "rules: [{name: spread, topologySpread: {}}]\n",
+			pod:    pod,
+			want:   pod + constraint("topology.kubernetes.io/zone", 1, "ScheduleAnyway"),
+		},
+		{
+			name:   "hostname",
+			config: "rules: [{name: spread, topologySpread: {topologyKey: kubernetes.io/hostname, maxSkew: 2, whenUnsatisfiable: DoNotSchedule}}]\n",
+			pod:    pod,
+			want:   pod + constraint("kubernetes.io/hostname", 2, "DoNotSchedule"),
+		},
+		{
+			name:   "constraint of another key appended",
+			config: "rules: [{name: spread, topologySpread: {topologyKey: kubernetes.io/hostname}}]\n",
+			pod:    pod + constraint("topology.kubernetes.io/zone", 1, "ScheduleAnyway"),
+			want:   pod + constraint("topology.kubernetes.io/zone", 1, "ScheduleAnyway") + strings.TrimPrefix(constraint("kubernetes.io/hostname", 1, "ScheduleAnyway"), "\n  topologySpreadConstraints:\n"),
+		},
+		{
+			name:   "constraint of the key kept",
+			config: "rules: [{name: spread, topologySpread: {}}]\n",
+			pod:    pod + constraint("topology.kubernetes.io/zone", 3, "DoNotSchedule"),
+		},
+		{
+			name:   "pod without labels",
+			config: "rules: [{name: spread, topologySpread: {}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid key", config: "rules: [{name: spread, topologySpread: {topologyKey: 'a b'}}]\n", err: `invalid topologyKey "a b"`},
+		{name: "negative maxSkew", config: "rules: [{name: spread, topologySpread: {maxSkew: -1}}]\n", err: "invalid maxSkew -1"},
+		{name: "invalid whenUnsatisfiable", config: "rules: [{name: spread, topologySpread: {whenUnsatisfiable: Never}}]\n", err: `invalid whenUnsatisfiable "Never"`},
+	})
+}
+
+func TestLimitsRulePercentages(t *testing.T) {
+	runPatchTests(t, []patchTest{
+		{
+			name: "percentages of the reference node",
+			config: `
+rules:
+- name: limits
+  limits:
+    cpu: 10%
+    memory: 25%
+    ephemeralStorage: 50%
+    referenceNode: {cpu: "4", memory: 16Gi, ephemeralStorage: 100Gi}
+`,
+			pod: "spec:\n  containers:\n  - name: app\n",
+			want: `
+spec:
+  containers:
+  - name: app
+    resources:
+      limits:
+        cpu: 400m
+        memory: 4Gi
+        ephemeral-storage: 50Gi
+`,
+		},
+		{
+			name:   "percentage beside a quantity",
+			config: "rules: [{name: limits, limits: {cpu: 12.5%, memory: 512Mi, referenceNode: {cpu: 8}}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      limits:\n        cpu: \"1\"\n        memory: 512Mi\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no reference node", config: "rules: [{name: limits, limits: {cpu: 10%}}]\n", err: "percentages need a referenceNode"},
+		{name: "percentage out of range", config: "rules: [{name: limits, limits: {cpu: 150%, referenceNode: {cpu: 4}}}]\n", err: "expected a percentage between 0 and 100"},
+		{name: "capacity missing", config: "rules: [{name: limits, limits: {memory: 10%, referenceNode: {cpu: 4}}}]\n", err: "referenceNode has no memory"},
+	})
+}
+
+func TestLimitsRuleEphemeralStorage(t *testing.T) {
+	runPatchTests(t, []patchTest{
+		{
+			name:   "alongside cpu and memory",
+			config: "rules: [{name: limits, limits: {cpu: 500m, memory: 256Mi, ephemeralStorage: 1Gi}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      limits:\n        cpu: 500m\n        memory: 256Mi\n        ephemeral-storage: 1Gi\n",
+		},
+		{
+			name:   "on its own",
+			config: "rules: [{name: limits, limits: {ephemeralStorage: 2Gi}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      limits:\n        ephemeral-storage: 2Gi\n",
+		},
+		{
+			name:   "container with limits kept",
+			config: "rules: [{name: limits, limits: {ephemeralStorage: 2Gi}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    resources:\n      limits:\n        ephemeral-storage: 5Gi\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no limits", config: "rules: [{name: limits, limits: {}}]\n", err: "needs at least one of cpu, memory or ephemeralStorage"},
+		{name: "invalid quantity", config: "rules: [{name: limits, limits: {ephemeralStorage: lots}}]\n", err: `invalid ephemeral-storage limit "lots"`},
+	})
+}
+
+func TestEnvRule(t *testing.T) {
+	config := `
+rules:
+- name: debug-env
+  selector:
+    namespaceSelector: {matchLabels: {environment: dev}}
+  env:
+    variables:
+    - {name: GOTRACEBACK, value: all}
+    - {name: LOG_LEVEL, value: debug}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "dev namespace",
+			config: config,
+			opts:   patchOptions{namespaceLabels: map[string]string{"environment": "dev"}},
+			pod:    "spec:\n  containers:\n  - name: app\n    env:\n    - {name: LOG_LEVEL, value: info}\n",
+			want:   "spec:\n  containers:\n  - name: app\n    env:\n    - {name: LOG_LEVEL, value: info}\n    - {name: GOTRACEBACK, value: all}\n",
+		},
+		{
+			name:   "prod namespace",
+			config: config,
+			opts:   patchOptions{namespaceLabels: map[string]string{"environment": "prod"}},
+			pod:    "spec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "unknown namespace",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no variables", config: "rules: [{name: env, env: {variables: []}}]\n", err: "needs at least one variable"},
+		{name: "duplicate variable", config: "rules: [{name: env, env: {variables: [{name: A}, {name: A}]}}]\n", err: `duplicate variable "A"`},
+		{name: "invalid name", config: "rules: [{name: env, env: {variables: [{name: '1A'}]}}]\n", err: `invalid variable name "1A"`},
+	})
+}
+
+func TestEnvRuleVariableNames(t *testing.T) {
+	for _, name := range []string{"GOMAXPROCS", "_private", "spring.profiles.active", "my-var", "A1"} {
+		testConfig(t, "rules: [{name: env, env: {variables: [{name: '"+name+"', value: x}]}}]\n")
+	}
+	var tests []configErrorTest
+	for _, name := range []string{"1A", "MY VAR", "A=B", "FOO$", "ü"} {
+		tests = append(tests, configErrorTest{
+			name:   name,
+			config: "rules: [{name: env, env: {variables: [{name: '" + name + "', value: x}]}}]\n",
+			err:    fmt.Sprintf("invalid variable name %q", name),
+		})
+	}
+	runConfigErrorTests(t, tests)
+}
+
+func TestPodDisruptionBudgetRule(t *testing.T) {
+	pod := "metadata:\n  labels: {app: web}\nspec:\n  containers:\n  - name: app\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "annotation absent",
+			config: "rules: [{name: pdb, podDisruptionBudget: {name: web-pdb}}]\n",
+			pod:    pod,
+			want:   "metadata:\n  labels: {app: web}\n  annotations: {diy-webhook/pod-disruption-budget: web-pdb}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "annotation present",
+			config: "rules: [{name: pdb, podDisruptionBudget: {name: web-pdb}}]\n",
+			pod:    "metadata:\n  annotations: {diy-webhook/pod-disruption-budget: other}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "name from label",
+			config: "rules: [{name: pdb, podDisruptionBudget: {annotation: example.com/pdb, nameFromLabel: app}}]\n",
+			pod:    pod,
+			want:   "metadata:\n  labels: {app: web}\n  annotations: {example.com/pdb: web}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "label absent",
+			config: "rules: [{name: pdb, podDisruptionBudget: {nameFromLabel: team}}]\n",
+			pod:    pod,
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no name", config: "rules: [{name: pdb, podDisruptionBudget: {}}]\n", err: "needs exactly one of name or nameFromLabel"},
+		{name: "both names", config: "rules: [{name: pdb, podDisruptionBudget: {name: a, nameFromLabel: app}}]\n", err: "needs exactly one of name or nameFromLabel"},
+		{name: "invalid name", config: "rules: [{name: pdb, podDisruptionBudget: {name: Web}}]\n", err: `invalid name "Web"`},
+	})
+}
+
+func TestGuaranteedQoSRule(t *testing.T) {
+	// The limits rule runs first, so the requests follow the limits it sets.
+	config := `
+rules:
+- name: limits
+  limits: {cpu: 500m, memory: 256Mi}
+- name: qos
+  guaranteedQoS: {}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "annotation present",
+			config: config,
+			pod:    "metadata:\n  annotations: {diy-webhook/qos: guaranteed}\nspec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: 100m}\n",
+			want: `
+metadata:
+  annotations: {diy-webhook/qos: guaranteed}
+spec:
+  containers:
+  - name: app
+    resources:
+      limits: {cpu: 500m, memory: 256Mi}
+      requests: {cpu: 500m, memory: 256Mi}
+`,
+		},
+		{
+			name:   "annotation absent",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {cpu: 500m, memory: 256Mi}\n",
+		},
+		{
+			name:     "no memory limit",
+			config:   "rules: [{name: qos, guaranteedQoS: {annotation: example.com/qos}}]\n",
+			pod:      "metadata:\n  annotations: {example.com/qos: guaranteed}\nspec:\n  containers:\n  - name: app\n    resources:\n      limits: {cpu: 500m}\n",
+			warnings: []string{"container app needs cpu and memory limits for Guaranteed QoS"},
+		},
+	})
+}
+
+func TestTopologyAwareHintsRule(t *testing.T) {
+	config := "rules: [{name: hints, topologyAwareHints: {}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "no annotations",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  annotations: {service.kubernetes.io/topology-aware-hints: auto}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "other annotations",
+			config: "rules: [{name: hints, topologyAwareHints: {annotation: example.com/hints, value: enabled}}]\n",
+			pod:    "metadata:\n  annotations: {team: web}\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  annotations: {team: web, example.com/hints: enabled}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "annotation kept",
+			config: config,
+			pod:    "metadata:\n  annotations: {service.kubernetes.io/topology-aware-hints: disabled}\nspec:\n  containers:\n  - name: app\n",
+		},
+	})
+
+	// The annotated pod is not patched again.
+	_, patched := mutatePod(t, testPod(t, cachedPod), testConfig(t, config), patchOptions{})
+	if result, _ := mutatePod(t, patched, testConfig(t, config), patchOptions{}); len(result.patch) > 0 {
+		t.Errorf("got patch %v for the annotated pod, want none", result.patch)
+	}
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid annotation", config: "rules: [{name: hints, topologyAwareHints: {annotation: 'a b'}}]\n", err: `invalid annotation "a b"`},
+	})
+}
+
+func TestCostAllocationRule(t *testing.T) {
+	config := `
+rules:
+- name: cost-allocation
+  costAllocation:
+    annotations:
+    - {annotation: team}
+    - {annotation: example.com/cost-center, fromLabel: cost-center, fallback: shared}
+`
+	pod := "spec:\n  containers:\n  - name: app\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "source labels present",
+			config: config,
+			opts:   patchOptions{namespaceLabels: map[string]string{"team": "web", "cost-center": "cc-42"}},
+			pod:    pod,
+			want:   "metadata:\n  annotations: {team: web, example.com/cost-center: cc-42}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "source labels missing",
+			config: config,
+			opts:   patchOptions{namespaceLabels: map[string]string{}},
+			pod:    pod,
+			want:   "metadata:\n  annotations: {example.com/cost-center: shared}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "existing annotation kept",
+			config: config,
+			opts:   patchOptions{namespaceLabels: map[string]string{"team": "web", "cost-center": "cc-42"}},
+			pod:    "metadata:\n  annotations: {team: api}\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  annotations: {team: api, example.com/cost-center: cc-42}\nspec:\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no annotations", config: "rules: [{name: cost, costAllocation: {annotations: []}}]\n", err: "needs at least one annotation"},
+		{name: "invalid label", config: "rules: [{name: cost, costAllocation: {annotations: [{annotation: team, fromLabel: 'a b'}]}}]\n", err: `invalid fromLabel "a b"`},
+	})
+}
+
+func TestTolerationsRule(t *testing.T) {
+	config := `
+rules:
+- name: gpu-pool
+  selector:
+    namespaceSelector: {matchLabels: {pool: gpu}}
+  tolerations:
+    tolerations: [{key: pool, value: gpu, effect: NoSchedule}]
+- name: batch-pool
+  selector:
+    namespaceSelector: {matchLabels: {pool: batch}}
+  tolerations:
+    tolerations: [{key: pool, value: batch, effect: NoSchedule}, {key: batch, operator: Exists}]
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "gpu namespace",
+			config: config,
+			opts:   patchOptions{namespaceLabels: map[string]string{"pool": "gpu"}},
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n  tolerations:\n  - {key: pool, value: gpu, effect: NoSchedule}\n",
+		},
+		{
+			name:   "batch namespace",
+			config: config,
+			opts:   patchOptions{namespaceLabels: map[string]string{"pool": "batch"}},
+			pod:    "spec:\n  containers:\n  - name: app\n  tolerations:\n  - {key: batch, operator: Exists}\n",
+			want:   "spec:\n  containers:\n  - name: app\n  tolerations:\n  - {key: batch, operator: Exists}\n  - {key: pool, value: batch, effect: NoSchedule}\n",
+		},
+		{
+			name:   "unmapped namespace",
+			config: config,
+			opts:   patchOptions{namespaceLabels: map[string]string{"pool": "default"}},
+			pod:    "spec:\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no tolerations", config: "rules: [{name: pool, tolerations: {}}]\n", err: "needs at least one toleration or spot"},
+		{name: "exists with value", config: "rules: [{name: pool, tolerations: {tolerations: [{key: pool, operator: Exists, value: gpu}]}}]\n", err: `toleration "pool" with operator Exists can't have a value`},
+		{name: "empty key", config: "rules: [{name: pool, tolerations: {tolerations: [{value: gpu}]}}]\n", err: "tolerations without a key need operator Exists"},
+	})
+}
+
+func TestReadinessGateRule(t *testing.T) {
+	config := "rules: [{name: gate, readinessGate: {conditionType: example.com/load-balancer-ready}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "no readiness gates",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n  readinessGates:\n  - {conditionType: example.com/load-balancer-ready}\n",
+		},
+		{
+			name:   "other readiness gate",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  readinessGates:\n  - {conditionType: example.com/warmed-up}\n",
+			want:   "spec:\n  containers:\n  - name: app\n  readinessGates:\n  - {conditionType: example.com/warmed-up}\n  - {conditionType: example.com/load-balancer-ready}\n",
+		},
+		{
+			name:   "readiness gate present",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  readinessGates:\n  - {conditionType: example.com/load-balancer-ready}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no condition type", config: "rules: [{name: gate, readinessGate: {}}]\n", err: `invalid readiness gate condition type ""`},
+	})
+}
+
+func TestEmptyDirSizeLimitRule(t *testing.T) {
+	pod := `
+spec:
+  containers:
+  - name: app
+  volumes:
+  - name: config
+    configMap: {name: app}
+  - name: cache
+    emptyDir: {}
+  - name: scratch
+    emptyDir: {medium: Memory, sizeLimit: 64Mi}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "default size limit",
+			config: "rules: [{name: empty-dir, emptyDirSizeLimit: {}}]\n",
+			pod:    pod,
+			want: `
+spec:
+  containers:
+  - name: app
+  volumes:
+  - name: config
+    configMap: {name: app}
+  - name: cache
+    emptyDir: {sizeLimit: 1Gi}
+  - name: scratch
+    emptyDir: {medium: Memory, sizeLimit: 64Mi}
+`,
+		},
+		{
+			name:   "configured size limit",
+			config: "rules: [{name: empty-dir, emptyDirSizeLimit: {sizeLimit: 512Mi}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n  volumes:\n  - name: cache\n    emptyDir: {}\n",
+			want:   "spec:\n  containers:\n  - name: app\n  volumes:\n  - name: cache\n    emptyDir: {sizeLimit: 512Mi}\n",
+		},
+		{
+			name:   "size limits set",
+			config: "rules: [{name: empty-dir, emptyDirSizeLimit: {}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n  volumes:\n  - name: cache\n    emptyDir: {sizeLimit: 2Gi}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "zero size limit", config: "rules: [{name: empty-dir, emptyDirSizeLimit: {sizeLimit: '0'}}]\n", err: "emptyDir sizeLimit must be positive, got 0"},
+	})
+}
+
+func TestFSGroupChangePolicyRule(t *testing.T) {
+	config := "rules: [{name: fs-group, fsGroupChangePolicy: {}}]\n"
+	injecting := "rules: [{name: fs-group, fsGroupChangePolicy: {policy: Always, fsGroup: 2000}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "fsGroup without policy",
+			config: config,
+			pod:    "spec:\n  securityContext: {fsGroup: 1000}\n  containers:\n  - name: app\n",
+			want:   "spec:\n  securityContext: {fsGroup: 1000, fsGroupChangePolicy: OnRootMismatch}\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "policy set",
+			config: config,
+			pod:    "spec:\n  securityContext: {fsGroup: 1000, fsGroupChangePolicy: Always}\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "no fsGroup",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "fsGroup injected without security context",
+			config: injecting,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  securityContext: {fsGroup: 2000, fsGroupChangePolicy: Always}\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "submitted fsGroup kept",
+			config: injecting,
+			pod:    "spec:\n  securityContext: {runAsUser: 1000, fsGroup: 1000}\n  containers:\n  - name: app\n",
+			want:   "spec:\n  securityContext: {runAsUser: 1000, fsGroup: 1000, fsGroupChangePolicy: Always}\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "unknown policy", config: "rules: [{name: fs-group, fsGroupChangePolicy: {policy: Never}}]\n", err: `unknown fsGroupChangePolicy "Never"`},
+		{name: "negative fsGroup", config: "rules: [{name: fs-group, fsGroupChangePolicy: {fsGroup: -1}}]\n", err: "fsGroup must not be negative, got -1"},
+	})
+}
+
+func TestWorkingDirRule(t *testing.T) {
+	config := `
+rules:
+- name: legacy-working-dir
+  selector:
+    images: ["registry.example.com/legacy/*"]
+  workingDir: {path: /opt/app}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "empty workingDir",
+			config: config,
+			pod: `
+spec:
+  containers:
+  - name: legacy
+    image: registry.example.com/legacy/billing:1.0
+  - name: app
+    image: registry.example.com/app:1.0
+`,
+			want: `
+spec:
+  containers:
+  - name: legacy
+    image: registry.example.com/legacy/billing:1.0
+    workingDir: /opt/app
+  - name: app
+    image: registry.example.com/app:1.0
+`,
+		},
+		{
+			name:   "set workingDir kept",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: legacy\n    image: registry.example.com/legacy/billing:1.0\n    workingDir: /srv\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "relative path", config: "rules: [{name: working-dir, workingDir: {path: app}}]\n", err: `workingDir path must be absolute, got "app"`},
+	})
+}
+
+func TestPrivilegeEscalationRule(t *testing.T) {
+	config := "rules: [{name: escalation, privilegeEscalation: {deny: true}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "unset",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  - name: sidecar\n    securityContext: {runAsNonRoot: true}\n",
+			want: `
+spec:
+  containers:
+  - name: app
+    securityContext: {allowPrivilegeEscalation: false}
+  - name: sidecar
+    securityContext: {runAsNonRoot: true, allowPrivilegeEscalation: false}
+`,
+		},
+		{
+			name:    "true denied",
+			config:  config,
+			pod:     "spec:\n  containers:\n  - name: app\n    securityContext: {allowPrivilegeEscalation: true}\n",
+			denials: []string{"container app sets allowPrivilegeEscalation to true"},
+		},
+		{
+			name:   "true without deny",
+			config: "rules: [{name: escalation, privilegeEscalation: {}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    securityContext: {allowPrivilegeEscalation: true}\n",
+		},
+		{
+			name:   "false",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n    securityContext: {allowPrivilegeEscalation: false}\n",
+		},
+		{
+			name:   "privileged",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n    securityContext: {privileged: true}\n",
+		},
+	})
+
+	captureLogs(t)
+	wh := testWebhook(t, config)
+	response := admissionResponse(t, wh.mutate, podReview(t, testPod(t, "metadata:\n  namespace: default\nspec:\n  containers:\n  - name: app\n    securityContext: {allowPrivilegeEscalation: true}\n")))
+	if response.Allowed || response.Result == nil || response.Result.Code != http.StatusForbidden || response.Result.Message != "test-webhook: container app sets allowPrivilegeEscalation to true" {
+		t.Errorf("got allowed %v and result %v, want the pod denied", response.Allowed, response.Result)
+	}
+}
+
+func TestDropCapabilitiesRule(t *testing.T) {
+	runPatchTests(t, []patchTest{
+		{
+			name:   "without capabilities",
+			config: "rules: [{name: capabilities, dropCapabilities: {add: [NET_BIND_SERVICE]}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n  - name: sidecar\n    securityContext: {runAsNonRoot: true}\n",
+			want: `
+spec:
+  containers:
+  - name: app
+    securityContext:
+      capabilities: {add: [NET_BIND_SERVICE], drop: [ALL]}
+  - name: sidecar
+    securityContext:
+      runAsNonRoot: true
+      capabilities: {add: [NET_BIND_SERVICE], drop: [ALL]}
+`,
+		},
+		{
+			name:   "existing capabilities kept",
+			config: "rules: [{name: capabilities, dropCapabilities: {}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    securityContext:\n      capabilities: {add: [SYS_TIME]}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "ALL added", config: "rules: [{name: capabilities, dropCapabilities: {add: [ALL]}}]\n", err: `invalid capability "ALL"`},
+		{name: "lowercase", config: "rules: [{name: capabilities, dropCapabilities: {add: [net_admin]}}]\n", err: `invalid capability "net_admin"`},
+	})
+}
+
+func TestTolerationsRuleSpot(t *testing.T) {
+	config := `
+rules:
+- name: spot
+  selector:
+    podSelector: {matchLabels: {workload: batch}}
+  tolerations: {spot: true}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "matching pod",
+			config: config,
+			pod:    "metadata:\n  labels: {workload: batch}\nspec:\n  containers:\n  - name: job\n",
+			want: `
+metadata:
+  labels: {workload: batch}
+spec:
+  containers:
+  - name: job
+  tolerations:
+  - {key: cloud.google.com/gke-spot, operator: Equal, value: "true", effect: NoSchedule}
+  - {key: cloud.google.com/gke-preemptible, operator: Equal, value: "true", effect: NoSchedule}
+  - {key: kubernetes.azure.com/scalesetpriority, operator: Equal, value: spot, effect: NoSchedule}
+`,
+		},
+		{
+			name:   "existing toleration not duplicated",
+			config: config,
+			pod: `
+metadata:
+  labels: {workload: batch}
+spec:
+  containers:
+  - name: job
+  tolerations:
+  - {key: cloud.google.com/gke-spot, operator: Equal, value: "true", effect: NoSchedule}
+`,
+			want: `
+metadata:
+  labels: {workload: batch}
+spec:
+  containers:
+  - name: job
+  tolerations:
+  - {key: cloud.google.com/gke-spot, operator: Equal, value: "true", effect: NoSchedule}
+  - {key: cloud.google.com/gke-preemptible, operator: Equal, value: "true", effect: NoSchedule}
+  - {key: kubernetes.azure.com/scalesetpriority, operator: Equal, value: spot, effect: NoSchedule}
+`,
+		},
+		{
+			name:   "non-matching pod",
+			config: config,
+			pod:    "metadata:\n  labels: {workload: web}\nspec:\n  containers:\n  - name: app\n",
+		},
+	})
+}
+
+func TestLimitsFromRequestsRule(t *testing.T) {
+	runPatchTests(t, []patchTest{
+		{
+			name:   "twice the requests",
+			config: "rules: [{name: limits, limitsFromRequests: {cpu: 2, memory: 2}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: 250m, memory: 100M}\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: 250m, memory: 100M}\n      limits: {cpu: 500m, memory: 200M}\n",
+		},
+		{
+			name:   "fractional ratios",
+			config: "rules: [{name: limits, limitsFromRequests: {cpu: 1.5, memory: 1.5, ephemeralStorage: 3}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: '1', memory: 128Mi, ephemeral-storage: 1Gi}\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: '1', memory: 128Mi, ephemeral-storage: 1Gi}\n      limits: {cpu: 1500m, memory: 192Mi, ephemeral-storage: 3Gi}\n",
+		},
+		{
+			name:   "rounded up to millicores",
+			config: "rules: [{name: limits, limitsFromRequests: {cpu: 1.3}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: 5m}\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: 5m}\n      limits: {cpu: 7m}\n",
+		},
+		{
+			name:   "existing limit and missing request",
+			config: "rules: [{name: limits, limitsFromRequests: {cpu: 2, memory: 2}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: 250m, memory: 64Mi}\n      limits: {cpu: '1'}\n  - name: sidecar\n    resources:\n      requests: {memory: 32Mi}\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      requests: {cpu: 250m, memory: 64Mi}\n      limits: {cpu: '1', memory: 128Mi}\n  - name: sidecar\n    resources:\n      requests: {memory: 32Mi}\n      limits: {memory: 64Mi}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no ratio", config: "rules: [{name: limits, limitsFromRequests: {}}]\n", err: "needs a ratio for at least one of"},
+		{name: "ratio below 1", config: "rules: [{name: limits, limitsFromRequests: {memory: 0.5}}]\n", err: "invalid memory ratio 0.5"},
+	})
+}
+
+func TestPodAntiAffinityRuleRequired(t *testing.T) {
+	resetMetrics(t)
+	captureLogs(t)
+	replicas := int32(3)
+	pod := "metadata:\n  namespace: default\n  labels: {app: web}\nspec:\n  containers:\n  - name: app\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "required warns",
+			config: "rules: [{name: spread, podAntiAffinity: {type: required, topologyKey: topology.kubernetes.io/zone}}]\n",
+			opts:   patchOptions{replicas: &replicas},
+			pod:    pod,
+			want: `
+metadata:
+  namespace: default
+  labels: {app: web}
+spec:
+  containers:
+  - name: app
+  affinity:
+    podAntiAffinity:
+      requiredDuringSchedulingIgnoredDuringExecution:
+      - labelSelector: {matchLabels: {app: web}}
+        topologyKey: topology.kubernetes.io/zone
+`,
+			warnings: []string{"injected required pod anti-affinity on topology.kubernetes.io/zone, replicas beyond the number of topology domains stay pending"},
+		},
+		{
+			name:   "preferred by default",
+			config: "rules: [{name: preferred, podAntiAffinity: {}}]\n",
+			opts:   patchOptions{replicas: &replicas},
+			pod:    pod,
+			want: `
+metadata:
+  namespace: default
+  labels: {app: web}
+spec:
+  containers:
+  - name: app
+  affinity:
+    podAntiAffinity:
+      preferredDuringSchedulingIgnoredDuringExecution:
+      - weight: 100
+        podAffinityTerm:
+          labelSelector: {matchLabels: {app: web}}
+          topologyKey: kubernetes.io/hostname
+`,
+		},
+	})
+	if warnings := testutil.ToFloat64(ruleWarnings.WithLabelValues("spread", "default")); warnings != 1 {
+		t.Errorf("counted %v warnings, want 1", warnings)
+	}
+}
+
+func TestMemoryEnvRule(t *testing.T) {
+	config := `
+rules:
+- name: limits
+  limits: {memory: 512Mi}
+- name: gc-tuning
+  memoryEnv:
+    variables:
+    - {name: GOMEMLIMIT, ratio: 0.9, unit: MiB, value: "{{.}}MiB"}
+    - {name: JAVA_TOOL_OPTIONS, ratio: 0.75, unit: MiB, value: "-Xmx{{.}}m"}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "limit set by an earlier rule",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want: `
+spec:
+  containers:
+  - name: app
+    resources:
+      limits: {memory: 512Mi}
+    env:
+    - {name: GOMEMLIMIT, value: 460MiB}
+    - {name: JAVA_TOOL_OPTIONS, value: -Xmx384m}
+`,
+		},
+		{
+			name:   "variable set",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {memory: 1Gi}\n    env:\n    - {name: GOMEMLIMIT, value: 800MiB}\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {memory: 1Gi}\n    env:\n    - {name: GOMEMLIMIT, value: 800MiB}\n    - {name: JAVA_TOOL_OPTIONS, value: -Xmx768m}\n",
+		},
+		{
+			name:   "bytes by default",
+			config: "rules: [{name: gc-tuning, memoryEnv: {variables: [{name: MEMORY_LIMIT}]}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {memory: 64Mi}\n  - name: sidecar\n",
+			want:   "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {memory: 64Mi}\n    env:\n    - {name: MEMORY_LIMIT, value: \"67108864\"}\n  - name: sidecar\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no variables", config: "rules: [{name: gc, memoryEnv: {variables: []}}]\n", err: "needs at least one variable"},
+		{name: "ratio above 1", config: "rules: [{name: gc, memoryEnv: {variables: [{name: GOMEMLIMIT, ratio: 1.5}]}}]\n", err: "variable GOMEMLIMIT: invalid ratio 1.5"},
+		{name: "unknown unit", config: "rules: [{name: gc, memoryEnv: {variables: [{name: GOMEMLIMIT, unit: MB}]}}]\n", err: `unknown unit "MB"`},
+		{name: "invalid template", config: "rules: [{name: gc, memoryEnv: {variables: [{name: GOMEMLIMIT, value: '{{'}]}}]\n", err: "invalid value template"},
+	})
+}
+
+func TestLimitProfilesRule(t *testing.T) {
+	config := `
+rules:
+- name: profiles
+  limitProfiles:
+    default: small
+    profiles:
+      small: {cpu: 100m, memory: 128Mi}
+      large: {cpu: "2", memory: 4Gi}
+`
+	small := "spec:\n  containers:\n  - name: app\n    resources:\n      limits: {cpu: 100m, memory: 128Mi}\n"
+	runPatchTests(t, []patchTest{
+		{name: "default profile", config: config, pod: "spec:\n  containers:\n  - name: app\n", want: small},
+		{
+			name:   "profile selected by label",
+			config: config,
+			pod:    "metadata:\n  labels: {diy-webhook/profile: large}\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  labels: {diy-webhook/profile: large}\nspec:\n  containers:\n  - name: app\n    resources:\n      limits: {cpu: \"2\", memory: 4Gi}\n",
+		},
+		{
+			name:     "unknown profile",
+			config:   config,
+			pod:      "metadata:\n  labels: {diy-webhook/profile: huge}\nspec:\n  containers:\n  - name: app\n",
+			want:     "metadata:\n  labels: {diy-webhook/profile: huge}\n" + small,
+			warnings: []string{`unknown limit profile "huge" in label diy-webhook/profile`},
+		},
+		{
+			name:   "custom label without default",
+			config: "rules: [{name: profiles, limitProfiles: {label: example.com/size, profiles: {large: {memory: 4Gi}}}}]\n",
+			pod:    "metadata:\n  labels: {diy-webhook/profile: large}\nspec:\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no profiles", config: "rules: [{name: profiles, limitProfiles: {profiles: {}}}]\n", err: "needs at least one profile"},
+		{name: "unknown default", config: "rules: [{name: profiles, limitProfiles: {default: medium, profiles: {small: {cpu: 100m}}}}]\n", err: `unknown default profile "medium"`},
+		{name: "invalid label", config: "rules: [{name: profiles, limitProfiles: {label: 'not a label', profiles: {small: {cpu: 100m}}}}]\n", err: `invalid label "not a label"`},
+		{name: "invalid limits", config: "rules: [{name: profiles, limitProfiles: {profiles: {small: {cpu: lots}}}}]\n", err: `profile "small"`},
+	})
+}
+
+func TestStdinTTYRule(t *testing.T) {
+	config := "rules: [{name: stdin-tty, stdinTTY: {}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "stdin and tty turned off",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n    stdin: true\n    stdinOnce: true\n    tty: true\n  - name: sidecar\n    tty: true\n",
+			want:   "spec:\n  containers:\n  - name: app\n  - name: sidecar\n",
+		},
+		{name: "non-interactive pod untouched", config: config, pod: "spec:\n  containers:\n  - name: app\n"},
+		{
+			name:   "interactive pod",
+			config: config,
+			pod:    "metadata:\n  annotations: {diy-webhook/interactive: \"true\"}\nspec:\n  containers:\n  - name: app\n    stdin: true\n    tty: true\n",
+		},
+		{
+			name:   "custom annotation",
+			config: "rules: [{name: stdin-tty, stdinTTY: {annotation: example.com/debug}}]\n",
+			pod:    "metadata:\n  annotations: {example.com/debug: \"true\", diy-webhook/interactive: \"false\"}\nspec:\n  containers:\n  - name: app\n    stdin: true\n",
+		},
+		{
+			name:   "annotation not true",
+			config: config,
+			pod:    "metadata:\n  annotations: {diy-webhook/interactive: \"false\"}\nspec:\n  containers:\n  - name: app\n    stdin: true\n",
+			want:   "metadata:\n  annotations: {diy-webhook/interactive: \"false\"}\nspec:\n  containers:\n  - name: app\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid annotation", config: "rules: [{name: stdin-tty, stdinTTY: {annotation: 'a b'}}]\n", err: `invalid annotation "a b"`},
+	})
+}
+
+func TestPreferredNodeAffinityRule(t *testing.T) {
+	config := `
+rules:
+- name: spot
+  preferredNodeAffinity:
+    preferences:
+    - weight: 100
+      preference:
+        matchExpressions: [{key: karpenter.sh/capacity-type, operator: In, values: [spot]}]
+    - weight: 1
+      preference:
+        matchExpressions: [{key: karpenter.sh/capacity-type, operator: In, values: [on-demand]}]
+`
+	nodeAffinity := `
+      preferredDuringSchedulingIgnoredDuringExecution:
+      - weight: 100
+        preference:
+          matchExpressions: [{key: karpenter.sh/capacity-type, operator: In, values: [spot]}]
+      - weight: 1
+        preference:
+          matchExpressions: [{key: karpenter.sh/capacity-type, operator: In, values: [on-demand]}]
+`
+	podAntiAffinity := "    podAntiAffinity:\n      preferredDuringSchedulingIgnoredDuringExecution:\n      - weight: 1\n        podAffinityTerm: {topologyKey: kubernetes.io/hostname}\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "affinity created",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n  affinity:\n    nodeAffinity:" + nodeAffinity,
+		},
+		{
+			name:   "node affinity added to the affinity",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  affinity:\n" + podAntiAffinity,
+			want:   "spec:\n  containers:\n  - name: app\n  affinity:\n" + podAntiAffinity + "    nodeAffinity:" + nodeAffinity,
+		},
+		{
+			name:   "node affinity kept",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  affinity:\n    nodeAffinity:\n      preferredDuringSchedulingIgnoredDuringExecution:\n      - weight: 10\n        preference:\n          matchExpressions: [{key: zone, operator: Exists}]\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no preferences", config: "rules: [{name: spot, preferredNodeAffinity: {preferences: []}}]\n", err: "needs at least one preference"},
+		{name: "invalid weight", config: "rules: [{name: spot, preferredNodeAffinity: {preferences: [{weight: 0, preference: {matchExpressions: [{key: zone, operator: Exists}]}}]}}]\n", err: "preference 0: invalid weight 0"},
+		{name: "empty preference", config: "rules: [{name: spot, preferredNodeAffinity: {preferences: [{weight: 1, preference: {}}]}}]\n", err: "preference 0 needs matchExpressions or matchFields"},
+		{name: "invalid operator", config: "rules: [{name: spot, preferredNodeAffinity: {preferences: [{weight: 1, preference: {matchExpressions: [{key: zone, operator: Equals}]}}]}}]\n", err: `invalid operator "Equals"`},
+	})
+}
+
+func TestPostStartRule(t *testing.T) {
+	config := "rules: [{name: warm-cache, postStart: {exec: {command: [/bin/warm, --cache]}}}]\n"
+	hook := "      postStart:\n        exec:\n          command: [/bin/warm, --cache]\n"
+	preStop := "      preStop:\n        exec:\n          command: [/bin/drain]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "lifecycle created",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    lifecycle:\n" + hook,
+		},
+		{
+			name:   "preStop hook kept",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n    lifecycle:\n" + preStop,
+			want:   "spec:\n  containers:\n  - name: app\n    lifecycle:\n" + hook + preStop,
+		},
+		{
+			name:   "postStart hook kept",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n    lifecycle:\n      postStart:\n        exec:\n          command: [/bin/true]\n",
+		},
+		{
+			name:   "httpGet hook",
+			config: "rules: [{name: warm-cache, postStart: {httpGet: {path: /warm, port: 8080}}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n    lifecycle:\n      postStart:\n        httpGet: {path: /warm, port: 8080}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no handler", config: "rules: [{name: hook, postStart: {}}]\n", err: "needs exec or httpGet"},
+		{name: "both handlers", config: "rules: [{name: hook, postStart: {exec: {command: [/bin/true]}, httpGet: {port: 80}}}]\n", err: "either exec or httpGet, not both"},
+		{name: "tcpSocket", config: "rules: [{name: hook, postStart: {tcpSocket: {port: 80}}}]\n", err: "doesn't support tcpSocket"},
+		{name: "empty command", config: "rules: [{name: hook, postStart: {exec: {command: []}}}]\n", err: "needs an exec command"},
+		{name: "no port", config: "rules: [{name: hook, postStart: {httpGet: {path: /warm}}}]\n", err: "needs an httpGet port"},
+	})
+}
+
+func TestHostPortsRule(t *testing.T) {
+	ports := "spec:\n  containers:\n  - name: app\n    ports:\n    - {containerPort: 80, hostPort: 8080}\n    - {containerPort: 9090}\n  - name: sidecar\n    ports:\n    - {containerPort: 15001, hostPort: 15001}\n  - name: metrics\n"
+	strip := "rules: [{name: host-ports, hostPorts: {action: strip}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:    "denied by default",
+			config:  "rules: [{name: host-ports, hostPorts: {}}]\n",
+			pod:     ports,
+			denials: []string{"host ports are declared by containers app, sidecar"},
+		},
+		{
+			name:     "stripped",
+			config:   strip,
+			pod:      ports,
+			want:     "spec:\n  containers:\n  - name: app\n    ports:\n    - {containerPort: 80}\n    - {containerPort: 9090}\n  - name: sidecar\n    ports:\n    - {containerPort: 15001}\n  - name: metrics\n",
+			warnings: []string{"removed the host ports of containers app, sidecar"},
+		},
+		{
+			name:     "host network kept",
+			config:   strip,
+			pod:      "spec:\n  hostNetwork: true\n  containers:\n  - name: app\n    ports:\n    - {containerPort: 80, hostPort: 80}\n",
+			warnings: []string{"host ports of containers app not removed, the pod uses the host network"},
+		},
+		{
+			name:   "no host ports",
+			config: "rules: [{name: host-ports, hostPorts: {}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n    ports:\n    - {containerPort: 80}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "invalid action", config: "rules: [{name: host-ports, hostPorts: {action: warn}}]\n", err: `invalid hostPorts action "warn"`},
+	})
+}
+
+func TestSysctlsRule(t *testing.T) {
+	config := `
+rules:
+- name: sysctls
+  sysctls:
+    allowedUnsafeSysctls: [net.core.somaxconn]
+    sysctls:
+    - {name: net.core.somaxconn, value: "1024"}
+    - {name: net.ipv4.ip_unprivileged_port_start, value: "0"}
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "security context created",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  containers:\n  - name: app\n  securityContext:\n    sysctls:\n    - {name: net.core.somaxconn, value: \"1024\"}\n    - {name: net.ipv4.ip_unprivileged_port_start, value: \"0\"}\n",
+		},
+		{
+			name:   "sysctls created in the security context",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  securityContext: {runAsNonRoot: true}\n",
+			want:   "spec:\n  containers:\n  - name: app\n  securityContext:\n    runAsNonRoot: true\n    sysctls:\n    - {name: net.core.somaxconn, value: \"1024\"}\n    - {name: net.ipv4.ip_unprivileged_port_start, value: \"0\"}\n",
+		},
+		{
+			name:   "pod values kept",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  securityContext:\n    sysctls:\n    - {name: net.core.somaxconn, value: \"4096\"}\n",
+			want:   "spec:\n  containers:\n  - name: app\n  securityContext:\n    sysctls:\n    - {name: net.core.somaxconn, value: \"4096\"}\n    - {name: net.ipv4.ip_unprivileged_port_start, value: \"0\"}\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no sysctls", config: "rules: [{name: sysctls, sysctls: {sysctls: []}}]\n", err: "needs at least one sysctl"},
+		{name: "invalid name", config: "rules: [{name: sysctls, sysctls: {sysctls: [{name: 'net..core', value: '1'}]}}]\n", err: `invalid sysctl name "net..core"`},
+		{name: "unsafe sysctl", config: "rules: [{name: sysctls, sysctls: {sysctls: [{name: net.core.somaxconn, value: '1024'}]}}]\n", err: "sysctl net.core.somaxconn is not safe"},
+		{name: "duplicate sysctl", config: "rules: [{name: sysctls, sysctls: {sysctls: [{name: kernel.shm_rmid_forced, value: '1'}, {name: kernel.shm_rmid_forced, value: '0'}]}}]\n", err: "duplicate sysctl kernel.shm_rmid_forced"},
+	})
+}
+
+func TestMeshSidecarRule(t *testing.T) {
+	config := "rules: [{name: mesh, meshSidecar: {annotations: {proxy.istio.io/config: '{holdApplicationUntilProxyStarts: true}'}}}]\n"
+	annotated := "metadata:\n  annotations:\n    proxy.istio.io/config: '{holdApplicationUntilProxyStarts: true}'\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "injected sidecar",
+			config: config,
+			pod:    "spec:\n  containers:\n  - name: app\n  - name: istio-proxy\n",
+			want:   annotated + "spec:\n  containers:\n  - name: app\n  - name: istio-proxy\n",
+		},
+		{
+			name:   "native sidecar",
+			config: config,
+			pod:    "spec:\n  initContainers:\n  - name: linkerd-proxy\n  containers:\n  - name: app\n",
+			want:   annotated + "spec:\n  initContainers:\n  - name: linkerd-proxy\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "injection requested",
+			config: config,
+			pod:    "metadata:\n  annotations: {linkerd.io/inject: enabled}\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  annotations:\n    linkerd.io/inject: enabled\n    proxy.istio.io/config: '{holdApplicationUntilProxyStarts: true}'\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "injection turned off",
+			config: config,
+			pod:    "metadata:\n  annotations: {sidecar.istio.io/inject: \"false\"}\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "annotation kept",
+			config: config,
+			pod:    "metadata:\n  annotations: {proxy.istio.io/config: '{}'}\nspec:\n  containers:\n  - name: istio-proxy\n",
+		},
+		{
+			name:   "custom sidecar",
+			config: "rules: [{name: mesh, meshSidecar: {containers: [envoy], annotations: {example.com/mesh: \"true\"}}}]\n",
+			pod:    "spec:\n  containers:\n  - name: envoy\n  - name: istio-proxy\n",
+			want:   "metadata:\n  annotations: {example.com/mesh: \"true\"}\nspec:\n  containers:\n  - name: envoy\n  - name: istio-proxy\n",
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no annotations", config: "rules: [{name: mesh, meshSidecar: {}}]\n", err: "needs at least one annotation"},
+		{name: "invalid annotation", config: "rules: [{name: mesh, meshSidecar: {annotations: {'a b': x}}}]\n", err: `invalid annotation "a b"`},
+		{name: "invalid inject annotation", config: "rules: [{name: mesh, meshSidecar: {injectAnnotations: ['a b'], annotations: {a: b}}}]\n", err: `invalid inject annotation "a b"`},
+	})
+}
+
+func TestSubdomainRule(t *testing.T) {
+	fromLabel := "rules: [{name: subdomain, subdomain: {fromLabel: app.kubernetes.io/name}}]\n"
+	runPatchTests(t, []patchTest{
+		{
+			name:   "fixed subdomain",
+			config: "rules: [{name: subdomain, subdomain: {subdomain: cluster}}]\n",
+			pod:    "spec:\n  containers:\n  - name: app\n",
+			want:   "spec:\n  subdomain: cluster\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "subdomain from label",
+			config: fromLabel,
+			pod:    "metadata:\n  labels: {app.kubernetes.io/name: kafka}\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  labels: {app.kubernetes.io/name: kafka}\nspec:\n  subdomain: kafka\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "explicit subdomain kept",
+			config: fromLabel,
+			pod:    "metadata:\n  labels: {app.kubernetes.io/name: kafka}\nspec:\n  subdomain: brokers\n  containers:\n  - name: app\n",
+		},
+		{name: "label missing", config: fromLabel, pod: "spec:\n  containers:\n  - name: app\n"},
+		{
+			name:     "invalid label value",
+			config:   fromLabel,
+			pod:      "metadata:\n  labels: {app.kubernetes.io/name: Kafka_Brokers}\nspec:\n  containers:\n  - name: app\n",
+			warnings: []string{"label app.kubernetes.io/name=Kafka_Brokers is not a valid subdomain, subdomain not set"},
+		},
+	})
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "neither", config: "rules: [{name: subdomain, subdomain: {}}]\n", err: "exactly one of subdomain or fromLabel"},
+		{name: "both", config: "rules: [{name: subdomain, subdomain: {subdomain: cluster, fromLabel: app}}]\n", err: "exactly one of subdomain or fromLabel"},
+		{name: "invalid subdomain", config: "rules: [{name: subdomain, subdomain: {subdomain: my.cluster}}]\n", err: `invalid subdomain "my.cluster"`},
+		{name: "invalid label", config: "rules: [{name: subdomain, subdomain: {fromLabel: 'a b'}}]\n", err: `invalid label "a b"`},
+	})
+}
+
+func TestAnnotationsRule(t *testing.T) {
+	config := `
+rules:
+- name: network-policy
+  selector:
+    podSelector: {matchLabels: {tier: backend}}
+  annotations:
+    annotations:
+      cni.example.com/policy-group: backend
+      cni.example.com/egress: restricted
+`
+	runPatchTests(t, []patchTest{
+		{
+			name:   "annotations created",
+			config: config,
+			pod:    "metadata:\n  labels: {tier: backend}\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  labels: {tier: backend}\n  annotations:\n    cni.example.com/policy-group: backend\n    cni.example.com/egress: restricted\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "pod value kept",
+			config: config,
+			pod:    "metadata:\n  labels: {tier: backend}\n  annotations:\n    cni.example.com/egress: open\nspec:\n  containers:\n  - name: app\n",
+			want:   "metadata:\n  labels: {tier: backend}\n  annotations:\n    cni.example.com/egress: open\n    cni.example.com/policy-group: backend\nspec:\n  containers:\n  - name: app\n",
+		},
+		{
+			name:   "other pods untouched",
+			config: config,
+			pod:    "metadata:\n  labels: {tier: frontend}\nspec:\n  containers:\n  - name: app\n",
+		},
+	})
+
+	// A readmitted pod already has the annotations.
+	_, patched := mutatePod(t, testPod(t, "metadata:\n  labels: {tier: backend}\nspec:\n  containers:\n  - name: app\n"), testConfig(t, config), patchOptions{})
+	if result, _ := mutatePod(t, patched, testConfig(t, config), patchOptions{}); len(result.patch) > 0 {
+		t.Errorf("got patch %v for a readmitted pod, want none", result.patch)
+	}
+
+	runConfigErrorTests(t, []configErrorTest{
+		{name: "no annotations", config: "rules: [{name: annotations, annotations: {annotations: {}}}]\n", err: "needs at least one annotation"},
+		{name: "invalid annotation", config: "rules: [{name: annotations, annotations: {annotations: {'a b': x}}}]\n", err: `invalid annotation "a b"`},
+	})
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	OutputJSONPatch           = "jsonpatch"
+	OutputStrategicMergePatch = "smp"
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Print the patch the webhook would apply to a pod",
+	Long: `Print the patch the webhook would apply to a pod, without running the server.
+Example:
+mutating-webhook simulate --pod <pod.yaml> [--config <config>] [--namespace-labels <key=value,...>] [--output jsonpatch|smp]`,
+	RunE: runSimulate,
+}
+
+func init() {
+	simulateCmd.Flags().String("pod", "", "Path to the pod manifest (YAML or JSON)")
+	simulateCmd.Flags().String("config", "", "Path to the mutation config file, the config embedded in the binary is used if not set")
+	simulateCmd.Flags().StringToString("namespace-labels", nil, "Labels of the pod namespace, matched by namespace selectors")
+	simulateCmd.Flags().String("output", OutputJSONPatch, "Output format: jsonpatch or smp (strategic merge patch, as used by kubectl patch)")
+	rootCmd.AddCommand(simulateCmd)
+}
+
+func runSimulate(cmd *cobra.Command, _ []string) error {
+	podFile, err := cmd.Flags().GetString("pod")
+	if err != nil {
+		return err
+	}
+	if len(podFile) == 0 {
+		return errors.New("please provide a pod manifest")
+	}
+	configFile, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	if output != OutputJSONPatch && output != OutputStrategicMergePatch {
+		return fmt.Errorf("unknown output format %q, expected %s or %s", output, OutputJSONPatch, OutputStrategicMergePatch)
+	}
+
+	namespaceLabels, err := cmd.Flags().GetStringToString("namespace-labels")
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(podFile)
+	if err != nil {
+		return fmt.Errorf("can't read pod manifest: %v", err)
+	}
+	pod := corev1.Pod{}
+	if err := yaml.Unmarshal(data, &pod); err != nil {
+		return fmt.Errorf("can't decode pod manifest: %v", err)
+	}
+
+	result := &mutationResult{}
+	if config.disabled() {
+		fmt.Fprintln(cmd.ErrOrStderr(), "Warning: the webhook is disabled by the config, pods are admitted unchanged")
+	} else if result, err = computePatch(&pod, config, patchOptions{namespaceLabels: namespaceLabels, skipMetrics: true}); err != nil {
+		return err
+	}
+	for _, warning := range result.warnings {
+		fmt.Fprintf(cmd.ErrOrStderr(), "Warning: %s\n", warning)
+	}
+	if len(result.denials) > 0 {
+		return fmt.Errorf("pod would be denied: %s", strings.Join(result.denials, "; "))
+	}
+	var out []byte
+	if output == OutputStrategicMergePatch {
+		out, err = strategicMergePatch(&pod, result.patch)
+	} else {
+		out, err = json.MarshalIndent(append([]patchOperation{}, result.patch...), "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), string(out))
+	return nil
+}
+
+// strategicMergePatch renders the JSONPatch as the equivalent strategic merge patch, by applying it to the pod
+// and diffing the result against the original.
+func strategicMergePatch(pod *corev1.Pod, patch []patchOperation) ([]byte, error) {
+	original, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := applyPatch(pod, patch)
+	if err != nil {
+		return nil, err
+	}
+	smp, err := strategicpatch.CreateTwoWayMergePatch(original, patched, corev1.Pod{})
+	if err != nil {
+		return nil, fmt.Errorf("can't create strategic merge patch: %v", err)
+	}
+	return smp, nil
+}
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestStrategicMergePatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		pod   string
+		patch []patchOperation
+		want  string
+	}{
+		{
+			name: "container limits",
+			pod: `
+spec:
+  containers:
+  - name: app
+  - name: sidecar
+`,
+			patch: []patchOperation{{Op: "add", Path: "/spec/containers/1/resources/limits", Value: map[string]string{"cpu": "100m"}}},
+			want:  `{"spec":{"$setElementOrder/containers":[{"name":"app"},{"name":"sidecar"}],"containers":[{"name":"sidecar","resources":{"limits":{"cpu":"100m"}}}]}}`,
+		},
+		{
+			name: "annotations",
+			pod: `
+metadata:
+  annotations:
+    a: "1"
+spec:
+  containers:
+  - name: app
+`,
+			patch: []patchOperation{{Op: "add", Path: "/metadata/annotations/b", Value: "2"}},
+			want:  `{"metadata":{"annotations":{"b":"2"}}}`,
+		},
+		{
+			name: "empty patch",
+			pod:  "spec:\n  containers:\n  - name: app\n",
+			want: `{}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			smp, err := strategicMergePatch(testPod(t, test.pod), test.patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(smp) != test.want {
+				t.Errorf("got %s, want %s", smp, test.want)
+			}
+		})
+	}
+}
+
+func TestSimulateOutput(t *testing.T) {
+	dir := t.TempDir()
+	podFile := filepath.Join(dir, "pod.yaml")
+	if err := ioutil.WriteFile(podFile, []byte("spec:\n  containers:\n  - name: app\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(configFile, []byte("pin: {annotation: example.com/pinned}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{output: OutputStrategicMergePatch, want: `{"spec":{"$setElementOrder/containers":[{"name":"app"}],"containers":[{"name":"app","resources":{"limits":{"cpu":"100m","memory":"100Mi"}}}]}}` + "\n"},
+		{output: OutputJSONPatch, want: `[
+  {
+    "op": "add",
+    "path": "/spec/containers/0/resources/limits",
+    "value": {
+      "cpu": "100m",
+      "memory": "100Mi"
+    }
+  }
+]
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.output, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			simulateCmd.SetOut(out)
+			for name, value := range map[string]string{"pod": podFile, "config": configFile, "output": test.output} {
+				if err := simulateCmd.Flags().Set(name, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := runSimulate(simulateCmd, nil); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != test.want {
+				t.Errorf("got %s, want %s", out, test.want)
+			}
+		})
+	}
+}
+
+func TestSimulateConfiguredRules(t *testing.T) {
+	dir := t.TempDir()
+	podFile := filepath.Join(dir, "pod.yaml")
+	if err := ioutil.WriteFile(podFile, []byte("spec:\n  containers:\n  - name: app\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The configured rules replace the default ones.
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(configFile, []byte("rules: [{name: pull-policy, imagePullPolicy: {default: IfNotPresent}}]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	simulateCmd.SetOut(out)
+	for name, value := range map[string]string{"pod": podFile, "config": configFile, "output": OutputStrategicMergePatch} {
+		if err := simulateCmd.Flags().Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runSimulate(simulateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"spec":{"$setElementOrder/containers":[{"name":"app"}],"containers":[{"imagePullPolicy":"IfNotPresent","name":"app"}]}}` + "\n"; out.String() != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/dirien/k8s-diy-mutating-webhook"
+
+// setupTracing installs the tracer provider and the W3C trace context propagator, so spans continue the
+// traces the API server sends along with admission requests.
+func setupTracing() {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// startSpan starts a span for the request, as a child of the trace propagated in its headers.
+func startSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return otel.Tracer(tracerName).Start(ctx, name)
+}
+
+// requestLogger returns a logger writing like l that adds the trace ID of the active span to every line.
+// Without an active span it returns l.
+func requestLogger(ctx context.Context, l *log.Logger) *log.Logger {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return l
+	}
+	return log.New(l.Writer(), fmt.Sprintf("%strace_id=%s ", l.Prefix(), spanContext.TraceID()), l.Flags())
+}
+
+// traceID returns the trace ID of the active span, empty without one.
+func traceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// observeWithTraceID observes the value with the trace ID as exemplar, so dashboards can drill down from a
+// latency bucket to a trace of a request that landed in it. Without a trace ID it is a plain observation.
+func observeWithTraceID(observer prometheus.Observer, value float64, traceID string) {
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && len(traceID) > 0 {
+		exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	observer.Observe(value)
+}
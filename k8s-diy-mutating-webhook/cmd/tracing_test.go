@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestMutateLogsTraceID(t *testing.T) {
+	setupTracing()
+	tests := []struct {
+		name   string
+		review func(review *admissionv1.AdmissionReview)
+	}{
+		{
+			name:   "rule lines",
+			review: func(*admissionv1.AdmissionReview) {},
+		},
+		{
+			name: "error response",
+			review: func(review *admissionv1.AdmissionReview) {
+				review.Request.Resource = metav1.GroupVersionResource{Version: "v1", Resource: "services"}
+			},
+		},
+		{
+			name: "subresource",
+			review: func(review *admissionv1.AdmissionReview) {
+				review.Request.SubResource = "status"
+			},
+		},
+		{
+			name: "list",
+			review: func(review *admissionv1.AdmissionReview) {
+				review.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"PodList","items":[]}`)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			wh := testWebhook(t, `
+rules:
+- name: pull-policy
+  dryRun: true
+  imagePullPolicy: {default: IfNotPresent}
+`)
+			wh.tracing = true
+			review := podReview(t, testPod(t, cachedPod))
+			test.review(review)
+			body, err := json.Marshal(review)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			r.Header.Set(ContentTypeKey, ContentTypeJSON)
+			r.Header.Set("traceparent", testTraceParent)
+			wh.mutate(httptest.NewRecorder(), r)
+
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) < 2 {
+				t.Fatalf("got log lines %q, want the request line and more", lines)
+			}
+			for _, line := range lines {
+				if !strings.Contains(line, "trace_id=4bf92f3577b34da6a3ce929d0e0e4736 ") {
+					t.Errorf("line without trace ID: %s", line)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateOmitsTraceIDWithoutTracing(t *testing.T) {
+	logs := captureLogs(t)
+	wh := testWebhook(t, "rules: [{name: pull-policy, dryRun: true, imagePullPolicy: {default: IfNotPresent}}]\n")
+	body, err := json.Marshal(podReview(t, testPod(t, cachedPod)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	r.Header.Set(ContentTypeKey, ContentTypeJSON)
+	r.Header.Set("traceparent", testTraceParent)
+	wh.mutate(httptest.NewRecorder(), r)
+
+	if len(logs.String()) == 0 || strings.Contains(logs.String(), "trace_id=") {
+		t.Errorf("got logs %q, want lines without trace ID", logs)
+	}
+}
+
+func TestRuleDurationExemplars(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		tracing bool
+		want    string
+	}{
+		{name: "tracing", tracing: true, want: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "no tracing"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setupTracing()
+			resetMetrics(t)
+			captureLogs(t)
+			wh := testWebhook(t, "rules: [{name: limits, limits: {cpu: 100m}}]\n")
+			wh.tracing = test.tracing
+			body, err := json.Marshal(podReview(t, testPod(t, cachedPod)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			r.Header.Set(ContentTypeKey, ContentTypeJSON)
+			r.Header.Set("traceparent", testTraceParent)
+			wh.mutate(httptest.NewRecorder(), r)
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(ruleDuration)
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var traceIDs []string
+			for _, family := range families {
+				for _, metric := range family.GetMetric() {
+					for _, bucket := range metric.GetHistogram().GetBucket() {
+						for _, label := range bucket.GetExemplar().GetLabel() {
+							if label.GetName() == "trace_id" {
+								traceIDs = append(traceIDs, label.GetValue())
+							}
+						}
+					}
+				}
+			}
+			if len(test.want) == 0 {
+				if len(traceIDs) > 0 {
+					t.Errorf("got exemplars with trace IDs %q, want none", traceIDs)
+				}
+				return
+			}
+			if len(traceIDs) != 1 || traceIDs[0] != test.want {
+				t.Errorf("got exemplars with trace IDs %q, want %s", traceIDs, test.want)
+			}
+		})
+	}
+}
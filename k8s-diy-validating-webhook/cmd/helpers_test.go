@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/pflag"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// testWebhook returns a webhook set up like runValidatingWebhook does with the default flags. It also creates
+// the denials metric, which registerMetrics would.
+func testWebhook(t *testing.T) *validatingWebhook {
+	t.Helper()
+	denials = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "denials_total"}, []string{"reason"})
+	return &validatingWebhook{
+		name:                  "test-webhook",
+		denyTemplate:          template.Must(template.New("deny-message").Option("missingkey=error").Parse(defaultDenyMessageTemplate)),
+		latestTagPolicy:       PolicyAllow,
+		dockerSocketPolicy:    PolicyAllow,
+		hostPathPolicy:        PolicyAllow,
+		missingRequestsPolicy: PolicyAllow,
+		requiredRequests:      RequireBoth,
+	}
+}
+
+// podReview returns the review of a request creating the pod of the YAML manifest in the default namespace.
+func podReview(t *testing.T, manifest string) *admissionv1.AdmissionReview {
+	t.Helper()
+	pod := &corev1.Pod{}
+	if err := yaml.UnmarshalStrict([]byte(manifest), pod); err != nil {
+		t.Fatalf("can't decode pod: %v", err)
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: "default",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// postReview sends the review to the handler as JSON and returns the recorded response.
+func postReview(t *testing.T, handler http.HandlerFunc, review *admissionv1.AdmissionReview) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+	r.Header.Set(ContentTypeKey, ContentTypeJSON)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// admissionResponse sends the review to the handler and decodes the admission response it answers with.
+func admissionResponse(t *testing.T, handler http.HandlerFunc, review *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	t.Helper()
+	w := postReview(t, handler, review)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	response := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+		t.Fatalf("can't decode response: %v", err)
+	}
+	if response.Response == nil {
+		t.Fatalf("review without response: %s", w.Body)
+	}
+	return response.Response
+}
+
+// captureLogs redirects both loggers into the returned buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	out, errOut := logger.Writer(), errorLogger.Writer()
+	logger.SetOutput(buffer)
+	errorLogger.SetOutput(buffer)
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		errorLogger.SetOutput(errOut)
+	})
+	return buffer
+}
+
+// runWithFlags runs the root command with the flags on top of a TLS key pair, up to the error it returns.
+// It is meant for rejected flags, it would serve otherwise. The flags are reset when the test ends.
+func runWithFlags(t *testing.T, args ...string) error {
+	t.Helper()
+	captureLogs(t)
+	registerer, prefix := prometheus.DefaultRegisterer, logger.Prefix()
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+	t.Cleanup(func() {
+		prometheus.DefaultRegisterer = registerer
+		logger.SetPrefix(prefix)
+		errorLogger.SetPrefix(prefix)
+		rootCmd.Flags().VisitAll(func(f *pflag.Flag) {
+			if slice, ok := f.Value.(pflag.SliceValue); ok {
+				slice.Replace(nil)
+			} else {
+				f.Value.Set(f.DefValue)
+			}
+			f.Changed = false
+		})
+	})
+	if err := rootCmd.Flags().Parse(append([]string{"--tls-cert", "tls.crt", "--tls-key", "tls.key"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return runValidatingWebhook(rootCmd, nil)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultMetricsPrefix is the default namespace of the metric names, set with --metrics-prefix.
+const defaultMetricsPrefix = "diy_webhook"
+
+var metricsPrefixPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Denial reasons, used as the reason label of the denials metric.
+const (
+	ReasonDisallowedRegistry = "disallowed_registry"
+	ReasonLatestTag          = "latest_tag"
+	ReasonDockerSocket       = "docker_socket"
+	ReasonDisallowedHostPath = "disallowed_host_path"
+	ReasonMissingRequests    = "missing_requests"
+)
+
+var denials *prometheus.CounterVec
+
+// registerMetrics creates the collectors with names prefixed by prefix and registers them for export.
+func registerMetrics(prefix string) error {
+	if !metricsPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("invalid metrics prefix %q, expected letters, digits and underscores", prefix)
+	}
+	denials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "denials_total",
+		Help:      "Number of denied pods by reason, a pod denied for several reasons counts under each.",
+	}, []string{"reason"})
+	prometheus.MustRegister(denials)
+	return nil
+}
+
+// runMetricsServer serves the Prometheus metrics over plain HTTP on the given port.
+func runMetricsServer(port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := http.Server{
+		Addr:     fmt.Sprintf(":%d", port),
+		Handler:  mux,
+		ErrorLog: errorLogger,
+	}
+
+	if err := server.ListenAndServe(); err != nil {
+		errorLogger.Printf("metrics server stopped: %v", err)
+	}
+}
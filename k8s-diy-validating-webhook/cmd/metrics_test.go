@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDenialsByReason(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		reasons []string
+		pod     string
+	}{
+		{
+			name:    ReasonDisallowedRegistry,
+			reasons: []string{ReasonDisallowedRegistry},
+			pod:     "spec:\n  containers:\n  - name: app\n    image: quay.io/app:1.0\n    resources: {requests: {cpu: 100m, memory: 64Mi}}\n",
+		},
+		{
+			name:    ReasonLatestTag,
+			reasons: []string{ReasonLatestTag},
+			pod:     "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx:latest\n    resources: {requests: {cpu: 100m, memory: 64Mi}}\n",
+		},
+		{
+			// The Docker socket is a host path outside the allowed prefixes too.
+			name:    ReasonDockerSocket,
+			reasons: []string{ReasonDockerSocket, ReasonDisallowedHostPath},
+			pod: `
+spec:
+  containers:
+  - name: app
+    image: docker.io/nginx:1.23
+    resources: {requests: {cpu: 100m, memory: 64Mi}}
+  volumes:
+  - name: docker
+    hostPath: {path: /var/run/docker.sock}
+`,
+		},
+		{
+			name:    ReasonDisallowedHostPath,
+			reasons: []string{ReasonDisallowedHostPath},
+			pod: `
+spec:
+  containers:
+  - name: app
+    image: docker.io/nginx:1.23
+    resources: {requests: {cpu: 100m, memory: 64Mi}}
+  volumes:
+  - name: logs
+    hostPath: {path: /var/log}
+`,
+		},
+		{
+			name:    ReasonMissingRequests,
+			reasons: []string{ReasonMissingRequests},
+			pod:     "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx:1.23\n",
+		},
+		{
+			name:    "several reasons",
+			reasons: []string{ReasonLatestTag, ReasonDisallowedHostPath},
+			pod: `
+spec:
+  containers:
+  - name: app
+    image: docker.io/nginx:latest
+    resources: {requests: {cpu: 100m, memory: 64Mi}}
+  volumes:
+  - name: logs
+    hostPath: {path: /var/log}
+`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			captureLogs(t)
+			wh := testWebhook(t)
+			wh.latestTagPolicy, wh.dockerSocketPolicy, wh.hostPathPolicy, wh.missingRequestsPolicy = PolicyDeny, PolicyDeny, PolicyDeny, PolicyDeny
+			if response := admissionResponse(t, wh.validate, podReview(t, test.pod)); response.Allowed {
+				t.Fatal("pod allowed")
+			}
+			for _, reason := range []string{ReasonDisallowedRegistry, ReasonLatestTag, ReasonDockerSocket, ReasonDisallowedHostPath, ReasonMissingRequests} {
+				want := 0.0
+				for _, denied := range test.reasons {
+					if reason == denied {
+						want = 1
+					}
+				}
+				if count := testutil.ToFloat64(denials.WithLabelValues(reason)); count != want {
+					t.Errorf("counted %v denials for %s, want %v", count, reason, want)
+				}
+			}
+		})
+	}
+
+	t.Run("warning", func(t *testing.T) {
+		captureLogs(t)
+		wh := testWebhook(t)
+		wh.latestTagPolicy = PolicyWarn
+		admissionResponse(t, wh.validate, podReview(t, "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx\n"))
+		if count := testutil.CollectAndCount(denials); count != 0 {
+			t.Errorf("counted denials for %d reasons, want none for a warning", count)
+		}
+	})
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	registerer := prometheus.DefaultRegisterer
+	registry := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer = registry
+	t.Cleanup(func() { prometheus.DefaultRegisterer = registerer })
+
+	if err := registerMetrics("acme_admission"); err != nil {
+		t.Fatal(err)
+	}
+	denials.WithLabelValues(ReasonLatestTag).Inc()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "acme_admission_denials_total" {
+		t.Errorf("got metric families %v, want acme_admission_denials_total", families)
+	}
+
+	if err := registerMetrics("acme-admission"); err == nil || !strings.Contains(err.Error(), `invalid metrics prefix "acme-admission"`) {
+		t.Errorf("got error %v, want the prefix rejected", err)
+	}
+}
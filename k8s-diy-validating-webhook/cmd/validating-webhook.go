@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -15,7 +16,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"text/template"
 )
 
 var rootCmd = &cobra.Command{
@@ -27,12 +31,53 @@ validating-webhook --port <port> --tls-cert <tls_cert> --tls-key <tls_key>`,
 	RunE: runValidatingWebhook,
 }
 
-var logger = log.New(os.Stdout, "", log.LstdFlags)
+// logger logs informational lines, errorLogger warnings and errors. Both write to stdout unless the
+// errors are split off to stderr with --log-errors-to-stderr.
+var (
+	logger      = log.New(os.Stdout, "", log.LstdFlags)
+	errorLogger = log.New(os.Stdout, "", log.LstdFlags)
+)
 
 func init() {
 	rootCmd.Flags().String("tls-cert", "", "TLS Certificate")
 	rootCmd.Flags().String("tls-key", "", "Key for TLS Certificate")
 	rootCmd.Flags().Int("port", 8443, "Port to listen on")
+	rootCmd.Flags().Int("metrics-port", 8080, "Port to serve metrics on, 0 disables the metrics listener")
+	rootCmd.Flags().String("metrics-prefix", defaultMetricsPrefix, "Prefix of the exported metric names")
+	rootCmd.Flags().Bool("log-errors-to-stderr", false, "Write warnings and errors to stderr and only the informational lines to stdout")
+	rootCmd.Flags().String("webhook-name", filepath.Base(os.Args[0]), "Name included in warnings, audit annotations and logs")
+	rootCmd.Flags().String("latest-tag-policy", PolicyAllow, "What to do with images using the latest tag or no tag: allow, warn or deny")
+	rootCmd.Flags().String("docker-socket-policy", PolicyAllow, "What to do with pods mounting the Docker socket from the host: allow, warn or deny")
+	rootCmd.Flags().String("host-path-policy", PolicyAllow, "What to do with pods mounting host paths outside the allowed prefixes: allow, warn or deny")
+	rootCmd.Flags().StringSlice("allowed-host-path-prefixes", nil, "Host path prefixes pods may mount under the warn or deny host path policy, like /var/log")
+	rootCmd.Flags().String("missing-requests-policy", PolicyAllow, "What to do with pods whose containers lack cpu or memory requests: allow, warn or deny")
+	rootCmd.Flags().String("required-requests", RequireBoth, "Requests a container must set under the warn or deny missing requests policy: both (cpu and memory) or either")
+	rootCmd.Flags().String("deny-message-template", defaultDenyMessageTemplate, "Go template of the deny message, with .Namespace, .PodName, .Reason and .Message")
+}
+
+const defaultDenyMessageTemplate = "{{.Message}}"
+
+// Policies of the validations that can warn instead of deny.
+const (
+	PolicyAllow = "allow"
+	PolicyWarn  = "warn"
+	PolicyDeny  = "deny"
+)
+
+// Requests required by the missing requests policy.
+const (
+	RequireBoth   = "both"
+	RequireEither = "either"
+)
+
+// denyMessageData holds the variables of the deny message template.
+type denyMessageData struct {
+	Namespace string
+	PodName   string
+	// Reason is the denial reason, as in the reason label of the denials metric.
+	Reason string
+	// Message is the built-in deny message.
+	Message string
 }
 
 func runValidatingWebhook(cmd *cobra.Command, _ []string) error {
@@ -54,7 +99,98 @@ func runValidatingWebhook(cmd *cobra.Command, _ []string) error {
 	if err != nil {
 		return err
 	}
-	err = runValidatingWebhookServer(tlsCert, tlsKey, port)
+	webhookName, err := cmd.Flags().GetString("webhook-name")
+	if err != nil {
+		return err
+	}
+	logger.SetPrefix(fmt.Sprintf("[%s] ", webhookName))
+	errorLogger.SetPrefix(logger.Prefix())
+	logErrorsToStderr, err := cmd.Flags().GetBool("log-errors-to-stderr")
+	if err != nil {
+		return err
+	}
+	if logErrorsToStderr {
+		errorLogger.SetOutput(os.Stderr)
+	}
+	metricsPort, err := cmd.Flags().GetInt("metrics-port")
+	if err != nil {
+		return err
+	}
+	metricsPrefix, err := cmd.Flags().GetString("metrics-prefix")
+	if err != nil {
+		return err
+	}
+	if err := registerMetrics(metricsPrefix); err != nil {
+		return err
+	}
+	denyMessage, err := cmd.Flags().GetString("deny-message-template")
+	if err != nil {
+		return err
+	}
+	denyTemplate, err := template.New("deny-message").Option("missingkey=error").Parse(denyMessage)
+	if err == nil {
+		// Fields the data doesn't have only fail on execution, so a typo would fail every denial.
+		err = denyTemplate.Execute(ioutil.Discard, denyMessageData{})
+	}
+	if err != nil {
+		return fmt.Errorf("invalid deny message template: %v", err)
+	}
+	latestTagPolicy, err := cmd.Flags().GetString("latest-tag-policy")
+	if err != nil {
+		return err
+	}
+	if latestTagPolicy != PolicyAllow && latestTagPolicy != PolicyWarn && latestTagPolicy != PolicyDeny {
+		return fmt.Errorf("unknown latest tag policy %q, expected %s, %s or %s", latestTagPolicy, PolicyAllow, PolicyWarn, PolicyDeny)
+	}
+	dockerSocketPolicy, err := cmd.Flags().GetString("docker-socket-policy")
+	if err != nil {
+		return err
+	}
+	if dockerSocketPolicy != PolicyAllow && dockerSocketPolicy != PolicyWarn && dockerSocketPolicy != PolicyDeny {
+		return fmt.Errorf("unknown docker socket policy %q, expected %s, %s or %s", dockerSocketPolicy, PolicyAllow, PolicyWarn, PolicyDeny)
+	}
+	hostPathPolicy, err := cmd.Flags().GetString("host-path-policy")
+	if err != nil {
+		return err
+	}
+	if hostPathPolicy != PolicyAllow && hostPathPolicy != PolicyWarn && hostPathPolicy != PolicyDeny {
+		return fmt.Errorf("unknown host path policy %q, expected %s, %s or %s", hostPathPolicy, PolicyAllow, PolicyWarn, PolicyDeny)
+	}
+	allowedHostPaths, err := cmd.Flags().GetStringSlice("allowed-host-path-prefixes")
+	if err != nil {
+		return err
+	}
+	for i, prefix := range allowedHostPaths {
+		if !path.IsAbs(prefix) {
+			return fmt.Errorf("please provide absolute host path prefixes, got %q", prefix)
+		}
+		allowedHostPaths[i] = path.Clean(prefix)
+	}
+	missingRequestsPolicy, err := cmd.Flags().GetString("missing-requests-policy")
+	if err != nil {
+		return err
+	}
+	if missingRequestsPolicy != PolicyAllow && missingRequestsPolicy != PolicyWarn && missingRequestsPolicy != PolicyDeny {
+		return fmt.Errorf("unknown missing requests policy %q, expected %s, %s or %s", missingRequestsPolicy, PolicyAllow, PolicyWarn, PolicyDeny)
+	}
+	requiredRequests, err := cmd.Flags().GetString("required-requests")
+	if err != nil {
+		return err
+	}
+	if requiredRequests != RequireBoth && requiredRequests != RequireEither {
+		return fmt.Errorf("unknown required requests %q, expected %s or %s", requiredRequests, RequireBoth, RequireEither)
+	}
+	wh := &validatingWebhook{
+		name:                  webhookName,
+		denyTemplate:          denyTemplate,
+		latestTagPolicy:       latestTagPolicy,
+		dockerSocketPolicy:    dockerSocketPolicy,
+		hostPathPolicy:        hostPathPolicy,
+		allowedHostPaths:      allowedHostPaths,
+		missingRequestsPolicy: missingRequestsPolicy,
+		requiredRequests:      requiredRequests,
+	}
+	err = runValidatingWebhookServer(tlsCert, tlsKey, port, metricsPort, wh)
 	if err != nil {
 		return err
 	}
@@ -83,6 +219,18 @@ func admissionReviewFromRequest(r *http.Request, deserializer runtime.Decoder) (
 		}
 		body = requestData
 	}
+	if len(body) == 0 {
+		return nil, errors.New("empty request body")
+	}
+
+	// Check the version first, a review of another version would otherwise fail with a generic decode error
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return nil, err
+	}
+	if typeMeta.APIVersion != admissionv1.SchemeGroupVersion.String() {
+		return nil, fmt.Errorf("unsupported admission version %q, expected %s", typeMeta.APIVersion, admissionv1.SchemeGroupVersion)
+	}
 
 	// Decode the request body into
 	admissionReviewRequest := &admissionv1.AdmissionReview{}
@@ -94,13 +242,35 @@ func admissionReviewFromRequest(r *http.Request, deserializer runtime.Decoder) (
 }
 
 func writeErrorResponse(w http.ResponseWriter, err error) {
-	logger.Printf(err.Error())
+	errorLogger.Printf(err.Error())
 	w.WriteHeader(http.StatusBadRequest)
 	w.Write([]byte(err.Error()))
 }
 
-func validate(w http.ResponseWriter, r *http.Request) {
-	log.Printf("validate request")
+type validatingWebhook struct {
+	// name identifies this webhook in audit annotations and logs.
+	name string
+	// denyTemplate renders the message of denied requests.
+	denyTemplate *template.Template
+	// latestTagPolicy is allow, warn or deny.
+	latestTagPolicy string
+	// dockerSocketPolicy is allow, warn or deny.
+	dockerSocketPolicy string
+	// hostPathPolicy is allow, warn or deny, for host paths outside allowedHostPaths.
+	hostPathPolicy   string
+	allowedHostPaths []string
+	// missingRequestsPolicy is allow, warn or deny, for containers without the requiredRequests.
+	missingRequestsPolicy string
+	requiredRequests      string
+}
+
+// warning prefixes the message with the webhook name, so users can tell which webhook it came from.
+func (wh *validatingWebhook) warning(message string) string {
+	return fmt.Sprintf("%s: %s", wh.name, message)
+}
+
+func (wh *validatingWebhook) validate(w http.ResponseWriter, r *http.Request) {
+	logger.Printf("validate request")
 
 	// https://godoc.org/k8s.io/apimachinery/pkg/runtime#Scheme
 	scheme := runtime.NewScheme()
@@ -121,6 +291,13 @@ func validate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Subresources like pods/status or pods/exec don't carry a pod spec to act on.
+	if subResource := admissionReviewRequest.Request.SubResource; len(subResource) > 0 {
+		logger.Printf("skipping request for subresource pods/%s", subResource)
+		wh.writeAdmissionResponse(w, admissionReviewRequest, &admissionv1.AdmissionResponse{Allowed: true})
+		return
+	}
+
 	rawRequest := admissionReviewRequest.Request.Object.Raw
 	pod := corev1.Pod{}
 	if _, _, err := deserializer.Decode(rawRequest, nil, &pod); err != nil {
@@ -133,14 +310,180 @@ func validate(w http.ResponseWriter, r *http.Request) {
 
 	for _, container := range pod.Spec.Containers {
 		if !strings.HasPrefix(container.Image, "docker.io") {
-			admissionResponse.Allowed = false
-			admissionResponse.Result = &metav1.Status{
-				Message: "only container from docker.io are allowed",
-			}
+			wh.deny(admissionResponse, denyMessageData{
+				Namespace: admissionReviewRequest.Request.Namespace,
+				PodName:   pod.Name,
+				Reason:    ReasonDisallowedRegistry,
+				Message:   "only container from docker.io are allowed",
+			})
 			break
 		}
 	}
 
+	if wh.latestTagPolicy != PolicyAllow {
+		var unpinned []string
+		for _, container := range pod.Spec.Containers {
+			if usesLatestTag(container.Image) {
+				unpinned = append(unpinned, fmt.Sprintf("%s (%s)", container.Name, container.Image))
+			}
+		}
+		if len(unpinned) > 0 {
+			wh.enforce(wh.latestTagPolicy, admissionResponse, denyMessageData{
+				Namespace: admissionReviewRequest.Request.Namespace,
+				PodName:   pod.Name,
+				Reason:    ReasonLatestTag,
+				Message:   fmt.Sprintf("containers use the latest tag or no tag, pin a version: %s", strings.Join(unpinned, ", ")),
+			})
+		}
+	}
+
+	if wh.dockerSocketPolicy != PolicyAllow {
+		var volumes []string
+		for _, volume := range pod.Spec.Volumes {
+			if volume.HostPath != nil && mountsDockerSocket(volume.HostPath.Path) {
+				volumes = append(volumes, fmt.Sprintf("%s (%s)", volume.Name, volume.HostPath.Path))
+			}
+		}
+		if len(volumes) > 0 {
+			wh.enforce(wh.dockerSocketPolicy, admissionResponse, denyMessageData{
+				Namespace: admissionReviewRequest.Request.Namespace,
+				PodName:   pod.Name,
+				Reason:    ReasonDockerSocket,
+				Message:   fmt.Sprintf("volumes mount the Docker socket of the host, which gives root access to the node: %s", strings.Join(volumes, ", ")),
+			})
+		}
+	}
+
+	if wh.hostPathPolicy != PolicyAllow {
+		var volumes []string
+		for _, volume := range pod.Spec.Volumes {
+			if volume.HostPath != nil && !wh.hostPathAllowed(volume.HostPath.Path) {
+				volumes = append(volumes, fmt.Sprintf("%s (%s)", volume.Name, volume.HostPath.Path))
+			}
+		}
+		if len(volumes) > 0 {
+			message := fmt.Sprintf("volumes mount host paths, which aren't allowed: %s", strings.Join(volumes, ", "))
+			if len(wh.allowedHostPaths) > 0 {
+				message = fmt.Sprintf("volumes mount host paths outside the allowed prefixes %s: %s", strings.Join(wh.allowedHostPaths, ", "), strings.Join(volumes, ", "))
+			}
+			wh.enforce(wh.hostPathPolicy, admissionResponse, denyMessageData{
+				Namespace: admissionReviewRequest.Request.Namespace,
+				PodName:   pod.Name,
+				Reason:    ReasonDisallowedHostPath,
+				Message:   message,
+			})
+		}
+	}
+
+	if wh.missingRequestsPolicy != PolicyAllow {
+		var containers []string
+		for _, container := range pod.Spec.Containers {
+			if missing := wh.missingRequests(container.Resources.Requests); len(missing) > 0 {
+				containers = append(containers, fmt.Sprintf("%s (%s)", container.Name, strings.Join(missing, ", ")))
+			}
+		}
+		if len(containers) > 0 {
+			wh.enforce(wh.missingRequestsPolicy, admissionResponse, denyMessageData{
+				Namespace: admissionReviewRequest.Request.Namespace,
+				PodName:   pod.Name,
+				Reason:    ReasonMissingRequests,
+				Message:   fmt.Sprintf("containers lack resource requests, which the scheduler places pods by: %s", strings.Join(containers, ", ")),
+			})
+		}
+	}
+
+	wh.writeAdmissionResponse(w, admissionReviewRequest, admissionResponse)
+}
+
+// missingRequests returns the cpu and memory requests missing from requests. With requiredRequests either,
+// nothing is missing as long as one of them is set.
+func (wh *validatingWebhook) missingRequests(requests corev1.ResourceList) []string {
+	var missing []string
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if _, ok := requests[name]; !ok {
+			missing = append(missing, string(name))
+		}
+	}
+	if wh.requiredRequests == RequireEither && len(missing) < 2 {
+		return nil
+	}
+	return missing
+}
+
+// hostPathAllowed reports whether the host path is one of the allowed prefixes or below one. Paths are cleaned
+// first, so /var/log/../run doesn't pass as /var/log.
+func (wh *validatingWebhook) hostPathAllowed(hostPath string) bool {
+	hostPath = path.Clean(hostPath)
+	for _, prefix := range wh.allowedHostPaths {
+		if hostPath == prefix || prefix == "/" || strings.HasPrefix(hostPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// usesLatestTag reports whether the image uses the latest tag, or no tag which defaults to latest.
+// Images pinned by digest never do.
+func usesLatestTag(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	return i < 0 || name[i+1:] == "latest"
+}
+
+// dockerSocketPaths are the host paths of the Docker socket, /var/run usually links to /run.
+var dockerSocketPaths = []string{"/var/run/docker.sock", "/run/docker.sock"}
+
+// mountsDockerSocket reports whether a hostPath volume of the path exposes the Docker socket, either the
+// socket itself or one of its parent directories.
+func mountsDockerSocket(hostPath string) bool {
+	hostPath = path.Clean(hostPath)
+	for _, socket := range dockerSocketPaths {
+		if hostPath == socket || hostPath == "/" || strings.HasPrefix(socket, hostPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// enforce denies the pod under the deny policy and only warns under the warn policy.
+func (wh *validatingWebhook) enforce(policy string, admissionResponse *admissionv1.AdmissionResponse, data denyMessageData) {
+	if policy == PolicyDeny {
+		wh.deny(admissionResponse, data)
+		return
+	}
+	admissionResponse.Warnings = append(admissionResponse.Warnings, wh.warning(data.Message))
+}
+
+// deny rejects the pod with the rendered deny message and counts the denial by reason. If the template
+// fails to render, the built-in message is used. A pod denied for several reasons gets their messages joined.
+func (wh *validatingWebhook) deny(admissionResponse *admissionv1.AdmissionResponse, data denyMessageData) {
+	denials.WithLabelValues(data.Reason).Inc()
+	message := data.Message
+	var rendered bytes.Buffer
+	if err := wh.denyTemplate.Execute(&rendered, data); err != nil {
+		errorLogger.Printf("can't render deny message: %v", err)
+	} else {
+		message = rendered.String()
+	}
+	if !admissionResponse.Allowed && admissionResponse.Result != nil {
+		message = admissionResponse.Result.Message + "; " + message
+	}
+	admissionResponse.Allowed = false
+	admissionResponse.Result = &metav1.Status{
+		Message: message,
+	}
+}
+
+// writeAdmissionResponse wraps the response into an AdmissionReview matching the request and writes it.
+func (wh *validatingWebhook) writeAdmissionResponse(w http.ResponseWriter, admissionReviewRequest *admissionv1.AdmissionReview, admissionResponse *admissionv1.AdmissionResponse) {
+	if admissionResponse.AuditAnnotations == nil {
+		admissionResponse.AuditAnnotations = map[string]string{}
+	}
+	admissionResponse.AuditAnnotations["webhook-name"] = wh.name
+
 	var admissionReviewResponse admissionv1.AdmissionReview
 	admissionReviewResponse.Response = admissionResponse
 	admissionReviewResponse.SetGroupVersionKind(admissionReviewRequest.GroupVersionKind())
@@ -156,24 +499,27 @@ func validate(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
-func runValidatingWebhookServer(tlsCert, tlsKey string, port int) error {
+func runValidatingWebhookServer(tlsCert, tlsKey string, port, metricsPort int, wh *validatingWebhook) error {
 	logger.Print("Starting DIY validating webhook server")
 	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
 	if err != nil {
-		logger.Fatal(err)
+		errorLogger.Fatal(err)
 	}
 
-	http.HandleFunc("/validate", validate)
+	if metricsPort > 0 {
+		go runMetricsServer(metricsPort)
+	}
+	http.HandleFunc("/validate", wh.validate)
 	server := http.Server{
 		Addr: fmt.Sprintf(":%d", port),
 		TLSConfig: &tls.Config{
 			Certificates: []tls.Certificate{cert},
 		},
-		ErrorLog: logger,
+		ErrorLog: errorLogger,
 	}
 
 	if err := server.ListenAndServeTLS("", ""); err != nil {
-		logger.Panic(err)
+		errorLogger.Panic(err)
 	}
 	return nil
 }
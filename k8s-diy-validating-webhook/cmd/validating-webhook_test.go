@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestValidateNamesWebhook(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t)
+	wh.latestTagPolicy = PolicyWarn
+	response := admissionResponse(t, wh.validate, podReview(t, `
+spec:
+  containers:
+  - name: app
+    image: docker.io/nginx
+`))
+	if !response.Allowed {
+		t.Fatalf("pod denied: %v", response.Result)
+	}
+	if len(response.Warnings) != 1 || !strings.HasPrefix(response.Warnings[0], "test-webhook: ") {
+		t.Errorf("got warnings %q, want one prefixed with the webhook name", response.Warnings)
+	}
+	if name := response.AuditAnnotations["webhook-name"]; name != "test-webhook" {
+		t.Errorf("got webhook-name audit annotation %q", name)
+	}
+}
+
+func TestEmptyRequestBody(t *testing.T) {
+	logs := captureLogs(t)
+	r := httptest.NewRequest(http.MethodPost, "/validate", nil)
+	r.Header.Set(ContentTypeKey, ContentTypeJSON)
+	w := httptest.NewRecorder()
+	testWebhook(t).validate(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "empty request body") {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(logs.String(), "empty request body") {
+		t.Errorf("got logs %q, want the empty body logged", logs)
+	}
+}
+
+func TestValidateSkipsSubresources(t *testing.T) {
+	logs := captureLogs(t)
+	wh := testWebhook(t)
+	wh.latestTagPolicy = PolicyDeny
+	for _, test := range []struct {
+		subResource string
+		object      string
+	}{
+		{subResource: "status", object: `{"apiVersion":"v1","kind":"Pod","spec":{"containers":[{"name":"app","image":"docker.io/nginx"}]}}`},
+		{subResource: "exec", object: `{"apiVersion":"v1","kind":"PodExecOptions","command":["sh"]}`},
+	} {
+		review := podReview(t, "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx\n")
+		review.Request.SubResource = test.subResource
+		review.Request.Object.Raw = []byte(test.object)
+		if response := admissionResponse(t, wh.validate, review); !response.Allowed {
+			t.Errorf("pods/%s request denied: %v", test.subResource, response.Result)
+		}
+		if line := "skipping request for subresource pods/" + test.subResource; !strings.Contains(logs.String(), line) {
+			t.Errorf("got logs %q, want %q", logs, line)
+		}
+	}
+}
+
+func TestUnsupportedAdmissionVersion(t *testing.T) {
+	logs := captureLogs(t)
+	review := podReview(t, "spec:\n  containers:\n  - name: app\n")
+	review.APIVersion = "admission.k8s.io/v2"
+	w := postReview(t, testWebhook(t).validate, review)
+	want := `unsupported admission version "admission.k8s.io/v2", expected admission.k8s.io/v1`
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got status %d: %s, want %q", w.Code, w.Body, want)
+	}
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("got logs %q, want the unsupported version logged", logs)
+	}
+}
+
+func TestValidateRendersDenyMessage(t *testing.T) {
+	logs := captureLogs(t)
+	pod := "metadata:\n  name: web\nspec:\n  containers:\n  - name: app\n    image: quay.io/app:1.0\n"
+	for _, test := range []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "default",
+			template: defaultDenyMessageTemplate,
+			want:     "only container from docker.io are allowed",
+		},
+		{
+			name:     "remediation link",
+			template: "{{.Namespace}}/{{.PodName}} denied ({{.Reason}}): {{.Message}}, see https://wiki.example.com/{{.Reason}}",
+			want:     "default/web denied (disallowed_registry): only container from docker.io are allowed, see https://wiki.example.com/disallowed_registry",
+		},
+		{
+			name:     "template failing to render",
+			template: "{{.Team}}: {{.Message}}",
+			want:     "only container from docker.io are allowed",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wh := testWebhook(t)
+			wh.denyTemplate = template.Must(template.New("deny-message").Option("missingkey=error").Parse(test.template))
+			response := admissionResponse(t, wh.validate, podReview(t, pod))
+			if response.Allowed || response.Result == nil || response.Result.Message != test.want {
+				t.Errorf("got response %+v, want denied with %q", response, test.want)
+			}
+		})
+	}
+	if !strings.Contains(logs.String(), "can't render deny message") {
+		t.Errorf("got logs %q, want the render error logged", logs)
+	}
+}
+
+func TestValidateJoinsDenyMessages(t *testing.T) {
+	captureLogs(t)
+	wh := testWebhook(t)
+	wh.latestTagPolicy, wh.hostPathPolicy = PolicyDeny, PolicyDeny
+	wh.denyTemplate = template.Must(template.New("deny-message").Option("missingkey=error").Parse("{{.Reason}}: {{.Message}}"))
+	pod := "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx\n  volumes:\n  - name: host\n    hostPath: {path: /var/log}\n"
+	response := admissionResponse(t, wh.validate, podReview(t, pod))
+	want := "latest_tag: containers use the latest tag or no tag, pin a version: app (docker.io/nginx); " +
+		"disallowed_host_path: volumes mount host paths, which aren't allowed: host (/var/log)"
+	if response.Allowed || response.Result == nil || response.Result.Message != want {
+		t.Errorf("got response %+v, want denied with %q", response, want)
+	}
+}
+
+func TestRunRejectsInvalidDenyMessageTemplate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		template string
+		err      string
+	}{
+		{name: "syntax error", template: "{{.Message", err: "invalid deny message template"},
+		{name: "unknown field", template: "{{.Namespce}}: {{.Message}}", err: `can't evaluate field Namespce`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := runWithFlags(t, "--deny-message-template", test.template)
+			if err == nil || !strings.Contains(err.Error(), "invalid deny message template") || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidateLatestTag(t *testing.T) {
+	captureLogs(t)
+	for _, test := range []struct {
+		image string
+		// unpinned is whether the image uses the latest tag.
+		unpinned bool
+	}{
+		{image: "docker.io/nginx:latest", unpinned: true},
+		{image: "docker.io/nginx", unpinned: true},
+		{image: "docker.io/library/nginx:1.25", unpinned: false},
+		{image: "docker.io/nginx@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31", unpinned: false},
+	} {
+		pod := "metadata:\n  name: web\nspec:\n  containers:\n  - name: app\n    image: " + test.image + "\n"
+		message := "containers use the latest tag or no tag, pin a version: app (" + test.image + ")"
+
+		wh := testWebhook(t)
+		wh.latestTagPolicy = PolicyDeny
+		response := admissionResponse(t, wh.validate, podReview(t, pod))
+		if test.unpinned && (response.Allowed || response.Result == nil || response.Result.Message != message) {
+			t.Errorf("image %s with policy deny: got allowed %v and result %v, want denied with %q", test.image, response.Allowed, response.Result, message)
+		}
+		if !test.unpinned && !response.Allowed {
+			t.Errorf("image %s with policy deny: denied with %v", test.image, response.Result)
+		}
+
+		wh.latestTagPolicy = PolicyWarn
+		response = admissionResponse(t, wh.validate, podReview(t, pod))
+		var want []string
+		if test.unpinned {
+			want = []string{"test-webhook: " + message}
+		}
+		if !response.Allowed || !reflect.DeepEqual(response.Warnings, want) {
+			t.Errorf("image %s with policy warn: got allowed %v and warnings %q, want allowed with %q", test.image, response.Allowed, response.Warnings, want)
+		}
+	}
+}
+
+func TestLogsRoutedByLevel(t *testing.T) {
+	captureLogs(t)
+	var out, errOut bytes.Buffer
+	logger.SetOutput(&out)
+	errorLogger.SetOutput(&errOut)
+	wh := testWebhook(t)
+	admissionResponse(t, wh.validate, podReview(t, "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx:1.25\n"))
+	r := httptest.NewRequest(http.MethodPost, "/validate", nil)
+	r.Header.Set(ContentTypeKey, ContentTypeJSON)
+	wh.validate(httptest.NewRecorder(), r)
+
+	if !strings.Contains(out.String(), "validate request") || strings.Contains(out.String(), "empty request body") {
+		t.Errorf("got informational lines %q, want the requests without the error", out.String())
+	}
+	if !strings.Contains(errOut.String(), "empty request body") || strings.Contains(errOut.String(), "validate request") {
+		t.Errorf("got error lines %q, want only the error", errOut.String())
+	}
+}
+
+func TestValidateDockerSocket(t *testing.T) {
+	captureLogs(t)
+	for _, test := range []struct {
+		name string
+		// hostPath is the path of the hostPath volume, empty for an emptyDir volume.
+		hostPath string
+		mounts   bool
+	}{
+		{name: "socket", hostPath: "/var/run/docker.sock", mounts: true},
+		{name: "socket under /run", hostPath: "/run//docker.sock", mounts: true},
+		{name: "parent directory", hostPath: "/var/run/", mounts: true},
+		{name: "host root", hostPath: "/", mounts: true},
+		{name: "other host path", hostPath: "/var/log", mounts: false},
+		{name: "emptyDir", mounts: false},
+	} {
+		source := "emptyDir: {}"
+		if len(test.hostPath) > 0 {
+			source = "hostPath: {path: '" + test.hostPath + "'}"
+		}
+		pod := "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx:1.25\n  volumes:\n  - name: docker\n    " + source + "\n"
+		message := "volumes mount the Docker socket of the host, which gives root access to the node: docker (" + test.hostPath + ")"
+
+		wh := testWebhook(t)
+		wh.dockerSocketPolicy = PolicyDeny
+		response := admissionResponse(t, wh.validate, podReview(t, pod))
+		if test.mounts && (response.Allowed || response.Result == nil || response.Result.Message != message) {
+			t.Errorf("%s with policy deny: got allowed %v and result %v, want denied with %q", test.name, response.Allowed, response.Result, message)
+		}
+		if !test.mounts && !response.Allowed {
+			t.Errorf("%s with policy deny: denied with %v", test.name, response.Result)
+		}
+
+		wh.dockerSocketPolicy = PolicyWarn
+		response = admissionResponse(t, wh.validate, podReview(t, pod))
+		var want []string
+		if test.mounts {
+			want = []string{"test-webhook: " + message}
+		}
+		if !response.Allowed || !reflect.DeepEqual(response.Warnings, want) {
+			t.Errorf("%s with policy warn: got allowed %v and warnings %q, want allowed with %q", test.name, response.Allowed, response.Warnings, want)
+		}
+	}
+}
+
+func TestValidateHostPaths(t *testing.T) {
+	captureLogs(t)
+	for _, test := range []struct {
+		hostPath string
+		allowed  bool
+	}{
+		{hostPath: "/var/log", allowed: true},
+		{hostPath: "/var/log/pods", allowed: true},
+		{hostPath: "/etc/ssl/certs/", allowed: true},
+		{hostPath: "/var/log/../lib/kubelet", allowed: false},
+		{hostPath: "/var/logs", allowed: false},
+		{hostPath: "/", allowed: false},
+	} {
+		pod := "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx:1.25\n  volumes:\n  - name: host\n    hostPath: {path: '" + test.hostPath + "'}\n"
+		wh := testWebhook(t)
+		wh.hostPathPolicy = PolicyDeny
+		wh.allowedHostPaths = []string{"/var/log", "/etc/ssl/certs"}
+		response := admissionResponse(t, wh.validate, podReview(t, pod))
+		message := "volumes mount host paths outside the allowed prefixes /var/log, /etc/ssl/certs: host (" + test.hostPath + ")"
+		if test.allowed && !response.Allowed {
+			t.Errorf("host path %s: denied with %v", test.hostPath, response.Result)
+		}
+		if !test.allowed && (response.Allowed || response.Result == nil || response.Result.Message != message) {
+			t.Errorf("host path %s: got allowed %v and result %v, want denied with %q", test.hostPath, response.Allowed, response.Result, message)
+		}
+	}
+
+	// Without prefixes every host path is disallowed, the warn policy admits the pod with a warning.
+	wh := testWebhook(t)
+	wh.hostPathPolicy = PolicyWarn
+	response := admissionResponse(t, wh.validate, podReview(t, "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx:1.25\n  volumes:\n  - name: host\n    hostPath: {path: /var/log}\n"))
+	want := []string{"test-webhook: volumes mount host paths, which aren't allowed: host (/var/log)"}
+	if !response.Allowed || !reflect.DeepEqual(response.Warnings, want) {
+		t.Errorf("got allowed %v and warnings %q, want allowed with %q", response.Allowed, response.Warnings, want)
+	}
+}
+
+func TestValidateMissingRequests(t *testing.T) {
+	captureLogs(t)
+	full := "    resources:\n      requests: {cpu: 100m, memory: 128Mi}\n"
+	cpuOnly := "    resources:\n      requests: {cpu: 100m}\n"
+	for _, test := range []struct {
+		name     string
+		required string
+		// containers are the resources of the containers app and sidecar.
+		app, sidecar string
+		missing      string
+	}{
+		{name: "fully specified", required: RequireBoth, app: full, sidecar: full},
+		{name: "partially specified", required: RequireBoth, app: full, sidecar: cpuOnly, missing: "sidecar (memory)"},
+		{name: "no requests", required: RequireBoth, app: "", sidecar: cpuOnly, missing: "app (cpu, memory), sidecar (memory)"},
+		{name: "either with one request", required: RequireEither, app: full, sidecar: cpuOnly},
+		{name: "either without requests", required: RequireEither, app: "", sidecar: cpuOnly, missing: "app (cpu, memory)"},
+	} {
+		pod := "spec:\n  containers:\n  - name: app\n    image: docker.io/nginx:1.25\n" + test.app + "  - name: sidecar\n    image: docker.io/envoy:1.28\n" + test.sidecar
+		message := "containers lack resource requests, which the scheduler places pods by: " + test.missing
+
+		wh := testWebhook(t)
+		wh.missingRequestsPolicy = PolicyDeny
+		wh.requiredRequests = test.required
+		response := admissionResponse(t, wh.validate, podReview(t, pod))
+		if len(test.missing) > 0 && (response.Allowed || response.Result == nil || response.Result.Message != message) {
+			t.Errorf("%s with policy deny: got allowed %v and result %v, want denied with %q", test.name, response.Allowed, response.Result, message)
+		}
+		if len(test.missing) == 0 && !response.Allowed {
+			t.Errorf("%s with policy deny: denied with %v", test.name, response.Result)
+		}
+
+		wh.missingRequestsPolicy = PolicyWarn
+		response = admissionResponse(t, wh.validate, podReview(t, pod))
+		var want []string
+		if len(test.missing) > 0 {
+			want = []string{"test-webhook: " + message}
+		}
+		if !response.Allowed || !reflect.DeepEqual(response.Warnings, want) {
+			t.Errorf("%s with policy warn: got allowed %v and warnings %q, want allowed with %q", test.name, response.Allowed, response.Warnings, want)
+		}
+	}
+}